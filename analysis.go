@@ -0,0 +1,281 @@
+package main
+	// Runtime vs outdoor temperature analysis page, served with the charts on port 8081:
+	//		http://yo.ur.i.p:8081/infinitive/analysis?from=2025-10-01&to=2026-04-30&from2=2024-10-01&to2=2025-04-30&kw=3.5
+	// Each day in range gives one point, mean outdoor temperature against heating or cooling hours.
+	// Separate heating and cooling lines are fit, the balance point is where a line reaches zero runtime.
+	// The optional second range is fit the same way to compare season over season.
+	// The optional kw argument, the average draw while running, charts energy in kWh instead of hours.
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+)
+
+const minDaySamples		= 180		// Half a day of samples, partial days skew the fit
+const maxAnalysisDays	= 3*366		// Longest range, a few seasons to compare
+
+// One day of runtime split by heating and cooling
+type dayRuntime struct {
+	Date			time.Time
+	MeanOutdoor		float64
+	HeatHours		float64
+	CoolHours		float64
+}
+
+// Least squares line, Balance is the outdoor temperature where the fit reaches zero
+type lineFit struct {
+	N				int
+	Slope			float64
+	Intercept		float64
+	R2				float64
+	Balance			float64
+}
+
+// sampleIsHeating decides if a blower on sample is heating. In auto mode, compare indoor temp to the setpoint midpoint.
+func sampleIsHeating( s hvacSample ) bool {
+	switch {
+	case slices.Contains( heatModes, s.HvacMode ):
+		return true
+	case s.HvacMode == "cool":
+		return false
+	}
+	return 2*s.CurrentTemp <= s.HeatSet + s.CoolSet
+}	// sampleIsHeating
+
+// dailyRuntimes reads the daily rollups from..to inclusive, skipping partial days. Fan circulation is in neither
+// the heating nor the cooling hours, see rollup.add.
+func dailyRuntimes( from time.Time, to time.Time ) []dayRuntime {
+	var days []dayRuntime
+
+	list, err := rollupRange( rollupDay, from, to.AddDate(0, 0, 1) )
+	if err != nil {
+		chartsLog.Error( "dailyRuntimes - rollups read failure: ", err )
+	}
+	for _, r := range list {
+		if r.Samples < minDaySamples {
+			continue
+		}
+		days = append( days, dayRuntime{ Date: r.Start, MeanOutdoor: r.OutdoorMean, HeatHours: r.HeatHours, CoolHours: r.CoolHours } )
+	}
+	return days
+}	// dailyRuntimes
+
+// fitLine is ordinary least squares of y on x, false when there is too little data or no spread in x.
+func fitLine( x []float64, y []float64 ) ( lineFit, bool ) {
+	var sx, sy, sxx, sxy, syy float64
+
+	fit := lineFit{ N: len(x) }
+	if fit.N < 3 {
+		return fit, false
+	}
+	for i := range x {
+		sx  += x[i]
+		sy  += y[i]
+		sxx += x[i]*x[i]
+		sxy += x[i]*y[i]
+		syy += y[i]*y[i]
+	}
+	n   := float64( fit.N )
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return fit, false
+	}
+	fit.Slope     = ( n*sxy - sx*sy ) / den
+	fit.Intercept = ( sy - fit.Slope*sx ) / n
+	if vy := n*syy - sy*sy; vy != 0 {
+		r := ( n*sxy - sx*sy ) / math.Sqrt( den*vy )
+		fit.R2 = r*r
+	}
+	fit.Balance = math.NaN()
+	if fit.Slope != 0 {
+		fit.Balance = -fit.Intercept / fit.Slope
+	}
+	return fit, true
+}	// fitLine
+
+// Points and fits for one date range
+type rangeAnalysis struct {
+	Label			string
+	Days			[]dayRuntime
+	Heat, Cool		lineFit
+	HeatOK, CoolOK	bool
+}
+
+func analyzeRange( label string, from time.Time, to time.Time, scale float64 ) rangeAnalysis {
+	var hx, hy, cx, cy []float64
+
+	ra := rangeAnalysis{ Label: label, Days: dailyRuntimes(from, to) }
+	for _, d := range ra.Days {
+		if d.HeatHours > 0 {
+			hx = append( hx, d.MeanOutdoor )
+			hy = append( hy, d.HeatHours*scale )
+		}
+		if d.CoolHours > 0 {
+			cx = append( cx, d.MeanOutdoor )
+			cy = append( cy, d.CoolHours*scale )
+		}
+	}
+	ra.Heat, ra.HeatOK = fitLine( hx, hy )
+	ra.Cool, ra.CoolOK = fitLine( cx, cy )
+	return ra
+}	// analyzeRange
+
+// parseDateArg reads a YYYY-MM-DD query argument, def when absent.
+func parseDateArg( r *http.Request, name string, def time.Time ) ( time.Time, error ) {
+	arg := r.URL.Query().Get( name )
+	if arg == "" {
+		return def, nil
+	}
+	return time.ParseInLocation( "2006-01-02", arg, time.Local )
+}	// parseDateArg
+
+// analysisEnd stops a range at today, there is nothing to read after it.
+func analysisEnd( to time.Time, today time.Time ) time.Time {
+	if to.After( today ) {
+		return today
+	}
+	return to
+}	// analysisEnd
+
+// analysisHandler serves the form, the scatter chart with fitted lines, and the fit table.
+func analysisHandler( w http.ResponseWriter, r *http.Request ) {
+	var ranges []rangeAnalysis
+
+	now   := time.Now()
+	today := time.Date( now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local )
+	from, err1 := parseDateArg( r, "from", today.AddDate(-1, 0, 0) )
+	to,   err2 := parseDateArg( r, "to",   today )
+	if err1 != nil || err2 != nil || to.Before(from) {
+		http.Error( w, "from and to must be YYYY-MM-DD dates, from before to", http.StatusBadRequest )
+		return
+	}
+	if to = analysisEnd( to, today ); to.Sub(from) > maxAnalysisDays*24*time.Hour {
+		http.Error( w, fmt.Sprintf( "from to to is more than %d days", maxAnalysisDays ), http.StatusBadRequest )
+		return
+	}
+	unit, scale := "Hours", 1.0
+	if kw := r.URL.Query().Get( "kw" ); kw != "" {
+		var err error
+		if scale, err = strconv.ParseFloat( kw, 64 ); err != nil || scale <= 0 {
+			http.Error( w, "kw must be a positive number", http.StatusBadRequest )
+			return
+		}
+		unit = "kWh"
+	}
+	chartsLog.Debug( "analysisHandler - Range: ", from.Format("2006-01-02"), " to ", to.Format("2006-01-02") )
+	ranges = append( ranges, analyzeRange( from.Format("2006-01-02")+" to "+to.Format("2006-01-02"), from, to, scale ) )
+	if r.URL.Query().Get( "from2" ) != "" {
+		from2, err1 := parseDateArg( r, "from2", from )
+		to2,   err2 := parseDateArg( r, "to2",   to )
+		if err1 != nil || err2 != nil || to2.Before(from2) {
+			http.Error( w, "from2 and to2 must be YYYY-MM-DD dates, from2 before to2", http.StatusBadRequest )
+			return
+		}
+		if to2 = analysisEnd( to2, today ); to2.Sub(from2) > maxAnalysisDays*24*time.Hour {
+			http.Error( w, fmt.Sprintf( "from2 to to2 is more than %d days", maxAnalysisDays ), http.StatusBadRequest )
+			return
+		}
+		ranges = append( ranges, analyzeRange( from2.Format("2006-01-02")+" to "+to2.Format("2006-01-02"), from2, to2, scale ) )
+	}
+
+	scatter := charts.NewScatter()
+	scatter.SetGlobalOptions(
+		charts.WithInitializationOpts( opts.Initialization{ PageTitle: "Infinitive Analysis", Theme: types.ThemeWesteros, Width: "1100px", Height: "600px" } ),
+		charts.WithTitleOpts( opts.Title{ Title: "Infinitive HVAC Daily " + unit + " vs Outdoor Temp", Subtitle: "Vsn: " + Version } ),
+		charts.WithTooltipOpts( opts.Tooltip{ Show: true } ),
+		charts.WithLegendOpts( opts.Legend{ Show: true, Top: "bottom" } ),
+		charts.WithXAxisOpts( opts.XAxis{ Name: "Mean Outdoor Temp", Type: "value", Scale: true } ),
+		charts.WithYAxisOpts( opts.YAxis{ Name: unit + " per Day", Type: "value", Min: 0 } ),
+	)
+	lines := charts.NewLine()
+	for _, ra := range ranges {
+		heat := make( []opts.ScatterData, 0 )
+		cool := make( []opts.ScatterData, 0 )
+		for _, d := range ra.Days {
+			if d.HeatHours > 0 {
+				heat = append( heat, opts.ScatterData{ Name: d.Date.Format("2006-01-02"), Value: []float64{ d.MeanOutdoor, d.HeatHours*scale }, SymbolSize: 6 } )
+			}
+			if d.CoolHours > 0 {
+				cool = append( cool, opts.ScatterData{ Name: d.Date.Format("2006-01-02"), Value: []float64{ d.MeanOutdoor, d.CoolHours*scale }, SymbolSize: 6 } )
+			}
+		}
+		scatter.AddSeries( "Heat "+ra.Label, heat )
+		scatter.AddSeries( "Cool "+ra.Label, cool )
+		if ra.HeatOK {
+			lines.AddSeries( "Heat fit "+ra.Label, fitLineData(ra.Heat, ra.Days) )
+		}
+		if ra.CoolOK {
+			lines.AddSeries( "Cool fit "+ra.Label, fitLineData(ra.Cool, ra.Days) )
+		}
+	}
+	scatter.Overlap( lines )
+
+	// The chart page is rendered whole, the form and fit table go just after <body>.
+	var page bytes.Buffer
+	if err := scatter.Render( &page ); err != nil {
+		chartsLog.Error( "analysisHandler - Render failed: ", err )
+		http.Error( w, "chart render failed", http.StatusInternalServerError )
+		return
+	}
+	w.Header().Set( "Content-Type", "text/html; charset=utf-8" )
+	w.Write( []byte( strings.Replace( page.String(), "<body>", "<body>\n"+analysisForm(r)+analysisTable(ranges, unit), 1 ) ) )
+}	// analysisHandler
+
+// fitLineData spans the fitted line over the range's outdoor temperatures, clipped at zero runtime.
+func fitLineData( fit lineFit, days []dayRuntime ) []opts.LineData {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, d := range days {
+		lo = math.Min( lo, d.MeanOutdoor )
+		hi = math.Max( hi, d.MeanOutdoor )
+	}
+	if !math.IsNaN( fit.Balance ) {
+		lo = math.Min( lo, fit.Balance )
+		hi = math.Max( hi, fit.Balance )
+	}
+	data := make( []opts.LineData, 0, 2 )
+	for _, x := range []float64{ lo, hi } {
+		data = append( data, opts.LineData{ Value: []float64{ x, math.Max(0, fit.Intercept+fit.Slope*x) } } )
+	}
+	return data
+}	// fitLineData
+
+func analysisForm( r *http.Request ) string {
+	q := r.URL.Query()
+	field := func( name string, label string ) string {
+		return fmt.Sprintf( "%s <input name=\"%s\" value=\"%s\" size=\"10\"> ", label, name, html.EscapeString(q.Get(name)) )
+	}
+	return "<form method=\"get\">" + field("from", "From") + field("to", "To") + field("from2", "Compare from") + field("to2", "to") +
+		field("kw", "kW") + "<input type=\"submit\" value=\"Analyze\"></form>\n"
+}	// analysisForm
+
+func analysisTable( ranges []rangeAnalysis, unit string ) string {
+	var sb strings.Builder
+
+	sb.WriteString( "<table border=\"1\" style=\"border-collapse: collapse\">\n" )
+	sb.WriteString( "<tr><th>Range</th><th>Fit</th><th>Days</th><th>Balance Point</th><th>Slope " + unit + "/day/deg</th><th>R&sup2;</th></tr>\n" )
+	row := func( label string, name string, fit lineFit, ok bool ) {
+		if !ok {
+			fmt.Fprintf( &sb, "<tr><td>%s</td><td>%s</td><td>%d</td><td colspan=\"3\">not enough data</td></tr>\n", html.EscapeString(label), name, fit.N )
+			return
+		}
+		fmt.Fprintf( &sb, "<tr><td>%s</td><td>%s</td><td>%d</td><td>%.1f&deg;</td><td>%.3f</td><td>%.2f</td></tr>\n",
+			html.EscapeString(label), name, fit.N, fit.Balance, fit.Slope, fit.R2 )
+	}
+	for _, ra := range ranges {
+		row( ra.Label, "Heating", ra.Heat, ra.HeatOK )
+		row( ra.Label, "Cooling", ra.Cool, ra.CoolOK )
+	}
+	sb.WriteString( "</table>\n" )
+	return sb.String()
+}	// analysisTable
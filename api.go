@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
+	"io"
 	"time"
 
 	"github.com/acd/infinitive/internal/cache"
@@ -18,6 +20,7 @@ var	CoolSet			uint8		// set in GetConfig
 var	CurrentTemp     uint8		// set in GetConfig
 var	OutdoorTemp     int8		// set in GetConfig
 var	HvacMode		string		// set in GetConfig
+var	Stage			uint8		// set in GetConfig
 
 const (
 	blowerCacheKey   = "blower"
@@ -27,6 +30,7 @@ const (
 
 type Api struct {
 	ctx        context.Context
+	cancel     context.CancelFunc
 	Bus        *Bus
 	dispatcher *dispatcher.Dispatcher
 	Cache      *cache.Cache
@@ -38,6 +42,7 @@ func NewApi(ctx context.Context, device string) (*Api, error) {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	dispatcher := dispatcher.New(ctx)
 
 	cache := cache.New(dispatcher.BroadcastEvent)
@@ -47,6 +52,7 @@ func NewApi(ctx context.Context, device string) (*Api, error) {
 
 	api := &Api{
 		ctx:        ctx,
+		cancel:     cancel,
 		Bus:        bus,
 		dispatcher: dispatcher,
 		Cache:      cache,
@@ -56,6 +62,16 @@ func NewApi(ctx context.Context, device string) (*Api, error) {
 	return api, nil
 }
 
+// Added: Close stops the poller and the dispatcher, and closes the serial port, at shutdown.
+func (a *Api) Close() error {
+	a.cancel()
+	port, ok := interface{}(a.Bus.port).(io.Closer)
+	if !ok {
+		return errors.New("serial port can't be closed")
+	}
+	return port.Close()
+}
+
 func (a *Api) attachSnoops() {
 	// Snoop Heat Pump responses
 	a.Bus.SnoopResponse(filter(sourceRange(0x5000, 0x51ff), func(frame Frame) {
@@ -157,6 +173,7 @@ func (a *Api) GetConfig(zone int) (*TStatZoneConfig, bool) {
 	HeatSet		= cfg.GetZonalField(zone, "HeatSetpoint").(uint8)
 	CoolSet		= cfg.GetZonalField(zone, "CoolSetpoint").(uint8)
 	HvacMode	= RawModeToString(params.Mode & 0xf)
+	Stage		= params.Mode >> 5
 	return &TStatZoneConfig{
 		CurrentTemp:     params.GetZonalField(zone, "CurrentTemp").(uint8),
 		CurrentHumidity: params.GetZonalField(zone, "CurrentHumidity").(uint8),
@@ -171,6 +188,71 @@ func (a *Api) GetConfig(zone int) (*TStatZoneConfig, bool) {
 	}, true
 }
 
+// Added: the zone config as last read by the poller, without another bus read
+func (a *Api) GetZoneConfig() (*TStatZoneConfig, bool) {
+	c := a.Cache.Get(tstatCacheKey)
+	tc, ok := c.(*TStatZoneConfig)
+	if !ok {
+		return nil, false
+	}
+	cfg := *tc
+	return &cfg, true
+}
+
+// Added: writes the fields set in cfg (non-empty strings, non-nil hold, non-zero setpoints) for zone 1.
+// Mode is in a different table from the fan, hold and setpoints, so it is a second write.
+func (a *Api) UpdateZoneConfig(cfg TStatZoneConfig) bool {
+	params := TStatZoneParams{}
+	flags := uint8(0)
+	ok := true
+
+	if len(cfg.FanMode) > 0 {
+		mode, found := rawFromString(cfg.FanMode, 4, RawFanModeToString)
+		if !found {
+			return false
+		}
+		params.Z1FanMode = mode
+		flags |= 0x01
+	}
+	if cfg.Hold != nil {
+		if *cfg.Hold {
+			params.ZoneHold = 0x01
+		}
+		flags |= 0x02
+	}
+	if cfg.HeatSetpoint > 0 {
+		params.Z1HeatSetpoint = cfg.HeatSetpoint
+		flags |= 0x04
+	}
+	if cfg.CoolSetpoint > 0 {
+		params.Z1CoolSetpoint = cfg.CoolSetpoint
+		flags |= 0x08
+	}
+	if flags != 0 {
+		log.Debugf("UpdateZoneConfig writing zone params with flags: %x", flags)
+		ok = a.UpdateThermostat(&params, flags)
+	}
+
+	if len(cfg.Mode) > 0 {
+		mode, found := rawFromString(cfg.Mode, 16, RawModeToString)
+		if !found {
+			return false
+		}
+		ok = a.UpdateThermostat(&TStatCurrentParams{Mode: mode}, 0x10) && ok
+	}
+	return ok
+}
+
+// Added: reverse of the RawXxxToString tables, so the strings accepted are always the ones reported
+func rawFromString(s string, count int, toString func(uint8) string) (uint8, bool) {
+	for raw := 0; raw < count; raw++ {
+		if toString(uint8(raw)) == s {
+			return uint8(raw), true
+		}
+	}
+	return 0, false
+}
+
 func (a *Api) GetTstatSettings() (*TStatSettings, bool) {
 	tss := TStatSettings{}
 	if !a.Bus.ReadTable(DevTSTAT, &tss) {
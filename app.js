@@ -1,11 +1,23 @@
 console.log("loaded app.js");
 
 var app = angular.module('thermostatApp', ['ngWebSocket']);
-/* Add bounds checks */
-const   HeatSetMin  = 64;
-const   HeatSetMax  = 74;
-const   CoolSetMin  = 70;
-const   CoolSetMax  = 78;
+
+/* Sign in again when the session is gone, show refusals */
+app.config(function ($httpProvider) {
+  $httpProvider.interceptors.push(function ($q, $window) {
+    return {
+      responseError: function (response) {
+        if (response.status == 401) {
+          $window.location.href = "/login?next=" + encodeURIComponent("/ui/");
+        } else if (response.status >= 400 && response.status < 500 && response.data && response.data.error) {
+          $window.alert(response.data.error);
+        }
+        return $q.reject(response);
+      }
+    };
+  });
+});
+/* Bounds checks come from the server, GET /api/limits, and are enforced there too */
 
 /*
 app.factory('thermostatEvents', function($websocket) {
@@ -46,11 +58,268 @@ app.factory('thermostatEvents', function ($websocket) {
 );
 
 // Define the `PhoneListController` controller on the `phonecatApp` module
-app.controller('thermostatController', function($scope, $http, $interval, $location, thermostatEvents) {
+app.controller('thermostatController', function($scope, $http, $interval, $timeout, $location, thermostatEvents) {
   $scope.tstat = {};
   $scope.blower = {};
+  $scope.whoami = {};
+  $scope.limits = null;
+
+  $http.get("/api/limits").then(function(response) {
+    $scope.limits = response.data;
+  });
+
+  $scope.modeAllowed = function(mode) {
+    return !$scope.limits || $scope.limits.modes.indexOf(mode) >= 0;
+  }
+
+  $scope.fanModeAllowed = function(mode) {
+    return !$scope.limits || $scope.limits.fanModes.indexOf(mode) >= 0;
+  }
+
+  $http.get("/api/whoami").then(function(response) {
+    $scope.whoami = response.data;
+  });
+
+  $scope.days = ["monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"];
+  $scope.schedule = null;
+  $scope.recovery = null;
+  $scope.scheduleEdit = null;
+
+  $scope.loadSchedule = function () {
+    $http.get("/api/schedule").then(function(response) {
+      $scope.schedule = response.data;
+    });
+    $http.get("/api/recovery").then(function(response) {
+      $scope.recovery = response.data;
+    });
+  }
+  $scope.loadSchedule();
+
+  $scope.editSchedule = function () {
+    var sched = angular.copy($scope.schedule.schedule);
+    sched.days = sched.days || {};
+    sched.holidays = sched.holidays || [];
+    $scope.scheduleEdit = sched;
+  }
+
+  $scope.cancelSchedule = function () {
+    $scope.scheduleEdit = null;
+  }
+
+  $scope.addPeriod = function (list) {
+    var last = list.length ? list[list.length-1] : { heatSetpoint: 68, coolSetpoint: 76 };
+    list.push({ start: "12:00", heatSetpoint: last.heatSetpoint, coolSetpoint: last.coolSetpoint });
+  }
+
+  $scope.addDay = function (day) {
+    $scope.scheduleEdit.days[day] = [];
+    $scope.addPeriod($scope.scheduleEdit.days[day]);
+  }
+
+  $scope.saveSchedule = function () {
+    $http.put("/api/schedule", $scope.scheduleEdit).then(function(response) {
+      $scope.schedule = response.data;
+      $scope.scheduleEdit = null;
+    });
+  }
+
+  $scope.skipNext = function (skip) {
+    var req = skip ? $http.post("/api/schedule/skip") : $http.delete("/api/schedule/skip");
+    req.then(function(response) {
+      $scope.schedule = response.data;
+    });
+  }
+
+  $scope.override = null;
+  $scope.overrideForm = null;
+
+  $scope.loadOverride = function () {
+    $http.get("/api/override").then(function(response) {
+      $scope.override = response.data;
+    });
+  }
+  $scope.loadOverride();
+
+  $interval(function () {
+    if ($scope.override) {
+      $scope.override.remaining--;
+      if ($scope.override.remaining == -20) {   // Reverted on the server by now
+        $scope.loadOverride();
+        $scope.loadSchedule();
+      }
+    }
+  }, 1000);
+
+  $scope.countdown = function (seconds) {
+    seconds = Math.max(seconds, 0);
+    var h = Math.floor(seconds / 3600), m = Math.floor(seconds % 3600 / 60), s = seconds % 60;
+    return h + ":" + (m < 10 ? "0" : "") + m + ":" + (s < 10 ? "0" : "") + s;
+  }
+
+  $scope.newOverride = function () {
+    $scope.overrideForm = { heatSetpoint: $scope.tstat.heatSetpoint, coolSetpoint: $scope.tstat.coolSetpoint, hours: 2 };
+  }
+
+  $scope.cancelOverrideForm = function () {
+    $scope.overrideForm = null;
+  }
+
+  $scope.startOverride = function () {
+    $http.post("/api/override", $scope.overrideForm).then(function(response) {
+      $scope.override = response.data;
+      $scope.overrideForm = null;
+    });
+  }
+
+  $scope.endOverride = function () {
+    $http.delete("/api/override").then(function(response) {
+      $scope.override = response.data;
+    });
+  }
+
+  $scope.profiles = null;
+  $scope.vacationForm = null;
+
+  $scope.loadProfiles = function () {
+    $http.get("/api/profiles").then(function(response) {
+      $scope.profiles = response.data;
+    });
+  }
+  $scope.loadProfiles();
+
+  $scope.enterProfile = function (name) {
+    $http.post("/api/profile/" + encodeURIComponent(name)).then(function(response) {
+      $scope.profiles = response.data;
+      $scope.loadOverride();
+    });
+  }
+
+  $scope.newVacation = function () {
+    var start = new Date(), end = new Date();
+    start.setSeconds(0, 0);
+    end.setDate(end.getDate() + 7);
+    end.setHours(12, 0, 0, 0);
+    $scope.vacationForm = { start: start, end: end, returnTo: "home" };
+  }
+
+  $scope.cancelVacationForm = function () {
+    $scope.vacationForm = null;
+  }
+
+  $scope.saveVacation = function () {
+    $http.post("/api/vacation", $scope.vacationForm).then(function(response) {
+      $scope.profiles = response.data;
+      $scope.vacationForm = null;
+    });
+  }
+
+  $scope.cancelVacation = function () {
+    $http.delete("/api/vacation").then(function(response) {
+      $scope.profiles = response.data;
+    });
+  }
+
+  $scope.circulation = null;
+  $scope.circulationEdit = null;
+
+  $http.get("/api/circulation").then(function(response) {
+    $scope.circulation = response.data;
+  });
+
+  $scope.editCirculation = function () {
+    $scope.circulationEdit = angular.copy($scope.circulation);
+  }
+
+  $scope.cancelCirculation = function () {
+    $scope.circulationEdit = null;
+  }
+
+  $scope.saveCirculation = function () {
+    $http.put("/api/circulation", $scope.circulationEdit).then(function(response) {
+      $scope.circulation = response.data;
+      $scope.circulationEdit = null;
+    });
+  }
+
+  $scope.occupancy = null;
+
+  $scope.loadOccupancy = function () {
+    $http.get("/api/occupancy").then(function(response) {
+      $scope.occupancy = response.data;
+    });
+  }
+  $scope.loadOccupancy();
+  $interval($scope.loadOccupancy, 60000);
+
+  $scope.setOccupancy = function (enabled) {
+    var st = angular.copy($scope.occupancy);
+    st.enabled = enabled;
+    $http.put("/api/occupancy", st).then(function(response) {
+      $scope.occupancy = response.data;
+    });
+  }
+
+  $scope.calendar = null;
+
+  $scope.loadCalendar = function () {
+    $http.get("/api/calendar").then(function(response) {
+      $scope.calendar = response.data;
+    });
+  }
+  $scope.loadCalendar();
+
+  $scope.approveCalendar = function () {
+    $http.post("/api/calendar/approve", { hash: $scope.calendar.pending.hash }).then(function(response) {
+      $scope.calendar = response.data;
+    });
+  }
+
+  $scope.calendarAction = function (e) {
+    return e.profile ? e.profile : e.heatSetpoint + "\u00b0/" + e.coolSetpoint + "\u00b0";
+  }
+
+  $scope.history = null;
+
+  $scope.toggleHistory = function () {
+    if ($scope.history) {
+      $scope.history = null;
+      return;
+    }
+    $http.get("/api/audit?days=7").then(function(response) {
+      $scope.history = response.data;
+    });
+  }
+
+  $scope.jobs = null;
+
+  $scope.loadJobs = function () {
+    $http.get("/api/jobs").then(function(response) {
+      $scope.jobs = response.data;
+    });
+  }
+
+  $scope.toggleJobs = function () {
+    if ($scope.jobs) {
+      $scope.jobs = null;
+      return;
+    }
+    $scope.loadJobs();
+  }
+
+  $scope.runJob = function (name) {
+    $http.post("/api/jobs/" + name + "/run").finally(function() {
+      $scope.loadJobs();
+      $timeout($scope.loadJobs, 5000);
+    });
+  }
+
+  $scope.logout = function () {
+    $http.post("/logout").finally(function() {
+      window.location.href = "/login";
+    });
+  }
 
-  var $wsUrl = "ws://" + $location.host() + ":" + $location.port() + "/api/ws";
+  var $wsUrl = ($location.protocol() == "https" ? "wss://" : "ws://") + $location.host() + ":" + $location.port() + "/api/ws";
 
   thermostatEvents.start($wsUrl, function (msg) {
     if (msg.source == "tstat") {
@@ -87,7 +356,9 @@ app.controller('thermostatController', function($scope, $http, $interval, $locat
   }
 
   $scope.incCoolSetpoint = function(val) {
-    if ( $scope.tstat.coolSetpoint+val>=CoolSetMin && $scope.tstat.coolSetpoint+val<=CoolSetMax ) {
+    var l = $scope.limits;
+    if ( l && $scope.tstat.coolSetpoint+val>=l.coolMin && $scope.tstat.coolSetpoint+val<=l.coolMax
+           && $scope.tstat.coolSetpoint+val-$scope.tstat.heatSetpoint>=l.deadband ) {
         var temp = $scope.tstat.coolSetpoint + val;
         $http.put("/api/zone/1/config", { "coolSetpoint": temp }).then(function(response) {
           console.log("set fan speed") ;
@@ -96,7 +367,9 @@ app.controller('thermostatController', function($scope, $http, $interval, $locat
   }
 
   $scope.incHeatSetpoint = function(val) {
-    if ( $scope.tstat.heatSetpoint+val>=HeatSetMin && $scope.tstat.heatSetpoint+val<=HeatSetMax ) {
+    var l = $scope.limits;
+    if ( l && $scope.tstat.heatSetpoint+val>=l.heatMin && $scope.tstat.heatSetpoint+val<=l.heatMax
+           && $scope.tstat.coolSetpoint-$scope.tstat.heatSetpoint-val>=l.deadband ) {
       var temp = $scope.tstat.heatSetpoint + val;
       $http.put("/api/zone/1/config", { "heatSetpoint": temp }).then(function(response) {
         console.log("set fan speed") ;
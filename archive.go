@@ -0,0 +1,613 @@
+package main
+	// Retention of old months, retention: in the config file. A month folder older than archiveMonths has its day files,
+	// the CSV data and the HTML charts, moved into one archive with a manifest of sizes and SHA-256 checksums.
+	// The archive is read back and checked against the manifest before the files are removed. The daily summaries
+	// are written beside it first and kept for good, like the rollups, past pruneMonths the archive itself is deleted.
+	// Readers do not see the difference, readDailySamples, the year chart, the calendar pages and /charts/
+	// fall back to the month's archive when a day file is not on disk.
+	//		YYYY-MM/index.html			the month calendar, still written by makeIndexPages
+	//		YYYY-MM/summaries.json		the summary of each day, kept forever
+	//		YYYY-MM/rollups.json		the hourly and daily rollups, see rollup.go, never archived and kept forever
+	//		YYYY-MM/YYYY-MM.tar.gz		manifest.json first, then the day files
+	//		GET /api/archive			every month, live, archived or pruned, with its file counts and sizes
+	// The archive job runs within the daily job, before the index pages.
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var archiveManifestName	= "manifest.json"
+var summariesFileName	= "summaries.json"
+var archiveExt			= ".tar.gz"
+var archiveVersion		= 1
+
+// One day file in an archive
+type archiveEntry struct {
+	Name			string			`json:"name"`
+	Size			int64			`json:"size"`
+	ModTime			time.Time		`json:"modTime"`
+	SHA256			string			`json:"sha256"`
+}
+
+// The first file in every archive
+type archiveManifest struct {
+	Version			int				`json:"version"`
+	Month			string			`json:"month"`
+	Created			time.Time		`json:"created"`
+	Files			[]archiveEntry	`json:"files"`
+}
+
+// An archive read and checked, the one last used is kept
+type monthArchive struct {
+	file			string
+	modTime			time.Time
+	manifest		archiveManifest
+	data			map[string][]byte
+}
+
+var archiveCache	*monthArchive
+var archiveMutex	sync.Mutex
+
+// Manifests read, keyed by archive file, for telling what an archive holds without reading it all
+type cachedManifest struct {
+	modTime			time.Time
+	manifest		archiveManifest
+}
+
+var manifestCache	= make( map[string]cachedManifest )
+
+// Summaries of archived months, keyed by month folder name
+var archivedSummaries	= make( map[string]map[string]daySummary )
+
+// What /api/archive shows of a month
+type archiveMonthStatus struct {
+	Month			string			`json:"month"`
+	State			string			`json:"state"`				// live, archived or pruned
+	LiveFiles		int				`json:"liveFiles"`			// Day files on disk
+	ArchivedFiles	int				`json:"archivedFiles"`
+	ArchiveBytes	int64			`json:"archiveBytes"`
+	Summaries		bool			`json:"summaries"`
+}
+
+func monthArchiveFile( month time.Time ) string {
+	return filePath + month.Format("2006-01") + "/" + month.Format("2006-01") + archiveExt
+}	// monthArchiveFile
+
+// archiveFileFor finds the archive that would hold a day file, false when the file is not in a month folder.
+func archiveFileFor( name string ) ( string, bool ) {
+	dir   := filepath.Dir( name )
+	month := filepath.Base( dir )
+	if !monthDirPattern.MatchString( month ) {
+		return "", false
+	}
+	return filepath.Join( dir, month+archiveExt ), true
+}	// archiveFileFor
+
+// readMonthArchive reads a whole archive and checks every file against the manifest.
+func readMonthArchive( file string ) ( *monthArchive, error ) {
+	f, err := os.Open( file )
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader( f )
+	if err != nil {
+		return nil, fmt.Errorf( "%s: %w", file, err )
+	}
+	a  := &monthArchive{ file: file, modTime: info.ModTime(), data: make(map[string][]byte) }
+	tr := tar.NewReader( gz )
+	for first := true; ; first = false {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf( "%s: %w", file, err )
+		}
+		data, err := io.ReadAll( tr )
+		if err != nil {
+			return nil, fmt.Errorf( "%s: %s: %w", file, hdr.Name, err )
+		}
+		if first {
+			if hdr.Name != archiveManifestName {
+				return nil, fmt.Errorf( "%s: %s is not first", file, archiveManifestName )
+			}
+			if err = json.Unmarshal( data, &a.manifest ); err != nil {
+				return nil, fmt.Errorf( "%s: %s: %w", file, archiveManifestName, err )
+			}
+			continue
+		}
+		a.data[hdr.Name] = data
+	}
+	if a.manifest.Version != archiveVersion {
+		return nil, fmt.Errorf( "%s: manifest version %d, not %d", file, a.manifest.Version, archiveVersion )
+	}
+	if len(a.data) != len(a.manifest.Files) {
+		return nil, fmt.Errorf( "%s: %d files, the manifest lists %d", file, len(a.data), len(a.manifest.Files) )
+	}
+	for _, e := range a.manifest.Files {
+		data, ok := a.data[e.Name]
+		sum := sha256.Sum256( data )
+		if !ok || int64(len(data)) != e.Size || hex.EncodeToString( sum[:] ) != e.SHA256 {
+			return nil, fmt.Errorf( "%s: %s does not match the manifest", file, e.Name )
+		}
+	}
+	return a, nil
+}	// readMonthArchive
+
+// readArchiveManifest reads only the manifest, the first file, without checking the rest.
+func readArchiveManifest( file string ) ( archiveManifest, error ) {
+	var m archiveManifest
+
+	f, err := os.Open( file )
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader( f )
+	if err != nil {
+		return m, fmt.Errorf( "%s: %w", file, err )
+	}
+	tr := tar.NewReader( gz )
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != archiveManifestName {
+		return m, fmt.Errorf( "%s: no %s", file, archiveManifestName )
+	}
+	if err = json.NewDecoder( tr ).Decode( &m ); err != nil {
+		return m, fmt.Errorf( "%s: %s: %w", file, archiveManifestName, err )
+	}
+	return m, nil
+}	// readArchiveManifest
+
+// archiveManifestOf returns an archive's manifest, from the cache while the file is unchanged.
+func archiveManifestOf( file string ) ( archiveManifest, error ) {
+	info, err := os.Stat( file )
+	if err != nil {
+		return archiveManifest{}, err
+	}
+	archiveMutex.Lock()
+	c, ok := manifestCache[file]
+	archiveMutex.Unlock()
+	if ok && c.modTime.Equal( info.ModTime() ) {
+		return c.manifest, nil
+	}
+	m, err := readArchiveManifest( file )
+	if err != nil {
+		return m, err
+	}
+	archiveMutex.Lock()
+	manifestCache[file] = cachedManifest{ modTime: info.ModTime(), manifest: m }
+	archiveMutex.Unlock()
+	return m, nil
+}	// archiveManifestOf
+
+// loadArchive returns the archive from the cache while the file is unchanged.
+func loadArchive( file string ) ( *monthArchive, error ) {
+	info, err := os.Stat( file )
+	if err != nil {
+		return nil, err
+	}
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	if archiveCache != nil && archiveCache.file == file && archiveCache.modTime.Equal( info.ModTime() ) {
+		return archiveCache, nil
+	}
+	a, err := readMonthArchive( file )
+	if err != nil {
+		return nil, err
+	}
+	archiveCache = a
+	return a, nil
+}	// loadArchive
+
+// archivedData finds a day file in its month's archive.
+func archivedData( name string ) ( []byte, time.Time, bool ) {
+	file, ok := archiveFileFor( name )
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	a, err := loadArchive( file )
+	if err != nil {
+		if !errors.Is( err, os.ErrNotExist ) {
+			chartsLog.Error( "archive - read failure: ", err )
+		}
+		return nil, time.Time{}, false
+	}
+	data, ok := a.data[filepath.Base(name)]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	for _, e := range a.manifest.Files {
+		if e.Name == filepath.Base( name ) {
+			return data, e.ModTime, true
+		}
+	}
+	return data, a.modTime, true
+}	// archivedData
+
+// openDataFile opens a day file on disk, or from its month's archive when it was archived.
+func openDataFile( name string ) ( io.ReadCloser, error ) {
+	f, err := os.Open( name )
+	if !errors.Is( err, os.ErrNotExist ) {
+		return f, err
+	}
+	if data, _, ok := archivedData( name ); ok {
+		return io.NopCloser( bytes.NewReader(data) ), nil
+	}
+	return nil, err
+}	// openDataFile
+
+// dataFileExists is true for a day file on disk or listed in its month's archive manifest.
+func dataFileExists( name string ) bool {
+	if _, err := os.Stat( name ); err == nil {
+		return true
+	}
+	file, ok := archiveFileFor( name )
+	if !ok {
+		return false
+	}
+	m, err := archiveManifestOf( file )
+	if err != nil {
+		if !errors.Is( err, os.ErrNotExist ) {
+			chartsLog.Error( "archive - read failure: ", err )
+		}
+		return false
+	}
+	for _, e := range m.Files {
+		if e.Name == filepath.Base( name ) {
+			return true
+		}
+	}
+	return false
+}	// dataFileExists
+
+// archivedFiles lists the day files with the extension in every month archive, as paths in their month folders.
+func archivedFiles( ext string ) []string {
+	var files []string
+
+	for _, month := range archiveMonths() {
+		file := monthArchiveFile( month )
+		m, err := archiveManifestOf( file )
+		if errors.Is( err, os.ErrNotExist ) {
+			continue
+		}
+		if err != nil {
+			chartsLog.Error( "archive - read failure: ", err )
+			continue
+		}
+		for _, e := range m.Files {
+			if filepath.Ext( e.Name ) == ext {
+				files = append( files, filepath.Join(filepath.Dir(file), e.Name) )
+			}
+		}
+	}
+	return files
+}	// archivedFiles
+
+// archivedSummary is the day's summary from its month's summaries file.
+func archivedSummary( day time.Time ) ( daySummary, bool ) {
+	month := day.Format( "2006-01" )
+	summaryMutex.Lock()
+	days, ok := archivedSummaries[month]
+	summaryMutex.Unlock()
+	if !ok {
+		data, err := os.ReadFile( filePath + month + "/" + summariesFileName )
+		if err == nil {
+			err = json.Unmarshal( data, &days )
+		}
+		if err != nil && !errors.Is( err, os.ErrNotExist ) {
+			chartsLog.Error( "archive - summaries read failure: ", err )
+		}
+		summaryMutex.Lock()
+		archivedSummaries[month] = days
+		summaryMutex.Unlock()
+	}
+	sum, ok := days[day.Format("2006-01-02")]
+	return sum, ok && sum.Samples > 0
+}	// archivedSummary
+
+// writeMonthSummaries keeps the summary of every day of the month that has samples.
+func writeMonthSummaries( month time.Time ) error {
+	days := make( map[string]daySummary )
+	for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+		if sum, ok := dataStore.DailySummary( day ); ok {
+			days[day.Format("2006-01-02")] = sum
+		}
+	}
+	file := filePath + month.Format("2006-01") + "/" + summariesFileName
+	data, err := json.MarshalIndent( days, "", "\t" )
+	if err == nil {
+		tmp := filepath.Join( filepath.Dir(file), ".summaries.tmp" )
+		if err = os.WriteFile( tmp, append(data, '\n'), 0644 ); err == nil {
+			err = os.Rename( tmp, file )
+		}
+	}
+	summaryMutex.Lock()
+	delete( archivedSummaries, month.Format("2006-01") )
+	summaryMutex.Unlock()
+	return err
+}	// writeMonthSummaries
+
+// isDayFile is a file the archive takes, not the month's index page, summaries, archive or dotfiles.
+func isDayFile( name string ) bool {
+	return name != linksFile && name != summariesFileName && name != rollupsFileName && !strings.HasSuffix( name, archiveExt ) &&
+		!strings.HasPrefix( name, "." )
+}	// isDayFile
+
+// archiveMonthFiles moves the month's day files into its archive, together with any already archived.
+func archiveMonthFiles( month time.Time ) error {
+	dir  := filePath + month.Format("2006-01") + "/"
+	file := monthArchiveFile( month )
+	entries, err := os.ReadDir( dir )
+	if err != nil {
+		return err
+	}
+	files := make( map[string][]byte )
+	var live []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isDayFile( e.Name() ) {
+			continue
+		}
+		live = append( live, e.Name() )
+	}
+	if len(live) == 0 {
+		return nil
+	}
+	if err = writeMonthSummaries( month ); err != nil {
+		return fmt.Errorf( "%s summaries: %w", month.Format("2006-01"), err )
+	}
+
+	// A day file written after the month was archived joins the files already in it
+	manifest := archiveManifest{ Version: archiveVersion, Month: month.Format("2006-01"), Created: time.Now() }
+	if _, err = os.Stat( file ); err == nil {
+		old, err := loadArchive( file )
+		if err != nil {
+			return err
+		}
+		for _, e := range old.manifest.Files {
+			if _, ok := old.data[e.Name]; ok {
+				files[e.Name] = old.data[e.Name]
+				manifest.Files = append( manifest.Files, e )
+			}
+		}
+	}
+	for _, name := range live {
+		info, err := os.Stat( dir + name )
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile( dir + name )
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256( data )
+		entry := archiveEntry{ Name: name, Size: int64(len(data)), ModTime: info.ModTime(), SHA256: hex.EncodeToString(sum[:]) }
+		if _, ok := files[name]; ok {
+			for i := range manifest.Files {
+				if manifest.Files[i].Name == name {
+					manifest.Files[i] = entry
+				}
+			}
+		} else {
+			manifest.Files = append( manifest.Files, entry )
+		}
+		files[name] = data
+	}
+	sort.Slice( manifest.Files, func(i, j int) bool { return manifest.Files[i].Name < manifest.Files[j].Name } )
+
+	tmp := dir + ".archive.tmp"
+	if err = writeMonthArchive( tmp, manifest, files ); err == nil {
+		_, err = readMonthArchive( tmp )				// Every file back and matching before anything is removed
+	}
+	if err == nil {
+		err = os.Rename( tmp, file )
+	}
+	if err != nil {
+		os.Remove( tmp )
+		return fmt.Errorf( "%s: %w", month.Format("2006-01"), err )
+	}
+	var size int64
+	for _, name := range live {
+		size += int64( len(files[name]) )
+		if err := os.Remove( dir + name ); err != nil {
+			chartsLog.Warn( "archive - remove failure: ", err )
+		}
+	}
+	chartsLog.WithFields( log.Fields{ "month": manifest.Month, "files": len(live), "bytes": size } ).Info( "archive - month archived" )
+	return nil
+}	// archiveMonthFiles
+
+// writeMonthArchive writes the manifest and then the files, synced to disk.
+func writeMonthArchive( file string, manifest archiveManifest, files map[string][]byte ) error {
+	f, err := os.OpenFile( file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644 )
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = writeTarGz( f, archiveManifestName, manifest, manifest.Created, manifest.Files, filesFrom(files) ); err == nil {
+		err = f.Sync()
+	}
+	return err
+}	// writeMonthArchive
+
+// filesFrom opens files held in memory, for writeTarGz.
+func filesFrom( files map[string][]byte ) func( string ) ( io.ReadCloser, error ) {
+	return func( name string ) ( io.ReadCloser, error ) {
+		return io.NopCloser( bytes.NewReader(files[name]) ), nil
+	}
+}	// filesFrom
+
+// writeTarGz writes a manifest as the first file and then the listed files, for month archives and backups.
+// Each file is copied from open to its size in entries, a file that no longer matches its checksum is an error.
+func writeTarGz( w io.Writer, manifestName string, manifest any, created time.Time, entries []archiveEntry, open func( string ) ( io.ReadCloser, error ) ) error {
+	gz := gzip.NewWriter( w )
+	tw := tar.NewWriter( gz )
+	add := func( e archiveEntry, r io.Reader ) error {
+		hdr := &tar.Header{ Name: e.Name, Mode: 0644, Size: e.Size, ModTime: e.ModTime, Typeflag: tar.TypeReg }
+		if err := tw.WriteHeader( hdr ); err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.CopyN( io.MultiWriter(tw, h), r, e.Size ); err != nil {
+			return fmt.Errorf( "%s: %w", e.Name, err )
+		}
+		if e.SHA256 != "" && hex.EncodeToString( h.Sum(nil) ) != e.SHA256 {
+			return fmt.Errorf( "%s changed while it was written", e.Name )
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent( manifest, "", "\t" )
+	if err == nil {
+		data = append( data, '\n' )
+		err = add( archiveEntry{ Name: manifestName, Size: int64(len(data)), ModTime: created }, bytes.NewReader(data) )
+	}
+	for _, e := range entries {
+		if err != nil {
+			break
+		}
+		var r io.ReadCloser
+		if r, err = open( e.Name ); err == nil {
+			err = add( e, r )
+			r.Close()
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	return err
+}	// writeTarGz
+
+// pruneMonthFiles deletes the month's archive, only once its summaries are kept.
+func pruneMonthFiles( month time.Time ) error {
+	file := monthArchiveFile( month )
+	if _, err := os.Stat( file ); errors.Is( err, os.ErrNotExist ) {
+		return nil
+	}
+	if _, err := os.Stat( filePath + month.Format("2006-01") + "/" + summariesFileName ); err != nil {
+		return fmt.Errorf( "%s: not pruned without summaries: %w", month.Format("2006-01"), err )
+	}
+	if err := keepArchivedRollups( month ); err != nil {
+		return fmt.Errorf( "%s: not pruned without rollups: %w", month.Format("2006-01"), err )
+	}
+	if err := os.Remove( file ); err != nil {
+		return err
+	}
+	chartsLog.WithField( "month", month.Format("2006-01") ).Info( "archive - raw data pruned, summaries kept" )
+	return nil
+}	// pruneMonthFiles
+
+// keepArchivedRollups puts back on disk the rollups of a month archived before they were kept out of the archive.
+func keepArchivedRollups( month time.Time ) error {
+	name := rollupsFileFor( month )
+	if _, err := os.Stat( name ); !errors.Is( err, os.ErrNotExist ) {
+		return err
+	}
+	data, _, ok := archivedData( name )
+	if !ok {
+		return nil
+	}
+	tmp := filepath.Join( filepath.Dir(name), ".rollups.tmp" )
+	if err := os.WriteFile( tmp, data, 0644 ); err != nil {
+		return err
+	}
+	return os.Rename( tmp, name )
+}	// keepArchivedRollups
+
+// applyRetention archives and prunes the months past the configured ages, never the current month.
+func applyRetention() error {
+	var errs []error
+
+	retention := currentConfig().Retention
+	if retention.ArchiveMonths == 0 {
+		return nil
+	}
+	now       := time.Now()
+	thisMonth := time.Date( now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local )
+	for _, month := range archiveMonths() {
+		if month.Before( thisMonth.AddDate(0, -retention.ArchiveMonths, 0) ) {
+			if err := archiveMonthFiles( month ); err != nil {
+				errs = append( errs, err )
+				continue
+			}
+		}
+		if retention.PruneMonths > 0 && month.Before( thisMonth.AddDate(0, -retention.PruneMonths, 0) ) {
+			if err := pruneMonthFiles( month ); err != nil {
+				errs = append( errs, err )
+			}
+		}
+	}
+	return errors.Join( errs... )
+}	// applyRetention
+
+// archiveStatus describes every month folder, oldest first.
+func archiveStatus() []archiveMonthStatus {
+	list := []archiveMonthStatus{}
+	for _, month := range archiveMonths() {
+		dir := filePath + month.Format("2006-01") + "/"
+		st  := archiveMonthStatus{ Month: month.Format("2006-01"), State: "live" }
+		if entries, err := os.ReadDir( dir ); err == nil {
+			for _, e := range entries {
+				if e.Type().IsRegular() && isDayFile( e.Name() ) {
+					st.LiveFiles++
+				}
+			}
+		}
+		if info, err := os.Stat( monthArchiveFile(month) ); err == nil {
+			st.State, st.ArchiveBytes = "archived", info.Size()
+			if m, err := archiveManifestOf( monthArchiveFile(month) ); err == nil {
+				st.ArchivedFiles = len( m.Files )
+			}
+		}
+		if _, err := os.Stat( dir + summariesFileName ); err == nil {
+			st.Summaries = true
+			if st.State == "live" && st.LiveFiles == 0 {
+				st.State = "pruned"
+			}
+		}
+		list = append( list, st )
+	}
+	return list
+}	// archiveStatus
+
+// serveArchived serves a day file from its month's archive, false when it is not there either.
+func serveArchived( w http.ResponseWriter, r *http.Request, name string ) bool {
+	data, modTime, ok := archivedData( name )
+	if !ok {
+		return false
+	}
+	w.Header().Set( "ETag", fmt.Sprintf("\"%x-%x\"", modTime.UnixNano(), len(data)) )
+	w.Header().Set( "Cache-Control", "public, max-age=86400" )			// Archived days no longer change
+	w.Header().Set( "X-Content-Type-Options", "nosniff" )
+	http.ServeContent( w, r, name, modTime, bytes.NewReader(data) )
+	return true
+}	// serveArchived
+
+func mountArchiveAPI( mux *http.ServeMux ) {
+	mux.HandleFunc( "GET /api/archive", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON( w, http.StatusOK, map[string]any{ "retention": currentConfig().Retention, "months": archiveStatus() } )
+	} )
+}	// mountArchiveAPI
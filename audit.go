@@ -0,0 +1,250 @@
+package main
+	// Audit log of thermostat changes, kept by the store, one JSON object per line in filePath+auditFileName with csv.
+	//		api			a change made through changeZoneConfig, with the user, address, old and new settings and result
+	//		external	a change seen in the thermostat config that did not come through us, the wall unit or another controller
+	// Events that are not changes themselves, like entering a profile, have event set.
+	// External changes are found by comparing the cached zone config every auditPollSeconds.
+	// GET /api/audit returns the recent entries for the UI, and the daily chart marks the changes of its day.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+	"github.com/go-echarts/go-echarts/v2/opts"
+)
+
+var auditFileName		= "infinitiveAudit.jsonl"
+var auditPollSeconds	= 10
+var auditSettleTime		= 30 * time.Second		// Time for our own write to show up in the config
+
+// The settings a change can touch
+type zoneSettings struct {
+	Mode			string		`json:"mode"`
+	FanMode			string		`json:"fanMode"`
+	Hold			bool		`json:"hold"`
+	HeatSetpoint	uint8		`json:"heatSetpoint"`
+	CoolSetpoint	uint8		`json:"coolSetpoint"`
+}
+
+// Who or what asked for a change
+type changeSource struct {
+	Source			string		`json:"source"`			// api, external, schedule, override, profile, circulation, occupancy, recovery or calendar
+	User			string		`json:"user,omitempty"`
+	Remote			string		`json:"remote,omitempty"`
+}
+
+// One audit log line
+type auditEntry struct {
+	Time			time.Time		`json:"time"`
+	changeSource
+	Event			string			`json:"event,omitempty"`		// Not a change itself, like entering a profile
+	Old				*zoneSettings	`json:"old,omitempty"`
+	New				zoneSettings	`json:"new"`
+	Result			string			`json:"result"`			// ok, refused or failed
+	Error			string			`json:"error,omitempty"`
+}
+
+// The audit file and the external change watch state
+var audit struct {
+	mu				sync.Mutex
+	lastSeen		*zoneSettings
+	pending			*zoneSettings		// Our last write, until it shows up or auditSettleTime passes
+	pendingUntil	time.Time
+}
+
+func settingsOf( cfg *infinity.TStatZoneConfig ) zoneSettings {
+	s := zoneSettings{ Mode: cfg.Mode, FanMode: cfg.FanMode, HeatSetpoint: cfg.HeatSetpoint, CoolSetpoint: cfg.CoolSetpoint }
+	if cfg.Hold != nil {
+		s.Hold = *cfg.Hold
+	}
+	return s
+}	// settingsOf
+
+// applied is s with the fields set in change.
+func ( s zoneSettings ) applied( change infinity.TStatZoneConfig ) zoneSettings {
+	if change.Mode != "" {
+		s.Mode = change.Mode
+	}
+	if change.FanMode != "" {
+		s.FanMode = change.FanMode
+	}
+	if change.Hold != nil {
+		s.Hold = *change.Hold
+	}
+	if change.HeatSetpoint > 0 {
+		s.HeatSetpoint = change.HeatSetpoint
+	}
+	if change.CoolSetpoint > 0 {
+		s.CoolSetpoint = change.CoolSetpoint
+	}
+	return s
+}	// applied
+
+// requestSource is the signed in user and address of an API request.
+func requestSource( r *http.Request ) changeSource {
+	host, _, err := net.SplitHostPort( r.RemoteAddr )
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return changeSource{ Source: "api", User: requestIdentity(r).User, Remote: host }
+}	// requestSource
+
+// auditChange records one change made by us, err is its outcome from changeZoneConfig.
+func auditChange( by changeSource, current *infinity.TStatZoneConfig, change infinity.TStatZoneConfig, err error ) {
+	e := auditEntry{ Time: time.Now(), changeSource: by, Result: "ok" }
+	if current != nil {
+		old := settingsOf( current )
+		e.Old = &old
+		e.New = old.applied( change )
+	} else {
+		e.New = zoneSettings{}.applied( change )
+	}
+	if err != nil {
+		e.Result, e.Error = "failed", err.Error()
+		var le *limitError
+		if errors.As( err, &le ) {
+			e.Result = "refused"
+		}
+	} else if current != nil {
+		audit.mu.Lock()
+		audit.pending      = &e.New
+		audit.pendingUntil = time.Now().Add( auditSettleTime )
+		audit.lastSeen     = &e.New
+		audit.mu.Unlock()
+	}
+	writeAudit( e )
+}	// auditChange
+
+func writeAudit( e auditEntry ) {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if err := dataStore.AppendEvent( e ); err != nil {
+		controlLog.Error( "audit - write failure: ", err )
+	}
+}	// writeAudit
+
+// watchExternalChanges compares the zone config every auditPollSeconds and records changes we did not make.
+func watchExternalChanges( ctx context.Context, api *infinity.Api ) {
+	ticker := time.NewTicker( time.Duration(auditPollSeconds) * time.Second )
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cfg, ok := api.GetZoneConfig()
+		if !ok || cfg == nil {
+			continue
+		}
+		current := settingsOf( cfg )
+		audit.mu.Lock()
+		if audit.pending != nil && time.Now().Before( audit.pendingUntil ) && current != *audit.pending {
+			audit.mu.Unlock()
+			continue
+		}
+		audit.pending = nil
+		old := audit.lastSeen
+		audit.lastSeen = &current
+		audit.mu.Unlock()
+		if old != nil && *old != current {
+			writeAudit( auditEntry{ Time: time.Now(), changeSource: changeSource{ Source: "external" }, Old: old, New: current, Result: "ok" } )
+		}
+	}
+}	// watchExternalChanges
+
+// readAudit returns the entries from..to, oldest first.
+func readAudit( from, to time.Time ) []auditEntry {
+	entries, err := dataStore.Events( from, to )
+	if err != nil {
+		controlLog.Error( "audit - read failure: ", err )
+	}
+	return entries
+}	// readAudit
+
+// auditHandler serves GET /api/audit?days=N, newest first, 7 days by default.
+func auditHandler( w http.ResponseWriter, r *http.Request ) {
+	days, err := strconv.Atoi( r.URL.Query().Get("days") )
+	if err != nil || days < 1 {
+		days = 7
+	}
+	now := time.Now()
+	entries := readAudit( now.AddDate(0, 0, -days), now.Add(time.Minute) )
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+	writeJSON( w, http.StatusOK, entries )
+}	// auditHandler
+
+// describe is a short text of what changed, for the chart.
+func ( e auditEntry ) describe() string {
+	text := e.Source
+	if e.User != "" {
+		text += " " + e.User
+	}
+	if e.Event != "" {
+		return text + " " + e.Event
+	}
+	if e.Old == nil {
+		return text + " " + e.Result
+	}
+	if e.Old.Mode != e.New.Mode {
+		text += fmt.Sprintf( " mode %s>%s", e.Old.Mode, e.New.Mode )
+	}
+	if e.Old.FanMode != e.New.FanMode {
+		text += fmt.Sprintf( " fan %s>%s", e.Old.FanMode, e.New.FanMode )
+	}
+	if e.Old.Hold != e.New.Hold {
+		text += fmt.Sprintf( " hold %t>%t", e.Old.Hold, e.New.Hold )
+	}
+	if e.Old.HeatSetpoint != e.New.HeatSetpoint {
+		text += fmt.Sprintf( " heat %d>%d", e.Old.HeatSetpoint, e.New.HeatSetpoint )
+	}
+	if e.Old.CoolSetpoint != e.New.CoolSetpoint {
+		text += fmt.Sprintf( " cool %d>%d", e.Old.CoolSetpoint, e.New.CoolSetpoint )
+	}
+	if e.Result != "ok" {
+		text += " " + e.Result
+	}
+	return text
+}	// describe
+
+// auditMarkPoints marks the day's changes on the daily chart, at the chart point, of times, nearest each change.
+func auditMarkPoints( day time.Time, times []time.Time ) []opts.MarkPointNameCoordItem {
+	var points []opts.MarkPointNameCoordItem
+
+	if len(times) == 0 {
+		return nil
+	}
+	start := startOfDay( day )
+	for _, e := range readAudit( start, start.AddDate(0, 0, 1) ) {
+		if e.Source == "circulation" {
+			continue								// Twice an hour, the CSV marks it instead
+		}
+		index := sort.Search( len(times), func(i int) bool { return !times[i].Before( e.Time ) } )
+		if index == len(times) || index > 0 && e.Time.Sub( times[index-1] ) < times[index].Sub( e.Time ) {
+			index--
+		}
+		label := "A"
+		switch {
+		case e.Event != "":
+			label = "P"
+		case e.Source == "external":
+			label = "E"
+		}
+		points = append( points, opts.MarkPointNameCoordItem{ Name: e.Time.Format("15:04") + " " + e.describe(),
+			Coordinate: []interface{}{ index, 95 }, Value: label } )
+	}
+	return points
+}	// auditMarkPoints
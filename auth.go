@@ -0,0 +1,443 @@
+package main
+	// Accounts, sessions, API tokens and roles for the web server.
+	// Accounts are kept in filePath+usersFileName and managed with the user subcommand, see usercmd.go.
+	// Passwords are bcrypt hashes, API tokens are stored as SHA-256 hashes and shown only when created.
+	//		viewer		the UI, GET on the API, charts and docs
+	//		presence	viewer plus reporting home/away with a token, for phones and scripts, see occupancy.go
+	//		control		viewer plus the requests that change the thermostat
+	// The UI signs in at /login and gets a session cookie, scripts send "Authorization: Bearer TOKEN".
+	// A state changing request made with the session cookie must send the XSRF-TOKEN cookie back in the
+	// X-XSRF-TOKEN header, angular's $http does that by itself. Token requests need no CSRF check.
+	// -auth auto (default) turns this on once an account exists, -anoncharts leaves /charts/ and /docs/ open.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var usersFileName	= "infinitiveUsers.json"
+var sessionCookie	= "infinitive_session"
+var csrfCookie		= "XSRF-TOKEN"			// Names angular's $http looks for
+var csrfHeader		= "X-XSRF-TOKEN"
+var sessionLifetime	= 30 * 24 * time.Hour
+var tokenPrefix		= "inf_"
+
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	rolePresence
+	roleControl
+)
+
+var roleNames = map[string]role{ "viewer": roleViewer, "presence": rolePresence, "control": roleControl }
+
+func ( r role ) String() string {
+	for name, v := range roleNames {
+		if v == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// One API token, only the hash is kept
+type apiToken struct {
+	Label		string		`json:"label"`
+	Hash		string		`json:"hash"`
+	Created		time.Time	`json:"created"`
+}
+
+// One account in the users file
+type userAccount struct {
+	Name		string		`json:"name"`
+	Role		string		`json:"role"`
+	Password	string		`json:"password"`			// bcrypt hash
+	Tokens		[]apiToken	`json:"tokens,omitempty"`
+}
+
+// A signed in browser
+type session struct {
+	User		string
+	CSRF		string
+	Expires		time.Time
+}
+
+// Who made a request, and how
+type identity struct {
+	User		string		`json:"user"`
+	Role		role		`json:"-"`
+	Via			string		`json:"via"`				// session, token, anonymous or open (auth off)
+}
+
+type identityKey struct{}
+
+// The authenticator, the users file is read again when it changes so the user subcommand works on a running server
+type authenticator struct {
+	mode		string					// -auth: auto, on or off
+	anonCharts	bool					// -anoncharts
+	file		string
+	mu			sync.Mutex
+	modTime		time.Time
+	users		map[string]userAccount
+	sessions	map[string]*session
+}
+
+// Compared against when the user does not exist, so a wrong name takes as long as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword( []byte("infinitive"), bcrypt.DefaultCost )
+
+func newAuthenticator( mode string, anonCharts bool ) ( *authenticator, error ) {
+	switch mode {
+	case "auto", "on", "off":
+	default:
+		return nil, fmt.Errorf( "unknown -auth %q, use auto, on or off", mode )
+	}
+	a := &authenticator{ mode: mode, anonCharts: anonCharts, file: filePath + usersFileName, sessions: make(map[string]*session) }
+	a.mu.Lock()
+	a.reload()
+	count := len( a.users )
+	a.mu.Unlock()
+	switch {
+	case mode == "off":
+		apiLog.Warn( "auth - off, anyone who can reach the server can change the thermostat" )
+	case count == 0 && mode == "auto":
+		apiLog.Warn( "auth - no accounts in " + a.file + ", auth is off until one is added with: infinitive user add NAME control" )
+	case count == 0:
+		apiLog.Warn( "auth - no accounts in " + a.file + ", every request will be refused" )
+	}
+	return a, nil
+}	// newAuthenticator
+
+// readUsers loads the users file, a missing file is no accounts.
+func readUsers( fileName string ) ( map[string]userAccount, error ) {
+	var list []userAccount
+
+	users := make( map[string]userAccount )
+	data, err := os.ReadFile( fileName )
+	if errors.Is( err, os.ErrNotExist ) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal( data, &list ); err != nil {
+		return nil, fmt.Errorf( "%s: %w", fileName, err )
+	}
+	for _, u := range list {
+		users[u.Name] = u
+	}
+	return users, nil
+}	// readUsers
+
+// writeUsers replaces the users file, readable by the owner only.
+func writeUsers( fileName string, users map[string]userAccount ) error {
+	list := make( []userAccount, 0, len(users) )
+	for _, u := range users {
+		list = append( list, u )
+	}
+	data, err := json.MarshalIndent( list, "", "\t" )
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp( filepath.Dir(fileName), ".users-*" )
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write( append(data, '\n') )
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename( tmp.Name(), fileName )		// CreateTemp made it 0600
+	}
+	if err != nil {
+		os.Remove( tmp.Name() )
+	}
+	return err
+}	// writeUsers
+
+// reload reads the users file if it changed, call with a.mu held. A bad file keeps the accounts already loaded.
+func ( a *authenticator ) reload() {
+	info, err := os.Stat( a.file )
+	if err == nil && info.ModTime().Equal( a.modTime ) && a.users != nil {
+		return
+	}
+	users, err := readUsers( a.file )
+	if err != nil {
+		apiLog.Error( "auth - users file not loaded: ", err )
+		if a.users == nil {
+			a.users = make( map[string]userAccount )
+		}
+		return
+	}
+	a.users = users
+	if info != nil {
+		a.modTime = info.ModTime()
+	}
+	for id, s := range a.sessions {						// Deleted accounts lose their sessions
+		if _, ok := a.users[s.User]; !ok {
+			delete( a.sessions, id )
+		}
+	}
+}	// reload
+
+// enabled is false with -auth off, or -auth auto and no accounts.
+func ( a *authenticator ) enabled() bool {
+	if a.mode == "off" {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reload()
+	return a.mode == "on" || len( a.users ) > 0
+}	// enabled
+
+// identify finds the account from the bearer token or the session cookie.
+func ( a *authenticator ) identify( r *http.Request ) ( identity, *session ) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reload()
+
+	if token, ok := strings.CutPrefix( r.Header.Get("Authorization"), "Bearer " ); ok {
+		sum := sha256.Sum256( []byte(strings.TrimSpace(token)) )
+		hash := hex.EncodeToString( sum[:] )
+		for _, u := range a.users {
+			for _, t := range u.Tokens {
+				if subtle.ConstantTimeCompare( []byte(t.Hash), []byte(hash) ) == 1 {
+					return identity{ User: u.Name, Role: roleNames[u.Role], Via: "token" }, nil
+				}
+			}
+		}
+		return identity{}, nil
+	}
+	c, err := r.Cookie( sessionCookie )
+	if err != nil {
+		return identity{}, nil
+	}
+	s, ok := a.sessions[c.Value]
+	if !ok {
+		return identity{}, nil
+	}
+	if time.Now().After( s.Expires ) {
+		delete( a.sessions, c.Value )
+		return identity{}, nil
+	}
+	return identity{ User: s.User, Role: roleNames[a.users[s.User].Role], Via: "session" }, s
+}	// identify
+
+// requestIdentity is the caller as found by require, for logging who did what.
+func requestIdentity( r *http.Request ) identity {
+	if id, ok := r.Context().Value( identityKey{} ).(identity); ok {
+		return id
+	}
+	return identity{ User: "anonymous", Via: "anonymous" }
+}	// requestIdentity
+
+// safeMethod is true for requests that only read.
+func safeMethod( method string ) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// require lets the request through with at least the role, pages redirect to /login and the API gets 401.
+func ( a *authenticator ) require( min role, next http.Handler ) http.Handler {
+	return http.HandlerFunc( func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled() {
+			id := identity{ User: "anonymous", Role: roleControl, Via: "open" }
+			next.ServeHTTP( w, r.WithContext( context.WithValue(r.Context(), identityKey{}, id) ) )
+			return
+		}
+		id, s := a.identify( r )
+		switch {
+		case id.Role == roleNone && safeMethod( r.Method ) && !strings.HasPrefix( r.URL.Path, "/api/" ):
+			http.Redirect( w, r, "/login?next=" + url.QueryEscape(r.URL.RequestURI()), http.StatusFound )
+			return
+		case id.Role == roleNone:
+			writeError( w, http.StatusUnauthorized, "sign in required" )
+			return
+		case id.Role < min:
+			writeError( w, http.StatusForbidden, id.User + " may not do this, " + min.String() + " role required" )
+			return
+		case s != nil && !safeMethod( r.Method ) && !validCSRF( r, s ):
+			writeError( w, http.StatusForbidden, "missing or wrong CSRF token, reload the page" )
+			return
+		}
+		next.ServeHTTP( w, r.WithContext( context.WithValue(r.Context(), identityKey{}, id) ) )
+	} )
+}	// require
+
+func validCSRF( r *http.Request, s *session ) bool {
+	header := r.Header.Get( csrfHeader )
+	return header != "" && subtle.ConstantTimeCompare( []byte(header), []byte(s.CSRF) ) == 1
+}
+
+// requireToken lets the request through with an API token of at least the role, even with auth off.
+func ( a *authenticator ) requireToken( min role, next http.Handler ) http.Handler {
+	return http.HandlerFunc( func(w http.ResponseWriter, r *http.Request) {
+		id, _ := a.identify( r )
+		switch {
+		case id.Via != "token":
+			writeError( w, http.StatusUnauthorized, "an API token is required, Authorization: Bearer TOKEN" )
+			return
+		case id.Role < min:
+			writeError( w, http.StatusForbidden, id.User + " may not do this, " + min.String() + " role required" )
+			return
+		}
+		next.ServeHTTP( w, r.WithContext( context.WithValue(r.Context(), identityKey{}, id) ) )
+	} )
+}	// requireToken
+
+// apiGuard: reading the API takes viewer, anything else control.
+func ( a *authenticator ) apiGuard( next http.Handler ) http.Handler {
+	viewer  := a.require( roleViewer, next )
+	control := a.require( roleControl, next )
+	return http.HandlerFunc( func(w http.ResponseWriter, r *http.Request) {
+		if safeMethod( r.Method ) {
+			viewer.ServeHTTP( w, r )
+			return
+		}
+		control.ServeHTTP( w, r )
+	} )
+}	// apiGuard
+
+// content guards charts and docs unless -anoncharts.
+func ( a *authenticator ) content( next http.Handler ) http.Handler {
+	if a.anonCharts {
+		return next
+	}
+	return a.require( roleViewer, next )
+}	// content
+
+// mount adds the sign in and sign out pages, and /api/whoami for the UI.
+func ( a *authenticator ) mount( mux *http.ServeMux, apiMux *http.ServeMux ) {
+	mux.HandleFunc( "GET /login", a.loginPage )
+	mux.HandleFunc( "POST /login", a.login )
+	mux.Handle( "POST /logout", a.require( roleViewer, http.HandlerFunc(a.logout) ) )
+	apiMux.HandleFunc( "GET /api/whoami", func(w http.ResponseWriter, r *http.Request) {
+		id := requestIdentity( r )
+		writeJSON( w, http.StatusOK, map[string]interface{}{ "user": id.User, "role": id.Role.String(), "via": id.Via, "auth": id.Via != "open" } )
+	} )
+}	// mount
+
+var loginTemplate = template.Must( template.New("login").Parse( `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Infinitive Sign In</title>
+` + pageStyle + `</head>
+<body>
+<h2>Infinitive Sign In</h2>
+{{ if .Error }}<p style="color: #a00">{{ .Error }}</p>{{ end }}
+<form method="post" action="/login">
+<input type="hidden" name="next" value="{{ .Next }}">
+<p><label>User <input name="user" autocomplete="username" autofocus required></label></p>
+<p><label>Password <input name="password" type="password" autocomplete="current-password" required></label></p>
+<p><input type="submit" value="Sign in"></p>
+</form>
+</body>
+</html>
+` ) )
+
+type loginData struct {
+	Next		string
+	Error		string
+}
+
+// localNext keeps the redirect after sign in on this server.
+func localNext( next string ) string {
+	if !strings.HasPrefix( next, "/" ) || strings.HasPrefix( next, "//" ) || strings.HasPrefix( next, "/\\" ) {
+		return "/ui/"
+	}
+	return next
+}	// localNext
+
+func ( a *authenticator ) loginPage( w http.ResponseWriter, r *http.Request ) {
+	w.Header().Set( "Content-Type", "text/html; charset=utf-8" )
+	w.Header().Set( "Cache-Control", "no-store" )
+	loginTemplate.Execute( w, loginData{ Next: localNext(r.URL.Query().Get("next")) } )
+}	// loginPage
+
+// login checks the password and starts a session. The form must come from this server.
+func ( a *authenticator ) login( w http.ResponseWriter, r *http.Request ) {
+	next := localNext( r.PostFormValue("next") )
+	if origin := r.Header.Get( "Origin" ); origin != "" {
+		if u, err := url.Parse( origin ); err != nil || u.Host != r.Host {
+			writeError( w, http.StatusForbidden, "sign in from another site refused" )
+			return
+		}
+	}
+	name     := r.PostFormValue( "user" )
+	password := r.PostFormValue( "password" )
+
+	a.mu.Lock()
+	a.reload()
+	u, found := a.users[name]
+	a.mu.Unlock()
+	hash := dummyHash
+	if found {
+		hash = []byte( u.Password )
+	}
+	if bcrypt.CompareHashAndPassword( hash, []byte(password) ) != nil || !found {
+		host, _, _ := net.SplitHostPort( r.RemoteAddr )
+		apiLog.Warn( "auth - failed sign in for " + name + " from " + host )
+		time.Sleep( time.Second )
+		w.Header().Set( "Content-Type", "text/html; charset=utf-8" )
+		w.WriteHeader( http.StatusUnauthorized )
+		loginTemplate.Execute( w, loginData{ Next: next, Error: "Wrong user or password." } )
+		return
+	}
+
+	s := &session{ User: name, CSRF: randomHex(32), Expires: time.Now().Add(sessionLifetime) }
+	id := randomHex( 32 )
+	a.mu.Lock()
+	for k, old := range a.sessions {
+		if time.Now().After( old.Expires ) {
+			delete( a.sessions, k )
+		}
+	}
+	a.sessions[id] = s
+	a.mu.Unlock()
+
+	secure := r.TLS != nil
+	http.SetCookie( w, &http.Cookie{ Name: sessionCookie, Value: id, Path: "/", Expires: s.Expires, HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode } )
+	http.SetCookie( w, &http.Cookie{ Name: csrfCookie, Value: s.CSRF, Path: "/", Expires: s.Expires, Secure: secure, SameSite: http.SameSiteStrictMode } )
+	http.Redirect( w, r, next, http.StatusSeeOther )
+}	// login
+
+func ( a *authenticator ) logout( w http.ResponseWriter, r *http.Request ) {
+	if c, err := r.Cookie( sessionCookie ); err == nil {
+		a.mu.Lock()
+		delete( a.sessions, c.Value )
+		a.mu.Unlock()
+	}
+	http.SetCookie( w, &http.Cookie{ Name: sessionCookie, Value: "", Path: "/", MaxAge: -1 } )
+	http.SetCookie( w, &http.Cookie{ Name: csrfCookie, Value: "", Path: "/", MaxAge: -1 } )
+	w.WriteHeader( http.StatusNoContent )
+}	// logout
+
+// randomHex returns n random bytes as hex.
+func randomHex( n int ) string {
+	b := make( []byte, n )
+	if _, err := rand.Read( b ); err != nil {
+		apiLog.Panicf( "crypto/rand failure: %s", err )
+	}
+	return hex.EncodeToString( b )
+}	// randomHex
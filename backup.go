@@ -0,0 +1,434 @@
+package main
+	// Backup and restore. GET /api/backup downloads one versioned bundle, a tar.gz with bundle.json first listing
+	// every file with its size, time and SHA-256 checksum, then the files as they are under filePath:
+	//		infinitive.yaml and the json settings files, schedule, profiles, override, limits, calendar and the rest
+	//		infinitiveAudit.jsonl			the audit log of changes and events
+	//		infinitiveRecovery.jsonl		the recovery event log of early starts and arrivals
+	//		YYYY-MM/summaries.json			the daily summaries of every month
+	//		YYYY-MM/rollups.json			the hourly and daily rollups of every month, see rollup.go
+	//		YYYY-MM/YYYY-MM-DD_Infinitive.csv	the raw samples of the days from..to, archived days included
+	// Accounts are not in the bundle, passwords and API tokens stay on the Pi, add them again with infinitive user.
+	//		GET /api/backup?from=2024-01-01&to=2024-12-31		control role, from defaults to 30 days ago, to to today
+	// The samples are at most backupMaxDays. The day files and logs are read once for the checksums and again as they
+	// are sent, so a bundle of any size is never held in memory. A file that only grew in between is sent as it was.
+	// The restore command checks the whole bundle before writing anything. A file newer on disk than in the bundle
+	// is not overwritten unless -force, the restore then stops without writing. Stop the service first.
+	//		infinitive restore [-force] [-n] [-data /var/lib/infinitive/] infinitive-backup-2024-12-31.tar.gz
+	// With the bolt store the audit log and the CSV files are written from the database, same format.
+	// Restore writes files, run infinitive migrate after it to load them into the database.
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var backupManifestName	= "bundle.json"
+var backupFormat		= "infinitive-backup"
+var backupVersion		= 1
+var backupDefaultDays	= 30
+var backupMaxDays		= 732						// Two years of samples in one bundle
+
+var backupCSVName		= regexp.MustCompile( `^\d{4}-\d{2}/\d{4}-\d{2}-\d{2}_Infinitive\.csv$` )
+var backupSummariesName	= regexp.MustCompile( `^\d{4}-\d{2}/` + regexp.QuoteMeta(summariesFileName) + `$` )
+var backupRollupsName	= regexp.MustCompile( `^\d{4}-\d{2}/` + regexp.QuoteMeta(rollupsFileName) + `$` )
+
+var restoreUsage = `usage: infinitive restore [-config FILE] [-force] [-n] [-data DIR] BUNDLE.tar.gz`
+
+// The first file of a bundle
+type backupManifest struct {
+	Format			string			`json:"format"`
+	Version			int				`json:"version"`
+	Created			time.Time		`json:"created"`
+	Infinitive		string			`json:"infinitive"`			// Version of the program that made it
+	From			string			`json:"from"`					// Sample range, YYYY-MM-DD
+	To				string			`json:"to"`
+	Files			[]archiveEntry	`json:"files"`
+}
+
+// backupSettingsFiles are the settings and logs kept in filePath, by their names there.
+func backupSettingsFiles() []string {
+	return []string{ configFileName, limitsFileName, scheduleFileName, profilesFileName, overrideFileName,
+		circulationFileName, occupancyFileName, calendarFileName, calendarApprovedName, calendarApprovedRulesName, jobsFileName,
+		auditFileName, recoveryFileName }
+}	// backupSettingsFiles
+
+// backupFileAllowed is a name restore may write, nothing outside these or outside the data folder.
+func backupFileAllowed( name string ) bool {
+	for _, f := range backupSettingsFiles() {
+		if name == f {
+			return true
+		}
+	}
+	return backupCSVName.MatchString( name ) || backupSummariesName.MatchString( name ) || backupRollupsName.MatchString( name )
+}	// backupFileAllowed
+
+// makeBackup lists the bundle's files with their checksums, the samples of the days from..to inclusive,
+// and returns how to open each one again for writeTarGz.
+func makeBackup( from, to time.Time ) ( backupManifest, func( string ) ( io.ReadCloser, error ), error ) {
+	var errs []error
+
+	m := backupManifest{ Format: backupFormat, Version: backupVersion, Created: time.Now(), Infinitive: Version,
+		From: from.Format("2006-01-02"), To: to.Format("2006-01-02") }
+	sources := make( map[string]func() ( io.ReadCloser, error ) )
+	addSource := func( name string, modTime time.Time, open func() ( io.ReadCloser, error ) ) {
+		r, err := open()
+		if errors.Is( err, os.ErrNotExist ) {
+			return
+		}
+		if err != nil {
+			errs = append( errs, err )
+			return
+		}
+		h := sha256.New()
+		size, err := io.Copy( h, r )
+		r.Close()
+		if err != nil {
+			errs = append( errs, fmt.Errorf( "%s: %w", name, err ) )
+			return
+		}
+		m.Files = append( m.Files, archiveEntry{ Name: name, Size: size, ModTime: modTime, SHA256: hex.EncodeToString(h.Sum(nil)) } )
+		sources[name] = open
+	}
+	add := func( name string, modTime time.Time, data []byte ) {
+		addSource( name, modTime, func() ( io.ReadCloser, error ) { return io.NopCloser( bytes.NewReader(data) ), nil } )
+	}
+	addFile := func( name, path string ) {
+		info, err := os.Stat( path )
+		if errors.Is( err, os.ErrNotExist ) {
+			return
+		}
+		if err != nil {
+			errs = append( errs, err )
+			return
+		}
+		addSource( name, info.ModTime(), func() ( io.ReadCloser, error ) { return os.Open( path ) } )
+	}
+
+	_, fromFiles := dataStore.(*csvStore)				// Else the bolt store, see storeDayCSV
+	configMu.RLock()
+	configPath, limitsPath := configFile, running.Limits
+	configMu.RUnlock()
+	for _, name := range backupSettingsFiles() {
+		switch {
+		case name == configFileName && configPath != "":
+			addFile( name, configPath )
+		case name == limitsFileName && limitsPath != "":
+			addFile( name, limitsPath )
+		case name == auditFileName && !fromFiles:
+			data, err := storeAuditLog()
+			if err != nil {
+				errs = append( errs, err )
+			} else if len(data) > 0 {
+				add( name, m.Created, data )
+			}
+		default:
+			addFile( name, filePath + name )
+		}
+	}
+
+	// Summaries of every month, as written for archived months or worked out for the others
+	for _, month := range archiveMonths() {
+		days := make( map[string]daySummary )
+		for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+			if sum, ok := dataStore.DailySummary( day ); ok {
+				days[day.Format("2006-01-02")] = sum
+			}
+		}
+		if len(days) == 0 {
+			continue
+		}
+		data, err := json.MarshalIndent( days, "", "\t" )
+		if err != nil {
+			errs = append( errs, err )
+			continue
+		}
+		add( month.Format("2006-01") + "/" + summariesFileName, m.Created, append(data, '\n') )
+
+		// The month's rollups as the csv store keeps them, pruned days have only these and the summaries
+		var rf rollupsFile
+		for _, res := range []rollupRes{ rollupHour, rollupDay } {
+			list, err := dataStore.Rollups( res, month, month.AddDate(0, 1, 0) )
+			if err != nil {
+				errs = append( errs, err )
+			}
+			*rf.list( res ) = list
+		}
+		if len(rf.Hour) == 0 && len(rf.Day) == 0 {
+			continue
+		}
+		if data, err = json.Marshal( rf ); err != nil {
+			errs = append( errs, err )
+			continue
+		}
+		add( month.Format("2006-01") + "/" + rollupsFileName, m.Created, append(data, '\n') )
+	}
+
+	for day := from; !day.After( to ); day = day.AddDate(0, 0, 1) {
+		csvName := dailyFileFor( day )
+		name := day.Format("2006-01") + "/" + filepath.Base(csvName)
+		if !fromFiles {
+			addSource( name, m.Created, func() ( io.ReadCloser, error ) {
+				data, err := storeDayCSV( day )
+				if err == nil && len(data) == 0 {
+					err = os.ErrNotExist
+				}
+				return io.NopCloser( bytes.NewReader(data) ), err
+			} )
+			continue
+		}
+		modTime := m.Created
+		if info, err := os.Stat( csvName ); err == nil {
+			modTime = info.ModTime()
+		} else if _, archived, ok := archivedData( csvName ); ok {
+			modTime = archived
+		}
+		addSource( name, modTime, func() ( io.ReadCloser, error ) { return openDataFile( csvName ) } )
+	}
+	open := func( name string ) ( io.ReadCloser, error ) {
+		if source, ok := sources[name]; ok {
+			return source()
+		}
+		return nil, fmt.Errorf( "%s: %w", name, os.ErrNotExist )
+	}
+	return m, open, errors.Join( errs... )
+}	// makeBackup
+
+// storeAuditLog is the audit log file as the csv store writes it, from the database.
+func storeAuditLog() ( []byte, error ) {
+	var buf bytes.Buffer
+
+	events, err := dataStore.Events( time.Time{}, time.Now().AddDate(1, 0, 0) )
+	for _, e := range events {
+		line, err := json.Marshal( e )
+		if err != nil {
+			return nil, err
+		}
+		buf.Write( append(line, '\n') )
+	}
+	return buf.Bytes(), err
+}	// storeAuditLog
+
+// storeDayCSV is the day's CSV file as the csv store writes it, a header line for each start, nothing for no samples.
+func storeDayCSV( day time.Time ) ( []byte, error ) {
+	var buf bytes.Buffer
+
+	samples, err := daySamples( day )
+	if err != nil || len(samples) == 0 {
+		return nil, err
+	}
+	sum, _ := dataStore.DailySummary( day )
+	for i := 0; i < max( sum.Restarts, 1 ); i++ {
+		buf.WriteString( csvHeader )
+	}
+	for _, s := range samples {
+		buf.WriteString( formatSampleLine(s) )
+	}
+	return buf.Bytes(), nil
+}	// storeDayCSV
+
+// backupRange reads from and to, YYYY-MM-DD, the last backupDefaultDays days when not given.
+func backupRange( fromText, toText string ) ( time.Time, time.Time, error ) {
+	now  := time.Now()
+	to   := time.Date( now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local )
+	from := to.AddDate( 0, 0, -backupDefaultDays )
+	var err error
+	if fromText != "" {
+		if from, err = time.ParseInLocation( "2006-01-02", fromText, time.Local ); err != nil {
+			return from, to, fmt.Errorf( "from %q is not YYYY-MM-DD", fromText )
+		}
+	}
+	if toText != "" {
+		if to, err = time.ParseInLocation( "2006-01-02", toText, time.Local ); err != nil {
+			return from, to, fmt.Errorf( "to %q is not YYYY-MM-DD", toText )
+		}
+	}
+	switch {
+	case to.Before( from ):
+		return from, to, errors.New( "to is before from" )
+	case to.Sub( from ) > time.Duration(backupMaxDays) * 24 * time.Hour:
+		return from, to, fmt.Errorf( "at most %d days of samples in one bundle, back up a longer span in parts", backupMaxDays )
+	}
+	return from, to, nil
+}	// backupRange
+
+// Control role only, the bundle holds the whole history and the settings
+func mountBackupAPI( mux *http.ServeMux, auth *authenticator ) {
+	mux.Handle( "GET /api/backup", auth.require( roleControl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, to, err := backupRange( r.URL.Query().Get("from"), r.URL.Query().Get("to") )
+		if err != nil {
+			writeError( w, http.StatusBadRequest, err.Error() )
+			return
+		}
+		m, open, err := makeBackup( from, to )
+		if err != nil {
+			apiLog.Error( "backup - incomplete: ", err )
+			writeError( w, http.StatusInternalServerError, "backup failed: " + err.Error() )
+			return
+		}
+		name := "infinitive-backup-" + m.Created.Format("2006-01-02") + archiveExt
+		w.Header().Set( "Content-Type", "application/gzip" )
+		w.Header().Set( "Content-Disposition", "attachment; filename=\"" + name + "\"" )
+		if err = writeTarGz( w, backupManifestName, m, m.Created, m.Files, open ); err != nil {
+			apiLog.Error( "backup - write failure: ", err )
+			return
+		}
+		apiLog.WithField( "files", len(m.Files) ).Info( "backup - downloaded by " + requestIdentity(r).User + ", samples " + m.From + " to " + m.To )
+	})) )
+}	// mountBackupAPI
+
+// readBackup reads a bundle and checks the manifest, every name and every checksum.
+func readBackup( fileName string ) ( backupManifest, map[string][]byte, error ) {
+	var m backupManifest
+
+	f, err := os.Open( fileName )
+	if err != nil {
+		return m, nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader( f )
+	if err != nil {
+		return m, nil, fmt.Errorf( "%s: not a backup bundle: %w", fileName, err )
+	}
+	files := make( map[string][]byte )
+	tr := tar.NewReader( gz )
+	for first := true; ; first = false {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, nil, fmt.Errorf( "%s: %w", fileName, err )
+		}
+		data, err := io.ReadAll( tr )
+		if err != nil {
+			return m, nil, fmt.Errorf( "%s: %s: %w", fileName, hdr.Name, err )
+		}
+		if first {
+			if hdr.Name != backupManifestName {
+				return m, nil, fmt.Errorf( "%s: not a backup bundle, %s is not first", fileName, backupManifestName )
+			}
+			if err = json.Unmarshal( data, &m ); err != nil {
+				return m, nil, fmt.Errorf( "%s: %s: %w", fileName, backupManifestName, err )
+			}
+			continue
+		}
+		if _, dup := files[hdr.Name]; dup {
+			return m, nil, fmt.Errorf( "%s: %s twice", fileName, hdr.Name )
+		}
+		files[hdr.Name] = data
+	}
+	switch {
+	case m.Format != backupFormat:
+		return m, nil, fmt.Errorf( "%s: not a backup bundle", fileName )
+	case m.Version < 1 || m.Version > backupVersion:
+		return m, nil, fmt.Errorf( "%s: bundle version %d, this Infinitive reads up to %d", fileName, m.Version, backupVersion )
+	case len(files) != len(m.Files):
+		return m, nil, fmt.Errorf( "%s: %d files, the manifest lists %d", fileName, len(files), len(m.Files) )
+	}
+	for _, e := range m.Files {
+		data, ok := files[e.Name]
+		sum := sha256.Sum256( data )
+		switch {
+		case !backupFileAllowed( e.Name ):
+			return m, nil, fmt.Errorf( "%s: %s is not a file a bundle may hold", fileName, e.Name )
+		case !ok || int64(len(data)) != e.Size || hex.EncodeToString( sum[:] ) != e.SHA256:
+			return m, nil, fmt.Errorf( "%s: %s does not match the manifest", fileName, e.Name )
+		}
+	}
+	return m, files, nil
+}	// readBackup
+
+// runRestoreCommand restores a bundle into the data folder, args follow "restore".
+func runRestoreCommand( args []string ) error {
+	var force, dryRun bool
+
+	dataDir := filePath
+	fs := flag.NewFlagSet( "restore", flag.ContinueOnError )
+	fs.BoolVar( &force, "force", false, "overwrite files that are newer on disk" )
+	fs.BoolVar( &dryRun, "n", false, "only check the bundle and list what would be restored" )
+	fs.StringVar( &dataDir, "data", dataDir, "data folder to restore into" )
+	fs.Usage = func() { fmt.Fprintln( os.Stderr, restoreUsage ); fs.PrintDefaults() }
+	if err := fs.Parse( args ); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New( restoreUsage )
+	}
+	dataDir = strings.TrimSuffix( dataDir, "/" ) + "/"
+
+	m, files, err := readBackup( fs.Arg(0) )
+	if err != nil {
+		return err
+	}
+	fmt.Printf( "bundle of %s by Infinitive %s, %d files, samples %s to %s\n",
+		m.Created.Format("2006-01-02 15:04"), m.Infinitive, len(m.Files), m.From, m.To )
+
+	// Decide every file before writing any
+	var write, newer []archiveEntry
+	unchanged := 0
+	for _, e := range m.Files {
+		info, err := os.Stat( dataDir + e.Name )
+		switch {
+		case errors.Is( err, os.ErrNotExist ):
+			write = append( write, e )
+		case err != nil:
+			return err
+		default:
+			if data, err := os.ReadFile( dataDir + e.Name ); err == nil && bytes.Equal( data, files[e.Name] ) {
+				unchanged++
+				continue
+			}
+			if info.ModTime().Truncate( time.Second ).After( e.ModTime.Truncate(time.Second) ) {
+				newer = append( newer, e )
+			}
+			write = append( write, e )
+		}
+	}
+	for _, e := range newer {
+		fmt.Printf( "newer on disk: %s\n", e.Name )
+	}
+	if len(newer) > 0 && !force {
+		return fmt.Errorf( "%d files are newer on disk than in the bundle, nothing restored, -force overwrites them", len(newer) )
+	}
+	if dryRun {
+		for _, e := range write {
+			fmt.Printf( "would restore: %s\n", e.Name )
+		}
+		fmt.Printf( "%d to restore, %d unchanged\n", len(write), unchanged )
+		return nil
+	}
+
+	for _, e := range write {
+		target := dataDir + e.Name
+		if err := os.MkdirAll( filepath.Dir(target), 0755 ); err != nil {
+			return err
+		}
+		tmp := filepath.Join( filepath.Dir(target), ".restore.tmp" )
+		if err := os.WriteFile( tmp, files[e.Name], 0644 ); err != nil {
+			return err
+		}
+		if err := os.Chtimes( tmp, e.ModTime, e.ModTime ); err != nil {
+			return err
+		}
+		if err := os.Rename( tmp, target ); err != nil {
+			return err
+		}
+		fmt.Printf( "restored: %s\n", e.Name )
+	}
+	fmt.Printf( "%d restored, %d unchanged. Add the accounts with infinitive user add, then start the service.\n", len(write), unchanged )
+	return nil
+}	// runRestoreCommand
@@ -0,0 +1,422 @@
+package main
+	// Calendar import, events from an iCalendar file whose summary holds a keyword become away periods or setpoints.
+	// Settings are in filePath+calendarFileName:
+	//		{ "file": "", "horizonDays": 30,
+	//		  "rules": [ { "keyword": "vacation", "profile": "vacation" }, { "keyword": "trip", "profile": "away" },
+	//		             { "keyword": "guests", "heatSetpoint": 70, "coolSetpoint": 74 } ] }
+	// The file is the .ics named, or with none the newest .ics dropped into filePath. Keywords match the summary
+	// ignoring case, the first rule that matches is used. A profile event enters the profile at its start and home at its
+	// end, if still in that profile. A setpoint event is a temporary override until its end, see override.go.
+	// Nothing takes effect until the plan is approved: approving copies the file to filePath+calendarApprovedName and
+	// the rules with the plan's hash to filePath+calendarApprovedRulesName, which is what runs. A changed file or changed
+	// rules show as a pending plan next to the approved one until that is approved too.
+	//		GET  /api/calendar			settings, the approved plan and any pending plan
+	//		PUT  /api/calendar			replace the settings
+	//		POST /api/calendar/approve	{ "hash": ... } of the pending plan shown
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+)
+
+var calendarFileName	= "infinitiveCalendar.json"
+var calendarApprovedName	= "infinitiveCalendar.approved.ics"
+var calendarApprovedRulesName	= "infinitiveCalendar.approved.json"
+var calendarTick		= time.Minute
+
+// Maps events with a keyword to a profile or setpoints
+type calendarRule struct {
+	Keyword			string		`json:"keyword"`
+	Profile			string		`json:"profile,omitempty"`
+	HeatSetpoint	uint8		`json:"heatSetpoint,omitempty"`
+	CoolSetpoint	uint8		`json:"coolSetpoint,omitempty"`
+}
+
+// One planned period
+type calendarEntry struct {
+	Summary			string		`json:"summary"`
+	Start			time.Time	`json:"start"`
+	End				time.Time	`json:"end"`
+	calendarRule
+}
+
+// The calendar file
+type calendarConfig struct {
+	File			string				`json:"file"`
+	HorizonDays		int					`json:"horizonDays"`
+	Rules			[]calendarRule		`json:"rules"`
+	Current			*calendarEntry		`json:"current,omitempty"`		// The entry in effect, applied by us
+}
+
+// A plan made from one calendar file
+type calendarPlan struct {
+	Source			string				`json:"source"`
+	Hash			string				`json:"hash"`					// Of the file content and the rules
+	Entries			[]calendarEntry		`json:"entries"`
+	Warnings		[]string			`json:"warnings,omitempty"`
+}
+
+// The rules a plan was approved with
+type calendarApproval struct {
+	Hash			string				`json:"hash"`
+	Rules			[]calendarRule		`json:"rules"`
+}
+
+// The calendar engine
+type calendarImporter struct {
+	mu				sync.Mutex
+	api				*infinity.Api
+	file			string
+	cfg				calendarConfig
+}
+
+var calendarEngine *calendarImporter
+
+// newCalendarImporter loads the settings, a missing file is no rules and so no plan.
+func newCalendarImporter( api *infinity.Api ) ( *calendarImporter, error ) {
+	c := &calendarImporter{ api: api, file: filePath + calendarFileName, cfg: calendarConfig{ HorizonDays: 30 } }
+	data, err := os.ReadFile( c.file )
+	if errors.Is( err, os.ErrNotExist ) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal( data, &c.cfg ); err != nil {
+		return nil, fmt.Errorf( "%s: %w", c.file, err )
+	}
+	if err = c.cfg.validate(); err != nil {
+		return nil, fmt.Errorf( "%s: %w", c.file, err )
+	}
+	return c, nil
+}	// newCalendarImporter
+
+// validate needs a keyword and one known profile or setpoints inside the limits for every rule.
+func ( cfg calendarConfig ) validate() error {
+	if cfg.HorizonDays < 1 || cfg.HorizonDays > 366 {
+		return errors.New( "horizonDays is 1 to 366" )
+	}
+	for _, r := range cfg.Rules {
+		switch {
+		case strings.TrimSpace( r.Keyword ) == "":
+			return errors.New( "every rule needs a keyword" )
+		case r.Profile != "" && ( r.HeatSetpoint != 0 || r.CoolSetpoint != 0 ):
+			return fmt.Errorf( "rule %q: a profile or setpoints, not both", r.Keyword )
+		case r.Profile == "" && r.HeatSetpoint == 0 && r.CoolSetpoint == 0:
+			return fmt.Errorf( "rule %q: a profile or setpoints is needed", r.Keyword )
+		case r.Profile != "" && profileEngine != nil:
+			if _, ok := profileEngine.snapshot().Profiles[r.Profile]; !ok {
+				return fmt.Errorf( "rule %q: no profile %s", r.Keyword, r.Profile )
+			}
+		default:
+			if err := limits.check( nil, infinity.TStatZoneConfig{ HeatSetpoint: r.HeatSetpoint, CoolSetpoint: r.CoolSetpoint } ); err != nil {
+				return fmt.Errorf( "rule %q: %w", r.Keyword, err )
+			}
+		}
+	}
+	return nil
+}	// validate
+
+// save writes the settings, call with c.mu held.
+func ( c *calendarImporter ) save() error {
+	data, err := json.MarshalIndent( c.cfg, "", "\t" )
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join( filepath.Dir(c.file), ".calendar.tmp" )
+	if err = os.WriteFile( tmp, append(data, '\n'), 0644 ); err != nil {
+		return err
+	}
+	return os.Rename( tmp, c.file )
+}	// save
+
+// source is the calendar file to read, the one set or the newest .ics in filePath, empty when none.
+func ( cfg calendarConfig ) source() string {
+	if cfg.File != "" {
+		return cfg.File
+	}
+	names, _ := filepath.Glob( filePath + "*.ics" )
+	newest, newestTime := "", time.Time{}
+	for _, name := range names {
+		info, err := os.Stat( name )
+		if err != nil || filepath.Base( name ) == calendarApprovedName {
+			continue
+		}
+		if info.ModTime().After( newestTime ) {
+			newest, newestTime = name, info.ModTime()
+		}
+	}
+	return newest
+}	// source
+
+// plan reads a calendar file and lists the events matching a rule over the horizon.
+func ( cfg calendarConfig ) plan( fileName string, now time.Time ) ( *calendarPlan, error ) {
+	data, err := os.ReadFile( fileName )
+	if err != nil {
+		return nil, err
+	}
+	events, warnings, err := parseICS( bytes.NewReader(data) )
+	if err != nil {
+		return nil, fmt.Errorf( "%s: %w", fileName, err )
+	}
+	p := &calendarPlan{ Source: fileName, Hash: calendarHash( data, cfg.Rules ), Entries: []calendarEntry{}, Warnings: warnings }
+	occurrences, more := expandICS( events, now, now.AddDate(0, 0, cfg.HorizonDays) )
+	p.Warnings = append( p.Warnings, more... )
+	for _, o := range occurrences {
+		for _, r := range cfg.Rules {
+			if strings.Contains( strings.ToLower(o.Summary), strings.ToLower(r.Keyword) ) {
+				p.Entries = append( p.Entries, calendarEntry{ Summary: o.Summary, Start: o.Start, End: o.End, calendarRule: r } )
+				break
+			}
+		}
+	}
+	return p, nil
+}	// plan
+
+// calendarHash identifies a plan by the file content and the rules.
+func calendarHash( data []byte, rules []calendarRule ) string {
+	r, _ := json.Marshal( rules )
+	sum := sha256.Sum256( append(data, r...) )
+	return hex.EncodeToString( sum[:] )
+}	// calendarHash
+
+// approvedPlan plans the approved file with the rules it was approved with, nil when nothing is approved.
+// An approved file without its rules was approved before they were kept, and needs approving again.
+func ( cfg calendarConfig ) approvedPlan( now time.Time ) ( *calendarPlan, error ) {
+	data, err := os.ReadFile( filePath + calendarApprovedRulesName )
+	if errors.Is( err, os.ErrNotExist ) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var a calendarApproval
+	if err = json.Unmarshal( data, &a ); err != nil {
+		return nil, fmt.Errorf( "%s: %w", calendarApprovedRulesName, err )
+	}
+	cfg.Rules = a.Rules
+	p, err := cfg.plan( filePath + calendarApprovedName, now )
+	switch {
+	case errors.Is( err, os.ErrNotExist ):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case p.Hash != a.Hash:
+		return nil, fmt.Errorf( "%s does not match %s, approve the calendar again", calendarApprovedName, calendarApprovedRulesName )
+	}
+	return p, nil
+}	// approvedPlan
+
+// plans returns the approved plan and the pending one, nil when none or when the same as the approved.
+func ( c *calendarImporter ) plans( now time.Time ) ( approved, pending *calendarPlan, err error ) {
+	c.mu.Lock()
+	cfg := c.cfg
+	c.mu.Unlock()
+	if approved, err = cfg.approvedPlan( now ); err != nil {
+		return nil, nil, err
+	}
+	if src := cfg.source(); src != "" {
+		if pending, err = cfg.plan( src, now ); err != nil {
+			return approved, nil, err
+		}
+		if approved != nil && pending.Hash == approved.Hash {			// Same file content and the rules approved
+			pending = nil
+		}
+	}
+	return approved, pending, nil
+}	// plans
+
+// approve copies the source file to the approved file and keeps the rules with it, when its plan is the one the user saw.
+func ( c *calendarImporter ) approve( hash string, by changeSource ) error {
+	c.mu.Lock()
+	rules := c.cfg.Rules
+	c.mu.Unlock()
+	_, pending, err := c.plans( time.Now() )
+	switch {
+	case err != nil:
+		return err
+	case pending == nil:
+		return errors.New( "no pending plan" )
+	case pending.Hash != hash:
+		return errors.New( "the calendar changed since it was shown, look at the plan again" )
+	}
+	data, err := os.ReadFile( pending.Source )
+	if err != nil {
+		return err
+	}
+	if calendarHash( data, rules ) != hash {
+		return errors.New( "the calendar changed since it was shown, look at the plan again" )
+	}
+	approval, err := json.MarshalIndent( calendarApproval{ Hash: hash, Rules: rules }, "", "\t" )
+	if err != nil {
+		return err
+	}
+	tmp := filePath + ".calendar.ics.tmp"
+	if err = os.WriteFile( tmp, data, 0644 ); err != nil {
+		return err
+	}
+	if err = os.Rename( tmp, filePath + calendarApprovedName ); err != nil {
+		return err
+	}
+	tmp = filePath + ".calendar.approved.tmp"						// A crash between the two fails the hash check in approvedPlan
+	if err = os.WriteFile( tmp, append(approval, '\n'), 0644 ); err != nil {
+		return err
+	}
+	if err = os.Rename( tmp, filePath + calendarApprovedRulesName ); err != nil {
+		return err
+	}
+	writeAudit( auditEntry{ Time: time.Now(), changeSource: by, Event: fmt.Sprintf( "calendar approved, %d entries", len(pending.Entries) ), Result: "ok" } )
+	go c.tick( time.Now() )
+	return nil
+}	// approve
+
+// run follows the approved plan.
+func ( c *calendarImporter ) run( ctx context.Context ) {
+	for {
+		c.tick( time.Now() )
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After( calendarTick ):
+		}
+	}
+}	// run
+
+func ( c *calendarImporter ) tick( now time.Time ) {
+	var active *calendarEntry
+
+	approved, _, err := c.plans( now )
+	if err != nil {
+		controlLog.Error( "calendar - ", err )
+		return
+	}
+	if approved != nil {
+		for i, e := range approved.Entries {
+			if !now.Before( e.Start ) && now.Before( e.End ) {
+				active = &approved.Entries[i]				// The latest to start wins when they overlap
+			}
+		}
+	}
+	c.mu.Lock()
+	current := c.cfg.Current
+	c.mu.Unlock()
+	switch {
+	case active != nil && ( current == nil || !current.Start.Equal( active.Start ) || current.Summary != active.Summary ):
+		if err := c.apply( *active, now ); err != nil {
+			controlLog.Error( "calendar - " + active.Summary + " not applied: ", err )
+			if errors.Is( err, errUpdateFailed ) {
+				return									// Tried again on the next tick
+			}
+		}
+	case active == nil && current != nil:
+		c.finish( *current )
+	default:
+		return
+	}
+	c.mu.Lock()
+	c.cfg.Current = active
+	if err := c.save(); err != nil {
+		controlLog.Error( "calendar - save failure: ", err )
+	}
+	c.mu.Unlock()
+}	// tick
+
+// apply starts an entry, entering its profile or overriding the setpoints until its end.
+func ( c *calendarImporter ) apply( e calendarEntry, now time.Time ) error {
+	by := changeSource{ Source: "calendar" }
+	controlLog.Info( "calendar - " + e.Summary + " until " + e.End.Format("2006-01-02 15:04") )
+	if e.Profile != "" {
+		return profileEngine.enter( e.Profile, by )
+	}
+	until := e.End
+	if limit := now.Add( time.Duration(overrideMaxHours * float64(time.Hour)) ); until.After( limit ) {
+		until = limit
+	}
+	_, _, err := overrideEngine.start( overrideRequest{ HeatSetpoint: e.HeatSetpoint, CoolSetpoint: e.CoolSetpoint, Until: &until }, by )
+	return err
+}	// apply
+
+// finish ends an entry, a profile is left for home only if nobody switched since. Overrides end by themselves.
+func ( c *calendarImporter ) finish( e calendarEntry ) {
+	controlLog.Info( "calendar - " + e.Summary + " ended" )
+	if e.Profile != "" && e.Profile != homeProfile && profileEngine.snapshot().Active == e.Profile {
+		if err := profileEngine.enter( homeProfile, changeSource{ Source: "calendar" } ); err != nil {
+			controlLog.Error( "calendar - home not applied: ", err )
+		}
+	}
+}	// finish
+
+// mountCalendarAPI adds the calendar handlers to mux.
+func mountCalendarAPI( mux *http.ServeMux, c *calendarImporter ) {
+	status := func( w http.ResponseWriter ) {
+		reply := struct {
+			Settings	calendarConfig		`json:"settings"`
+			Approved	*calendarPlan		`json:"approved"`
+			Pending		*calendarPlan		`json:"pending"`
+			Error		string				`json:"error,omitempty"`
+		}{}
+		var err error
+		reply.Approved, reply.Pending, err = c.plans( time.Now() )
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		c.mu.Lock()
+		reply.Settings = c.cfg
+		c.mu.Unlock()
+		writeJSON( w, http.StatusOK, reply )
+	}
+
+	mux.HandleFunc( "GET /api/calendar", func(w http.ResponseWriter, r *http.Request) {
+		status( w )
+	} )
+
+	mux.HandleFunc( "PUT /api/calendar", func(w http.ResponseWriter, r *http.Request) {
+		var cfg calendarConfig
+		if err := json.NewDecoder( r.Body ).Decode( &cfg ); err != nil {
+			writeError( w, http.StatusBadRequest, "invalid calendar settings: " + err.Error() )
+			return
+		}
+		if err := cfg.validate(); err != nil {
+			writeError( w, http.StatusUnprocessableEntity, err.Error() )
+			return
+		}
+		c.mu.Lock()
+		cfg.Current = c.cfg.Current						// Not the client's to set
+		c.cfg = cfg
+		err := c.save()
+		c.mu.Unlock()
+		if err != nil {
+			writeError( w, http.StatusInternalServerError, "calendar settings not saved: " + err.Error() )
+			return
+		}
+		status( w )
+	} )
+
+	mux.HandleFunc( "POST /api/calendar/approve", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Hash		string		`json:"hash"`
+		}
+		if err := json.NewDecoder( r.Body ).Decode( &body ); err != nil {
+			writeError( w, http.StatusBadRequest, "invalid approval: " + err.Error() )
+			return
+		}
+		if err := c.approve( body.Hash, requestSource(r) ); err != nil {
+			writeError( w, http.StatusConflict, err.Error() )
+			return
+		}
+		status( w )
+	} )
+}	// mountCalendarAPI
@@ -0,0 +1,232 @@
+package main
+	// Fan circulation, runs the blower some minutes each hour when the system is idle, kept in filePath+circulationFileName.
+	//		{ "enabled": true, "minutesPerHour": 15, "fanMode": "low", "outdoorMin": 10, "outdoorMax": 90,
+	//		  "quietStart": "22:00", "quietEnd": "07:00" }
+	// In the first minutesPerHour minutes of each hour, if the fan mode is auto and nothing is running, the fan mode
+	// is set to fanMode, and back to auto after. Not outside outdoorMin..outdoorMax or in quiet hours.
+	// Someone else changing the fan mode while it runs ends circulation for the hour.
+	// Samples taken while circulating are marked in the daily CSV, so they don't count as heating or cooling runtime.
+	//		GET /api/circulation	settings and whether it is running
+	//		PUT /api/circulation	replace the settings
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+)
+
+var circulationFileName	= "infinitiveCirculation.json"
+var circulationTick		= time.Minute
+
+// The circulation file
+type circulationConfig struct {
+	Enabled			bool		`json:"enabled"`
+	MinutesPerHour	int			`json:"minutesPerHour"`
+	FanMode			string		`json:"fanMode"`
+	OutdoorMin		int			`json:"outdoorMin"`
+	OutdoorMax		int			`json:"outdoorMax"`
+	QuietStart		string		`json:"quietStart"`		// HH:MM, equal to quietEnd for none
+	QuietEnd		string		`json:"quietEnd"`
+	Running			string		`json:"running,omitempty"`	// The fan mode we set while circulating, a restart puts it back to auto
+}
+
+// The circulation engine
+type circulator struct {
+	mu				sync.Mutex
+	api				*infinity.Api
+	file			string
+	cfg				circulationConfig
+}
+
+var circulationEngine *circulator
+
+func defaultCirculation() circulationConfig {
+	return circulationConfig{ MinutesPerHour: 10, FanMode: "low", OutdoorMin: 0, OutdoorMax: 95, QuietStart: "22:00", QuietEnd: "07:00" }
+}
+
+// newCirculator loads the circulation file, a missing file is circulation off.
+func newCirculator( api *infinity.Api ) ( *circulator, error ) {
+	c := &circulator{ api: api, file: filePath + circulationFileName, cfg: defaultCirculation() }
+	data, err := os.ReadFile( c.file )
+	if errors.Is( err, os.ErrNotExist ) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal( data, &c.cfg ); err != nil {
+		return nil, fmt.Errorf( "%s: %w", c.file, err )
+	}
+	if err = c.cfg.validate(); err != nil {
+		return nil, fmt.Errorf( "%s: %w", c.file, err )
+	}
+	return c, nil
+}	// newCirculator
+
+func ( cfg circulationConfig ) validate() error {
+	switch {
+	case cfg.MinutesPerHour < 1 || cfg.MinutesPerHour > 59:
+		return errors.New( "minutesPerHour is 1 to 59" )
+	case cfg.FanMode == "auto":
+		return errors.New( "fanMode must be a speed, low, med or high" )
+	case cfg.OutdoorMin > cfg.OutdoorMax:
+		return errors.New( "outdoorMin is above outdoorMax" )
+	}
+	if err := limits.check( nil, infinity.TStatZoneConfig{ FanMode: cfg.FanMode } ); err != nil {
+		return err
+	}
+	for _, hhmm := range []string{ cfg.QuietStart, cfg.QuietEnd } {
+		if _, err := parseClock( hhmm ); err != nil {
+			return fmt.Errorf( "quiet hours: %w", err )
+		}
+	}
+	return nil
+}	// validate
+
+// save writes the circulation file, call with c.mu held.
+func ( c *circulator ) save() {
+	data, err := json.MarshalIndent( c.cfg, "", "\t" )
+	if err == nil {
+		tmp := filepath.Join( filepath.Dir(c.file), ".circulation.tmp" )
+		if err = os.WriteFile( tmp, append(data, '\n'), 0644 ); err == nil {
+			err = os.Rename( tmp, c.file )
+		}
+	}
+	if err != nil {
+		controlLog.Error( "circulation - save failure: ", err )
+	}
+}	// save
+
+// quiet is true between quietStart and quietEnd, which may span midnight.
+func ( cfg circulationConfig ) quiet( t time.Time ) bool {
+	start, _ := parseClock( cfg.QuietStart )
+	end, _   := parseClock( cfg.QuietEnd )
+	now      := time.Duration( t.Hour() )*time.Hour + time.Duration( t.Minute() )*time.Minute
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}	// quiet
+
+func ( c *circulator ) setRunning( running string ) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cfg.Running != running {
+		c.cfg.Running = running
+		c.save()
+	}
+}	// setRunning
+
+// run checks every circulationTick whether to start or stop the fan.
+func ( c *circulator ) run( ctx context.Context ) {
+	for {
+		c.tick( time.Now() )
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After( circulationTick ):
+		}
+	}
+}	// run
+
+func ( c *circulator ) tick( now time.Time ) {
+	c.mu.Lock()
+	cfg := c.cfg
+	c.mu.Unlock()
+	tstat, ok := c.api.GetZoneConfig()
+	if !ok || tstat == nil {
+		return
+	}
+	by   := changeSource{ Source: "circulation" }
+	want := cfg.Enabled && now.Minute() < cfg.MinutesPerHour && !cfg.quiet( now ) &&
+		int(tstat.OutdoorTemp) >= cfg.OutdoorMin && int(tstat.OutdoorTemp) <= cfg.OutdoorMax
+
+	if cfg.Running != "" {
+		switch {
+		case tstat.FanMode != cfg.Running:
+			controlLog.Warn( "circulation - fan mode changed to " + tstat.FanMode + " by someone else, stopping" )
+			c.setRunning( "" )
+		case !want:
+			if err := changeZoneConfig( c.api, infinity.TStatZoneConfig{ FanMode: "auto" }, by ); err == nil {
+				c.setRunning( "" )
+			}
+		}
+		return
+	}
+	blower, _ := c.api.GetAirHandler()
+	if want && tstat.FanMode == "auto" && tstat.Stage == 0 && blower.BlowerRPM == 0 {
+		if err := changeZoneConfig( c.api, infinity.TStatZoneConfig{ FanMode: cfg.FanMode }, by ); err != nil {
+			controlLog.Error( "circulation - fan not started: ", err )
+			return
+		}
+		c.setRunning( cfg.FanMode )
+	}
+}	// tick
+
+// circulating is true when the blower is running for circulation only, for the CSV sample.
+func ( c *circulator ) circulating() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	running := c.cfg.Running
+	c.mu.Unlock()
+	if running == "" {
+		return false
+	}
+	tstat, ok := c.api.GetZoneConfig()
+	blower, _ := c.api.GetAirHandler()
+	return ok && tstat != nil && tstat.Stage == 0 && !blower.ElecHeat
+}	// circulating
+
+// fanSetting is the fan mode to remember for cfg, auto while circulation has the fan at its own speed,
+// so a revert doesn't leave the blower on after circulation ends.
+func ( c *circulator ) fanSetting( cfg *infinity.TStatZoneConfig ) string {
+	if c == nil {
+		return cfg.FanMode
+	}
+	c.mu.Lock()
+	running := c.cfg.Running
+	c.mu.Unlock()
+	if running != "" && cfg.FanMode == running {
+		return "auto"
+	}
+	return cfg.FanMode
+}	// fanSetting
+
+// mountCirculationAPI adds the circulation handlers to mux.
+func mountCirculationAPI( mux *http.ServeMux, c *circulator ) {
+	mux.HandleFunc( "GET /api/circulation", func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		cfg := c.cfg
+		c.mu.Unlock()
+		writeJSON( w, http.StatusOK, cfg )
+	} )
+
+	mux.HandleFunc( "PUT /api/circulation", func(w http.ResponseWriter, r *http.Request) {
+		var cfg circulationConfig
+		if err := json.NewDecoder( r.Body ).Decode( &cfg ); err != nil {
+			writeError( w, http.StatusBadRequest, "invalid circulation: " + err.Error() )
+			return
+		}
+		if err := cfg.validate(); err != nil {
+			writeError( w, http.StatusUnprocessableEntity, err.Error() )
+			return
+		}
+		c.mu.Lock()
+		cfg.Running = c.cfg.Running					// Not the client's to set
+		c.cfg = cfg
+		c.save()
+		c.mu.Unlock()
+		go c.tick( time.Now() )
+		writeJSON( w, http.StatusOK, cfg )
+	} )
+}	// mountCirculationAPI
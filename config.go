@@ -0,0 +1,397 @@
+package main
+	// Settings that used to be Go variables, read from a YAML file so a change needs no rebuild for ARM.
+	// The file is /var/lib/infinitive/infinitive.yaml or -config, a missing default file means the built-in defaults.
+	// Command line flags override the file, the same flags as before plus -config.
+	// SIGHUP or POST /api/config/reload read the file again, spikes, retention and logs take effect at once,
+	// paths, serial, web, limits, cron and store need a restart and are listed as such. GET /api/config shows what runs.
+	//		paths:
+	//		  data: /var/lib/infinitive/
+	//		  logs: /var/log/infinitive/
+	//		serial: /dev/ttyUSB0
+	//		web: { listen: ":8080", compatListen: ":8081", auth: auto }
+	//		cron: { sample: "0 */4 * * * *", chart: "2 0 */1 * * *", final: "20 0 0 * * *", index: "3 2 0 * * *" }
+	//		spikes: { outdoorMax: 125, outdoorDropout: 10, indoorMin: 32, indoorMax: 115 }
+	//		retention: { archiveMonths: 0, pruneMonths: 0 }
+	//		store: { backend: csv, file: "" }
+	//		logs: { level: "info,charts=debug", format: logfmt, maxMB: 10, maxDays: 7, keepDays: 60 }
+	// See infinitive.example.yaml for all of them.
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+var configFileName	= "infinitive.yaml"
+
+// Everything in the config file
+type config struct {
+	Paths			configPaths		`yaml:"paths" json:"paths"`
+	Serial			string			`yaml:"serial" json:"serial"`
+	Web				webOptions		`yaml:"web" json:"web"`
+	Limits			string			`yaml:"limits" json:"limits"`			// Default paths.data + limitsFileName
+	Cron			configCron		`yaml:"cron" json:"cron"`
+	Spikes			configSpikes	`yaml:"spikes" json:"spikes"`
+	Retention		configRetention	`yaml:"retention" json:"retention"`
+	Store			configStore		`yaml:"store" json:"store"`
+	Logs			configLogs		`yaml:"logs" json:"logs"`
+}
+
+// Folders and file names, homeDocs and photos are in data
+type configPaths struct {
+	Data			string			`yaml:"data" json:"data"`
+	Logs			string			`yaml:"logs" json:"logs"`
+	HomeDocs		string			`yaml:"homeDocs" json:"homeDocs"`
+	Photos			string			`yaml:"photos" json:"photos"`
+	ChartSuffix		string			`yaml:"chartSuffix" json:"chartSuffix"`
+}
+
+// Cron schedules with seconds, sample must run at midnight to start the new daily file
+type configCron struct {
+	Sample			string			`yaml:"sample" json:"sample"`
+	Chart			string			`yaml:"chart" json:"chart"`
+	Final			string			`yaml:"final" json:"final"`			// Yesterday's whole day chart
+	Index			string			`yaml:"index" json:"index"`
+}
+
+// Bad readings replaced by the previous one, see writeSample in main
+type configSpikes struct {
+	OutdoorMax		int				`yaml:"outdoorMax" json:"outdoorMax"`
+	OutdoorDropout	int				`yaml:"outdoorDropout" json:"outdoorDropout"`	// 0 or 1 outdoor after this is a dropout
+	IndoorMin		int				`yaml:"indoorMin" json:"indoorMin"`
+	IndoorMax		int				`yaml:"indoorMax" json:"indoorMax"`
+}
+
+// Month folders archived and pruned, see archive.go, 0 is never
+type configRetention struct {
+	ArchiveMonths	int				`yaml:"archiveMonths" json:"archiveMonths"`
+	PruneMonths		int				`yaml:"pruneMonths" json:"pruneMonths"`			// Raw data deleted, summaries kept
+}
+
+// Where samples and events are kept, see store.go
+type configStore struct {
+	Backend			string			`yaml:"backend" json:"backend"`			// csv or bolt
+	File			string			`yaml:"file" json:"file"`				// Default paths.data + dbFileName
+}
+
+// Log levels, format and rotation, see logging.go and logfiles.go
+type configLogs struct {
+	Level			string			`yaml:"level" json:"level"`
+	Format			string			`yaml:"format" json:"format"`
+	MaxMB			int				`yaml:"maxMB" json:"maxMB"`
+	MaxDays			int				`yaml:"maxDays" json:"maxDays"`
+	KeepDays		int				`yaml:"keepDays" json:"keepDays"`
+}
+
+// The values that were Go variables and flag defaults
+func defaultConfig() config {
+	return config{
+		Paths:	configPaths{ Data: "/var/lib/infinitive/", Logs: "/var/log/infinitive/", HomeDocs: "HomeDocs/", Photos: "Photos/",
+					ChartSuffix: "_Infinitive.html" },
+		Web:	webOptions{ Listen: ":8080", CompatListen: ":8081", Content: contentNames, Auth: "auto", AnonCharts: true },
+		Cron:	configCron{ Sample: "0 */4 * * * *", Chart: "2 0 */1 * * *", Final: "20 0 0 * * *", Index: "3 2 0 * * *" },
+		Spikes:	configSpikes{ OutdoorMax: 125, OutdoorDropout: 10, IndoorMin: 32, IndoorMax: 115 },
+		Retention:	configRetention{ ArchiveMonths: 0 },		// Off until set, archiving moves day files
+		Store:	configStore{ Backend: "csv" },
+		Logs:	configLogs{ Level: "info", Format: "logfmt", MaxMB: 10, MaxDays: 7, KeepDays: 60 },
+	}
+}
+
+// The running config, structural parts as at startup
+var (
+	configMu		sync.RWMutex
+	running			= defaultConfig()
+	configFile		string
+	configArgs		[]string
+	configLoaded	time.Time
+	configRestart	[]string			// Changed in the file, waiting for a restart
+)
+
+func currentConfig() config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return running
+}	// currentConfig
+
+// configFlags binds the command line flags to c.
+func configFlags( c *config, fileName *string, httpPort *int ) *flag.FlagSet {
+	fs := flag.NewFlagSet( "infinitive", flag.ContinueOnError )
+	fs.StringVar( fileName, "config", *fileName, "YAML config file, the flags below override it" )
+	fs.IntVar( httpPort, "httpport", 8080, "HTTP port to listen on, when -listen is not given" )
+	fs.StringVar( &c.Serial, "serial", c.Serial, "path to serial port" )
+	fs.StringVar( &c.Web.Listen, "listen", c.Web.Listen, "address to listen on" )
+	fs.StringVar( &c.Web.CompatListen, "compatlisten", c.Web.CompatListen, "second plain http listener for old chart links, empty to disable" )
+	fs.StringVar( &c.Web.TLSCert, "tlscert", c.Web.TLSCert, "TLS certificate file for -listen" )
+	fs.StringVar( &c.Web.TLSKey, "tlskey", c.Web.TLSKey, "TLS key file for -listen" )
+	fs.StringVar( &c.Web.Content, "content", c.Web.Content, "content served under /charts/ and /docs/" )
+	fs.StringVar( &c.Web.Auth, "auth", c.Web.Auth, "sign in for the UI and API: auto (on once an account exists), on or off" )
+	fs.BoolVar( &c.Web.AnonCharts, "anoncharts", c.Web.AnonCharts, "charts and docs need no account" )
+	fs.StringVar( &c.Limits, "limits", c.Limits, "setpoint and mode limits file, default in the data folder" )
+	fs.IntVar( &c.Logs.MaxMB, "logmaxmb", c.Logs.MaxMB, "rotate a log file at this size in MB" )
+	fs.IntVar( &c.Logs.MaxDays, "logmaxdays", c.Logs.MaxDays, "rotate a log file at this age in days" )
+	fs.IntVar( &c.Logs.KeepDays, "logkeepdays", c.Logs.KeepDays, "remove rotated log files after this many days" )
+	fs.StringVar( &c.Logs.Level, "loglevel", c.Logs.Level, "log level for all components, then component=level, e.g. info,charts=debug" )
+	fs.StringVar( &c.Logs.Format, "logformat", c.Logs.Format, "log format: logfmt, text or json" )
+	return fs
+}	// configFlags
+
+// readConfig reads the config file over the defaults, then the command line over that.
+func readConfig( args []string ) ( config, string, error ) {
+	// First pass for -config and to report bad flags, the second sets the flags over the file
+	fileName := defaultConfig().Paths.Data + configFileName
+	scratch, httpPort := defaultConfig(), 0
+	fs := configFlags( &scratch, &fileName, &httpPort )
+	if err := fs.Parse( args ); err != nil {
+		return scratch, fileName, err
+	}
+	named := map[string]bool{}
+	fs.Visit( func(f *flag.Flag) { named[f.Name] = true } )
+
+	c := defaultConfig()
+	if err := loadConfigFile( fileName, &c, named["config"] ); err != nil {
+		return c, fileName, err
+	}
+	fs = configFlags( &c, &fileName, &httpPort )
+	fs.SetOutput( io.Discard )
+	fs.Parse( args )
+	if named["httpport"] && !named["listen"] {
+		c.Web.Listen = fmt.Sprintf( ":%d", httpPort )
+	}
+	c.normalize()
+	return c, fileName, c.validate()
+}	// readConfig
+
+// loadConfigFile decodes fileName into c, unknown keys are errors so a typo is not silently ignored.
+func loadConfigFile( fileName string, c *config, required bool ) error {
+	data, err := os.ReadFile( fileName )
+	if errors.Is( err, os.ErrNotExist ) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder( bytes.NewReader(data) )
+	decoder.KnownFields( true )
+	if err = decoder.Decode( c ); err != nil && !errors.Is( err, io.EOF ) {
+		return fmt.Errorf( "%s: %w", fileName, err )
+	}
+	return nil
+}	// loadConfigFile
+
+// normalize adds the trailing slash the folder variables have always had.
+func ( c *config ) normalize() {
+	for _, p := range []*string{ &c.Paths.Data, &c.Paths.Logs, &c.Paths.HomeDocs, &c.Paths.Photos } {
+		if *p != "" && !strings.HasSuffix( *p, "/" ) {
+			*p += "/"
+		}
+	}
+	if c.Limits == "" {
+		c.Limits = c.Paths.Data + limitsFileName
+	}
+}	// normalize
+
+var cronParser = cron.NewParser( cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor )
+
+// validate returns every problem at once, each with the key it is about.
+func ( c config ) validate() error {
+	var errs []error
+	bad := func( key string, format string, a ...any ) {
+		errs = append( errs, fmt.Errorf( key + ": " + format, a... ) )
+	}
+
+	if !filepath.IsAbs( c.Paths.Data ) {
+		bad( "paths.data", "%q is not an absolute path", c.Paths.Data )
+	}
+	if !filepath.IsAbs( c.Paths.Logs ) {
+		bad( "paths.logs", "%q is not an absolute path", c.Paths.Logs )
+	}
+	for key, p := range map[string]string{ "paths.homeDocs": c.Paths.HomeDocs, "paths.photos": c.Paths.Photos } {
+		if p == "" || filepath.IsAbs( p ) || strings.Contains( p, ".." ) {
+			bad( key, "%q must be a folder name inside paths.data", p )
+		}
+	}
+	if !strings.HasSuffix( c.Paths.ChartSuffix, ".html" ) {
+		bad( "paths.chartSuffix", "%q must end in .html", c.Paths.ChartSuffix )
+	}
+	if c.Serial == "" {
+		bad( "serial", "the serial port is needed, serial: in the config file or -serial" )
+	}
+
+	if _, _, err := net.SplitHostPort( c.Web.Listen ); err != nil {
+		bad( "web.listen", "%v", err )
+	}
+	if c.Web.CompatListen != "" {
+		if _, _, err := net.SplitHostPort( c.Web.CompatListen ); err != nil {
+			bad( "web.compatListen", "%v", err )
+		}
+	}
+	if ( c.Web.TLSCert == "" ) != ( c.Web.TLSKey == "" ) {
+		bad( "web.tlsCert", "tlsCert and tlsKey go together" )
+	}
+	for key, f := range map[string]string{ "web.tlsCert": c.Web.TLSCert, "web.tlsKey": c.Web.TLSKey } {
+		if _, err := os.Stat( f ); f != "" && err != nil {
+			bad( key, "%v", err )
+		}
+	}
+	if c.Web.Auth != "auto" && c.Web.Auth != "on" && c.Web.Auth != "off" {
+		bad( "web.auth", "%q is not auto, on or off", c.Web.Auth )
+	}
+	if c.Web.Content == "" {
+		bad( "web.content", "nothing to serve" )
+	}
+
+	for key, spec := range map[string]string{ "cron.sample": c.Cron.Sample, "cron.chart": c.Cron.Chart, "cron.final": c.Cron.Final, "cron.index": c.Cron.Index } {
+		schedule, err := cronParser.Parse( spec )
+		if err != nil {
+			bad( key, "%q: %v", spec, err )
+			continue
+		}
+		beforeMidnight := time.Date( 2024, 1, 1, 23, 59, 0, 0, time.Local )
+		if key == "cron.sample" && !schedule.Next( beforeMidnight ).Equal( beforeMidnight.Add(time.Minute) ) {
+			bad( key, "%q must run at 00:00:00 to start the new daily file", spec )
+		}
+	}
+
+	if c.Spikes.IndoorMin >= c.Spikes.IndoorMax {
+		bad( "spikes.indoorMin", "%d is not below indoorMax %d", c.Spikes.IndoorMin, c.Spikes.IndoorMax )
+	}
+	if c.Spikes.OutdoorDropout >= c.Spikes.OutdoorMax {
+		bad( "spikes.outdoorDropout", "%d is not below outdoorMax %d", c.Spikes.OutdoorDropout, c.Spikes.OutdoorMax )
+	}
+
+	// The final chart job can still write last month's folder
+	if r := c.Retention; r.ArchiveMonths != 0 && r.ArchiveMonths < 2 {
+		bad( "retention.archiveMonths", "%d must be 0 or 2 or more", r.ArchiveMonths )
+	}
+	if r := c.Retention; r.PruneMonths < 0 || r.PruneMonths > 0 && ( r.ArchiveMonths == 0 || r.PruneMonths <= r.ArchiveMonths ) {
+		bad( "retention.pruneMonths", "%d must be 0 or more than archiveMonths %d", r.PruneMonths, r.ArchiveMonths )
+	}
+
+	if c.Store.Backend != "csv" && c.Store.Backend != "bolt" {
+		bad( "store.backend", "%q is not csv or bolt", c.Store.Backend )
+	}
+
+	if _, err := parseLogLevels( c.Logs.Level ); err != nil {
+		bad( "logs.level", "%v", err )
+	}
+	if c.Logs.Format != "logfmt" && c.Logs.Format != "text" && c.Logs.Format != "json" {
+		bad( "logs.format", "%q is not logfmt, text or json", c.Logs.Format )
+	}
+	for key, n := range map[string]int{ "logs.maxMB": c.Logs.MaxMB, "logs.maxDays": c.Logs.MaxDays, "logs.keepDays": c.Logs.KeepDays } {
+		if n < 1 {
+			bad( key, "%d must be 1 or more", n )
+		}
+	}
+	return errors.Join( errs... )
+}	// validate
+
+// startConfig reads the config at startup and sets the variables the rest of Infinitive uses.
+func startConfig( args []string ) ( config, error ) {
+	c, fileName, err := readConfig( args )
+	if err != nil {
+		return c, err
+	}
+	filePath, logPath		= c.Paths.Data, c.Paths.Logs
+	homeDocsFldr			= c.Paths.HomeDocs
+	homePhotosFldr			= c.Paths.Photos
+	chartFileSuffix			= c.Paths.ChartSuffix
+	configMu.Lock()
+	running, configFile, configArgs, configLoaded = c, fileName, args, time.Now()
+	configMu.Unlock()
+	return c, nil
+}	// startConfig
+
+// reloadConfig reads the file again, applies spikes, retention and logs, and lists what waits for a restart.
+func reloadConfig() error {
+	configMu.RLock()
+	args := configArgs
+	configMu.RUnlock()
+	c, _, err := readConfig( args )
+	if err != nil {
+		controlLog.Error( "config - reload failed, keeping the running config: ", err )
+		return err
+	}
+	if err = setLogLevels( c.Logs.Level, c.Logs.Format ); err != nil {
+		return err
+	}
+	configMu.Lock()
+	var restart []string
+	for key, same := range map[string]bool{ "paths": c.Paths == running.Paths, "serial": c.Serial == running.Serial,
+		"web": c.Web == running.Web, "limits": c.Limits == running.Limits, "cron": c.Cron == running.Cron,
+		"store": c.Store == running.Store } {
+		if !same {
+			restart = append( restart, key )
+		}
+	}
+	sort.Strings( restart )
+	running.Spikes, running.Retention, running.Logs = c.Spikes, c.Retention, c.Logs
+	configRestart, configLoaded = restart, time.Now()
+	configMu.Unlock()
+	controlLog.WithField( "restart", restart ).Info( "config - reloaded" )
+	return nil
+}	// reloadConfig
+
+// configUserPaths sets filePath from the config file, for the user, restore, rollups and migrate subcommands.
+// A -config FILE anywhere in args names the file as for the service, the rest of args are returned for the subcommand.
+func configUserPaths( args []string ) ( config, []string, error ) {
+	c := defaultConfig()
+	fileName, named := c.Paths.Data + configFileName, false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut( strings.TrimLeft(args[i], "-"), "=" )
+		if !strings.HasPrefix( args[i], "-" ) || name != "config" {
+			rest = append( rest, args[i] )
+			continue
+		}
+		if !hasValue {
+			if i++; i == len(args) {
+				return c, rest, errors.New( "-config needs a file name" )
+			}
+			value = args[i]
+		}
+		fileName, named = value, true
+	}
+	if err := loadConfigFile( fileName, &c, named ); err != nil {
+		return c, rest, err
+	}
+	c.normalize()
+	filePath, configFile = c.Paths.Data, fileName
+	return c, rest, nil
+}	// configUserPaths
+
+// Read only, reload takes control like any other POST
+func mountConfigAPI( mux *http.ServeMux ) {
+	reply := func() any {
+		configMu.RLock()
+		defer configMu.RUnlock()
+		return struct {
+			File			string		`json:"file"`
+			Loaded			time.Time	`json:"loaded"`
+			Config			config		`json:"config"`
+			RestartNeeded	[]string	`json:"restartNeeded"`
+		}{ configFile, configLoaded, running, configRestart }
+	}
+	mux.HandleFunc( "GET /api/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON( w, http.StatusOK, reply() )
+	} )
+	mux.HandleFunc( "POST /api/config/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := reloadConfig(); err != nil {
+			writeError( w, http.StatusUnprocessableEntity, err.Error() )
+			return
+		}
+		writeJSON( w, http.StatusOK, reply() )
+	} )
+}	// mountConfigAPI
@@ -0,0 +1,161 @@
+package main
+	// Thermostat control API, mounted at /api by the router in server.go:
+	//		GET  /api/zone/1/config			thermostat zone config (infinity.TStatZoneConfig)
+	//		PUT  /api/zone/1/config			change mode, fanMode, hold, heatSetpoint, coolSetpoint; omitted fields are unchanged
+	//										422 when outside the limits, see limits.go
+	//		GET  /api/limits				setpoint bounds, deadband, allowed modes and fan modes
+	//		GET  /api/audit?days=7			audit log of changes, newest first, see audit.go
+	//		GET  /api/zone/1/airhandler		blower RPM, air flow
+	//		GET  /api/zone/1/heatpump		coil and outside temps, stage
+	//		GET  /api/ws					websocket of {source, data} updates for the UI, only from a page of this host
+	// Same requests and replies as the acd/infinitive webserver it replaces, app.js is unchanged.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+	"golang.org/x/net/websocket"
+)
+
+// writeJSON replies with v as JSON and the status code.
+func writeJSON( w http.ResponseWriter, status int, v interface{} ) {
+	w.Header().Set( "Content-Type", "application/json; charset=utf-8" )
+	w.WriteHeader( status )
+	if err := json.NewEncoder( w ).Encode( v ); err != nil {
+		apiLog.Error( "writeJSON - encode failure: ", err )
+	}
+}	// writeJSON
+
+// writeError replies with {"error": msg}, the UI shows msg.
+func writeError( w http.ResponseWriter, status int, msg string ) {
+	writeJSON( w, status, map[string]string{ "error": msg } )
+}	// writeError
+
+// writeChangeError: 422 for a change outside the limits, 502 when the thermostat did not take it.
+func writeChangeError( w http.ResponseWriter, err error ) {
+	var le *limitError
+	if errors.As( err, &le ) {
+		writeError( w, http.StatusUnprocessableEntity, le.Error() )
+		return
+	}
+	writeError( w, http.StatusBadGateway, err.Error() )
+}	// writeChangeError
+
+// mountControlAPI adds the thermostat handlers to mux.
+func mountControlAPI( mux *http.ServeMux, api *infinity.Api ) {
+	mux.HandleFunc( "GET /api/zone/1/config", func(w http.ResponseWriter, r *http.Request) {
+		cfg, ok := api.GetZoneConfig()
+		if !ok {
+			if cfg, ok = api.GetConfig( 1 ); !ok {
+				writeError( w, http.StatusServiceUnavailable, "thermostat config not available" )
+				return
+			}
+		}
+		writeJSON( w, http.StatusOK, cfg )
+	} )
+
+	mux.HandleFunc( "PUT /api/zone/1/config", func(w http.ResponseWriter, r *http.Request) {
+		var args infinity.TStatZoneConfig
+		if err := json.NewDecoder( r.Body ).Decode( &args ); err != nil {
+			writeError( w, http.StatusBadRequest, "invalid config: " + err.Error() )
+			return
+		}
+		if err := changeZoneConfig( api, args, requestSource(r) ); err != nil {
+			writeChangeError( w, err )
+			return
+		}
+		writeJSON( w, http.StatusOK, args )
+	} )
+
+	mux.HandleFunc( "GET /api/limits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON( w, http.StatusOK, limits )
+	} )
+
+	mux.HandleFunc( "GET /api/audit", auditHandler )
+
+	mux.HandleFunc( "GET /api/zone/1/airhandler", func(w http.ResponseWriter, r *http.Request) {
+		if b, ok := api.GetAirHandler(); ok {
+			writeJSON( w, http.StatusOK, b )
+			return
+		}
+		writeError( w, http.StatusServiceUnavailable, "air handler not available" )
+	} )
+
+	mux.HandleFunc( "GET /api/zone/1/heatpump", func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := api.GetHeatPump(); ok {
+			writeJSON( w, http.StatusOK, h )
+			return
+		}
+		writeError( w, http.StatusServiceUnavailable, "heat pump not available" )
+	} )
+
+	mux.Handle( "GET /api/ws", websocket.Server{ Handshake: sameOrigin, Handler: func(ws *websocket.Conn) {
+		streamUpdates( ws, api )
+	} } )
+}	// mountControlAPI
+
+// sameOrigin refuses a websocket opened by a page from another site, the session cookie would go along with it.
+func sameOrigin( config *websocket.Config, r *http.Request ) error {
+	origin, err := websocket.Origin( config, r )
+	if err != nil {
+		return err
+	}
+	if origin == nil || !strings.EqualFold( origin.Host, r.Host ) {
+		apiLog.Warn( "websocket - origin refused: ", r.Header.Get("Origin") )
+		return errors.New( "websocket origin is not this host" )
+	}
+	config.Origin = origin
+	return nil
+}	// sameOrigin
+
+// One websocket message, source matches what app.js expects
+type wsMessage struct {
+	Source			string		`json:"source"`
+	Data			interface{}	`json:"data"`
+}
+
+// streamUpdates sends the cached tstat, blower and heatpump state whenever it changes, until the client goes away.
+func streamUpdates( ws *websocket.Conn, api *infinity.Api ) {
+	defer ws.Close()
+	closed := make( chan struct{} )
+	go func() {									// The UI never sends, a read returns when it goes away
+		io.Copy( io.Discard, ws )
+		close( closed )
+	}()
+	last   := make( map[string][]byte )
+	ticker := time.NewTicker( time.Second )
+	defer ticker.Stop()
+	for {
+		current := map[string]interface{}{}
+		if c, ok := api.GetZoneConfig(); ok {
+			current["tstat"] = c
+		}
+		if b, ok := api.GetAirHandler(); ok {
+			current["blower"] = b
+		}
+		if h, ok := api.GetHeatPump(); ok {
+			current["heatpump"] = h
+		}
+		for source, data := range current {
+			msg, err := json.Marshal( wsMessage{ Source: source, Data: data } )
+			if err != nil || bytes.Equal( msg, last[source] ) {
+				continue
+			}
+			if _, err = ws.Write( msg ); err != nil {
+				return
+			}
+			last[source] = msg
+		}
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+	}
+}	// streamUpdates
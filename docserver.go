@@ -0,0 +1,262 @@
+package main
+	// Static content server for /charts/, /docs/ and the old /infinitive/ path.
+	// Only whitelisted content under filePath is served, never the binary, logs or anything else in the folder:
+	//		charts		index.html, Year*.html, YYYY-MM/*.html
+	//		csv			YYYY-MM/*.csv, the daily data files
+	//		homedocs	everything in HomeDocs/
+	//		photos		everything in Photos/
+	// -content picks which of these are served. There is no directory listing, a folder serves its index.html or 404.
+	// Dotfiles are never served. Symlinks are followed only when the target is inside one of the enabled roots,
+	// HomeDocs and Photos may themselves be symlinks, their targets count as the root.
+	// Responses get Last-Modified, an ETag and Cache-Control, text content is gzipped when the client takes it.
+	// A day chart or CSV no longer on disk is served from its month's archive, see archive.go.
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// One servable folder and the files in it that may be served
+type contentRoot struct {
+	Name		string						// -content name
+	Dir			string
+	Allow		*regexp.Regexp				// Path relative to Dir, nil allows everything
+}
+
+var chartsAllow	= regexp.MustCompile( `^(index\.html|` + regexp.QuoteMeta(yearFileString) + `[^/]*\.html|\d{4}-\d{2}/[^/]+\.html)$` )
+var csvAllow	= regexp.MustCompile( `^\d{4}-\d{2}/[^/]+\.csv$` )
+
+var contentNames	= "charts,csv,homedocs,photos"		// -content default
+var gzipTypes		= []string{ "text/", "application/javascript", "application/json", "image/svg+xml" }
+
+// The content server, chart and CSV roots share filePath and differ by pattern
+type contentServer struct {
+	data		[]contentRoot				// Roots in filePath itself
+	docs		map[string]contentRoot		// Keyed by folder name, HomeDocs and Photos
+}
+
+// newContentServer enables the named roots, names is a comma list from -content.
+func newContentServer( names string ) ( *contentServer, error ) {
+	cs := &contentServer{ docs: make(map[string]contentRoot) }
+	for _, name := range strings.Split( names, "," ) {
+		switch strings.TrimSpace( strings.ToLower(name) ) {
+		case "charts":
+			cs.data = append( cs.data, contentRoot{ Name: "charts", Dir: filePath, Allow: chartsAllow } )
+		case "csv":
+			cs.data = append( cs.data, contentRoot{ Name: "csv", Dir: filePath, Allow: csvAllow } )
+		case "homedocs":
+			cs.docs[strings.TrimSuffix(homeDocsFldr, "/")] = contentRoot{ Name: "homedocs", Dir: filePath + homeDocsFldr }
+		case "photos":
+			cs.docs[strings.TrimSuffix(homePhotosFldr, "/")] = contentRoot{ Name: "photos", Dir: filePath + homePhotosFldr }
+		case "":
+		default:
+			return nil, fmt.Errorf( "unknown -content root %q, use %s", name, contentNames )
+		}
+	}
+	return cs, nil
+}	// newContentServer
+
+// chartsHandler serves filePath content, docsHandler the HomeDocs and Photos folders, legacyHandler both.
+func ( cs *contentServer ) chartsHandler( prefix string ) http.Handler {
+	return http.HandlerFunc( func(w http.ResponseWriter, r *http.Request) {
+		cs.serveData( w, r, strings.TrimPrefix(r.URL.Path, prefix) )
+	} )
+}	// chartsHandler
+
+func ( cs *contentServer ) docsHandler( prefix string ) http.Handler {
+	return http.HandlerFunc( func(w http.ResponseWriter, r *http.Request) {
+		cs.serveDocs( w, r, strings.TrimPrefix(r.URL.Path, prefix) )
+	} )
+}	// docsHandler
+
+func ( cs *contentServer ) legacyHandler( prefix string ) http.Handler {
+	return http.HandlerFunc( func(w http.ResponseWriter, r *http.Request) {
+		rel   := strings.TrimPrefix( r.URL.Path, prefix )
+		first := strings.SplitN( rel, "/", 2 )[0]
+		if _, ok := cs.docs[first]; ok || first+"/" == homeDocsFldr || first+"/" == homePhotosFldr {
+			cs.serveDocs( w, r, rel )
+			return
+		}
+		cs.serveData( w, r, rel )
+	} )
+}	// legacyHandler
+
+// cleanRel cleans the request path, false for dotfiles and dot folders anywhere in it.
+func cleanRel( rel string ) ( string, bool ) {
+	dir := rel == "" || strings.HasSuffix( rel, "/" )
+	rel  = strings.TrimPrefix( path.Clean("/"+rel), "/" )
+	for _, elem := range strings.Split( rel, "/" ) {
+		if strings.HasPrefix( elem, "." ) {
+			return "", false
+		}
+	}
+	if dir {
+		rel = path.Join( rel, linksFile )		// A folder is its index.html, never a listing
+	}
+	return rel, true
+}	// cleanRel
+
+func ( cs *contentServer ) serveData( w http.ResponseWriter, r *http.Request, rel string ) {
+	rel, ok := cleanRel( rel )
+	if !ok {
+		http.NotFound( w, r )
+		return
+	}
+	for _, root := range cs.data {
+		if root.Allow.MatchString( rel ) {
+			name := filepath.Join( root.Dir, filepath.FromSlash(rel) )
+			if _, err := os.Lstat( name ); errors.Is( err, os.ErrNotExist ) && serveArchived( w, r, name ) {
+				return
+			}
+			cs.serveFile( w, r, root, rel )
+			return
+		}
+	}
+	http.NotFound( w, r )
+}	// serveData
+
+func ( cs *contentServer ) serveDocs( w http.ResponseWriter, r *http.Request, rel string ) {
+	rel, ok := cleanRel( rel )
+	if !ok {
+		http.NotFound( w, r )
+		return
+	}
+	parts := strings.SplitN( rel, "/", 2 )
+	root, ok := cs.docs[parts[0]]
+	if !ok || len(parts) < 2 {
+		http.NotFound( w, r )
+		return
+	}
+	cs.serveFile( w, r, root, parts[1] )
+}	// serveDocs
+
+// insideRoots reports if the resolved path is in one of the enabled roots, with the roots' symlinks resolved too.
+func ( cs *contentServer ) insideRoots( resolved string ) bool {
+	roots := make( []contentRoot, 0, len(cs.data)+len(cs.docs) )
+	roots  = append( roots, cs.data... )
+	for _, root := range cs.docs {
+		roots = append( roots, root )
+	}
+	for _, root := range roots {
+		dir, err := filepath.EvalSymlinks( root.Dir )
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel( dir, resolved ); err == nil && rel != ".." && !strings.HasPrefix( rel, "../" ) {
+			if root.Allow == nil || root.Allow.MatchString( filepath.ToSlash(rel) ) {
+				return true
+			}
+		}
+	}
+	return false
+}	// insideRoots
+
+// serveFile sends one regular file with cache headers, gzipped when that helps.
+func ( cs *contentServer ) serveFile( w http.ResponseWriter, r *http.Request, root contentRoot, rel string ) {
+	resolved, err := filepath.EvalSymlinks( filepath.Join(root.Dir, filepath.FromSlash(rel)) )
+	if err != nil || !cs.insideRoots( resolved ) {
+		http.NotFound( w, r )
+		return
+	}
+	f, err := os.Open( resolved )
+	if err != nil {
+		http.NotFound( w, r )
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound( w, r )
+		return
+	}
+
+	ctype := mime.TypeByExtension( filepath.Ext(resolved) )
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	etag := fmt.Sprintf( "\"%x-%x\"", info.ModTime().UnixNano(), info.Size() )
+	w.Header().Set( "Content-Type", ctype )
+	w.Header().Set( "Cache-Control", cacheControl(ctype) )
+	w.Header().Set( "X-Content-Type-Options", "nosniff" )
+
+	if !acceptsGzip( r ) || !compressible( ctype ) || r.Header.Get( "Range" ) != "" {
+		w.Header().Set( "ETag", etag )
+		http.ServeContent( w, r, "", info.ModTime(), f )		// Handles If-None-Match, If-Modified-Since and ranges
+		return
+	}
+	etag = strings.TrimSuffix( etag, "\"" ) + "-gz\""
+	w.Header().Set( "ETag", etag )
+	w.Header().Set( "Last-Modified", info.ModTime().UTC().Format(http.TimeFormat) )
+	w.Header().Add( "Vary", "Accept-Encoding" )
+	if etagMatch( r.Header.Get("If-None-Match"), etag ) {
+		w.WriteHeader( http.StatusNotModified )
+		return
+	}
+	w.Header().Set( "Content-Encoding", "gzip" )
+	if r.Method == http.MethodHead {
+		return
+	}
+	gz := gzip.NewWriter( w )
+	if _, err = io.Copy( gz, f ); err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		docsLog.Error( "contentServer - gzip write failure: " + rel + " ", err )
+	}
+}	// serveFile
+
+// cacheControl: pages and data are rewritten hourly and revalidate with the ETag, photos and documents rarely change.
+func cacheControl( ctype string ) string {
+	if strings.HasPrefix( ctype, "text/" ) {
+		return "no-cache"
+	}
+	return "public, max-age=86400"
+}	// cacheControl
+
+func compressible( ctype string ) bool {
+	for _, t := range gzipTypes {
+		if strings.HasPrefix( ctype, t ) {
+			return true
+		}
+	}
+	return false
+}	// compressible
+
+// acceptsGzip checks Accept-Encoding for gzip without q=0.
+func acceptsGzip( r *http.Request ) bool {
+	for _, enc := range strings.Split( r.Header.Get("Accept-Encoding"), "," ) {
+		params := strings.Split( enc, ";" )
+		if strings.TrimSpace( params[0] ) != "gzip" {
+			continue
+		}
+		for _, p := range params[1:] {
+			if q, ok := strings.CutPrefix( strings.TrimSpace(p), "q=" ); ok {
+				if v, err := strconv.ParseFloat( q, 64 ); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}	// acceptsGzip
+
+func etagMatch( header string, etag string ) bool {
+	for _, tag := range strings.Split( header, "," ) {
+		tag = strings.TrimPrefix( strings.TrimSpace(tag), "W/" )
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}	// etagMatch
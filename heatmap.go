@@ -0,0 +1,136 @@
+package main
+	// Year heatmaps built from the hourly rollups, see rollup.go:
+	//		YearHeatmap_YYYY.html	calendar of blower percent on per day
+	//		YearHours_YYYY.html		hour-of-day by day-of-year matrix of blower percent on
+	// Both names start with yearFileString so makeTableHTMLfiles lists them next to the Year_YYYY-MM.html chart.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+)
+
+var heatmapFileString	= yearFileString + "Heatmap"
+var hoursFileString		= yearFileString + "Hours"
+
+// Blower on counts for one day, overall and per hour of the day
+type dayUsage struct {
+	samples			int
+	on				int
+	hourSamples		[24]int
+	hourOn			[24]int
+}
+
+// usageForYear reads the hourly rollups of the year. Days without samples are left with zero samples.
+func usageForYear( year int ) ( days []dayUsage, found int ) {
+	first := time.Date( year, time.January, 1, 0, 0, 0, 0, time.Local )
+	days   = make( []dayUsage, time.Date(year, time.December, 31, 0, 0, 0, 0, time.Local).YearDay() )
+	hours, err := rollupRange( rollupHour, first, first.AddDate(1, 0, 0) )
+	if err != nil {
+		chartsLog.Error( "usageForYear - rollups read failure: ", err )
+	}
+	for _, r := range hours {
+		i, hour := r.Start.YearDay()-1, r.Start.Hour()
+		if days[i].samples == 0 {
+			found++
+		}
+		on := int( math.Round( (r.HeatHours + r.CoolHours) * 60 / sampleMinutes ) )
+		days[i].samples += r.Samples
+		days[i].on      += on
+		days[i].hourSamples[hour] += r.Samples
+		days[i].hourOn[hour]      += on
+	}
+	return days, found
+}	// usageForYear
+
+func percentOf( on int, samples int ) float64 {
+	return math.Round( 1000.0*float64(on)/float64(samples) ) / 10.0
+}	// percentOf
+
+// makeYearHeatmaps renders both heatmap files for the year.
+func makeYearHeatmaps( year int ) error {
+	days, found := usageForYear( year )
+	chartsLog.Info( "makeYearHeatmaps - Year: ", year, ", days found: ", found )
+	if found == 0 {
+		return nil
+	}
+	subtitle := fmt.Sprintf( "Infinitive Vsn: %s, #Found = %d, Date: %s", Version, found, time.Now().Format("2006-01-02") )
+	first    := time.Date( year, time.January, 1, 0, 0, 0, 0, time.Local )
+
+	// Calendar of percent on per day
+	calendar := make( []opts.HeatMapData, 0, len(days) )
+	for i, d := range days {
+		if d.samples == 0 {
+			continue
+		}
+		date := first.AddDate( 0, 0, i ).Format( "2006-01-02" )
+		calendar = append( calendar, opts.HeatMapData{ Value: [2]interface{}{ date, percentOf(d.on, d.samples) } } )
+	}
+	cal := charts.NewHeatMap()
+	cal.SetGlobalOptions(
+		charts.WithInitializationOpts( opts.Initialization{ Theme: types.ThemeWesteros, Width: "1200px", Height: "320px" } ),
+		charts.WithTitleOpts( opts.Title{ Title: "Infinitive HVAC Pcnt Blower On - " + strconv.Itoa(year), Subtitle: subtitle } ),
+		charts.WithTooltipOpts( opts.Tooltip{ Show: true } ),
+		charts.WithVisualMapOpts( opts.VisualMap{ Calculable: true, Min: 0, Max: 100, Orient: "horizontal", Left: "center", Top: "bottom" } ),
+	)
+	cal.AddCalendar( &opts.Calendar{ Orient: "horizontal", Range: []string{ strconv.Itoa(year) }, Top: "90", Left: "50", Right: "30", CellSize: "20" } )
+	cal.AddSeries( "Percent On", calendar, charts.WithCoordinateSystem("calendar") )
+	calendarErr := renderYearChart( fmt.Sprintf( "%s_%04d%s", heatmapFileString, year, htmlExt ), cal )
+
+	// Hour of day (Y) by day of year (X)
+	dayAxis  := make( []int, len(days) )
+	hourAxis := make( []string, 24 )
+	matrix   := make( []opts.HeatMapData, 0, len(days)*24 )
+	for h := range hourAxis {
+		hourAxis[h] = fmt.Sprintf( "%02d:00", h )
+	}
+	for i, d := range days {
+		dayAxis[i] = i + 1
+		for h := 0; h < 24; h++ {
+			if d.hourSamples[h] == 0 {
+				continue
+			}
+			matrix = append( matrix, opts.HeatMapData{ Value: [3]interface{}{ i, h, percentOf(d.hourOn[h], d.hourSamples[h]) } } )
+		}
+	}
+	hours := charts.NewHeatMap()
+	hours.SetGlobalOptions(
+		charts.WithInitializationOpts( opts.Initialization{ Theme: types.ThemeWesteros, Width: "1200px", Height: "600px" } ),
+		charts.WithTitleOpts( opts.Title{ Title: "Infinitive HVAC Pcnt Blower On by Hour - " + strconv.Itoa(year), Subtitle: subtitle } ),
+		charts.WithTooltipOpts( opts.Tooltip{ Show: true } ),
+		charts.WithXAxisOpts( opts.XAxis{ Name: "Year Day", Type: "category", SplitArea: &opts.SplitArea{ Show: true } } ),
+		charts.WithYAxisOpts( opts.YAxis{ Name: "Hour", Type: "category", Data: hourAxis, SplitArea: &opts.SplitArea{ Show: true } } ),
+		charts.WithVisualMapOpts( opts.VisualMap{ Calculable: true, Min: 0, Max: 100, Orient: "horizontal", Left: "center", Bottom: "0" } ),
+	)
+	hours.SetXAxis( dayAxis ).AddSeries( "Percent On", matrix )
+	return errors.Join( calendarErr, renderYearChart( fmt.Sprintf( "%s_%04d%s", hoursFileString, year, htmlExt ), hours ) )
+}	// makeYearHeatmaps
+
+// Any go-echarts chart
+type chartRenderer interface {
+	Render( w io.Writer ) error
+}
+
+// renderYearChart writes a chart file to the data root, as done for the Year_YYYY-MM.html chart.
+func renderYearChart( fileStr string, chart chartRenderer ) error {
+	fHTML, err := os.OpenFile( filePath + fileStr, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0664 )
+	if err != nil {
+		chartsLog.Error( "renderYearChart - Error writing html file: " + fileStr )
+		return err
+	}
+	chartsLog.Info( "renderYearChart - Render to html:  " + fileStr )
+	if err = chart.Render( io.MultiWriter(fHTML) ); err != nil {
+		chartsLog.Error( "renderYearChart - Render failed: " + fileStr + " ", err )
+	}
+	fHTML.Close()
+	os.Chmod( filePath + fileStr, 0664 )
+	return err
+}	// renderYearChart
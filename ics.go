@@ -0,0 +1,439 @@
+package main
+	// A small iCalendar (RFC 5545) reader for calendar.go, the VEVENTs only.
+	// DTSTART and DTEND or DURATION, in UTC (Z), with TZID, floating, or all day (VALUE=DATE). TZID must be an IANA name
+	// like America/New_York, others are read as local time with a warning, the VTIMEZONE blocks are not used.
+	// RRULE with FREQ DAILY, WEEKLY, MONTHLY or YEARLY, INTERVAL, COUNT and UNTIL. BYDAY for DAILY, WEEKLY and MONTHLY,
+	// BYMONTHDAY for MONTHLY, any other use of them keeps only the first date with a warning. EXDATE and
+	// RECURRENCE-ID for moved or cancelled instances. Occurrences step in the event's own time zone, so a 7:00 event
+	// stays at 7:00 across daylight saving changes.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// One VEVENT
+type icsEvent struct {
+	UID				string
+	Summary			string
+	Start			time.Time
+	End				time.Time
+	AllDay			bool
+	RRule			map[string]string
+	ExDates			[]time.Time
+	RecurrenceID	*time.Time
+	Cancelled		bool
+}
+
+// One occurrence of an event
+type icsOccurrence struct {
+	UID				string
+	Summary			string
+	Start			time.Time
+	End				time.Time
+}
+
+var icsWeekdays = map[string]time.Weekday{ "SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday }
+
+// parseICS reads the events of a calendar, warnings are about things read less than exactly.
+func parseICS( r io.Reader ) ( events []icsEvent, warnings []string, err error ) {
+	var lines []string
+	var e *icsEvent
+
+	scanner := bufio.NewScanner( r )
+	scanner.Buffer( make([]byte, 64*1024), 1024*1024 )
+	for scanner.Scan() {
+		line := strings.TrimRight( scanner.Text(), "\r" )
+		if len(line) > 0 && ( line[0] == ' ' || line[0] == '\t' ) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]				// Folded line
+			continue
+		}
+		lines = append( lines, line )
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold( lines[0], "BEGIN:VCALENDAR" ) {
+		return nil, nil, fmt.Errorf( "not an iCalendar file" )
+	}
+	for n, line := range lines {
+		name, params, value := icsProperty( line )
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			e = &icsEvent{}
+			continue
+		case name == "END" && value == "VEVENT" && e != nil:
+			switch {
+			case e.Start.IsZero():
+				warnings = append( warnings, fmt.Sprintf( "line %d: event %q has no DTSTART, ignored", n+1, e.Summary ) )
+			default:
+				if e.End.IsZero() {
+					e.End = e.Start
+					if e.AllDay {
+						e.End = e.Start.AddDate( 0, 0, 1 )
+					}
+				}
+				events = append( events, *e )
+			}
+			e = nil
+			continue
+		case e == nil:
+			continue
+		}
+		var t time.Time
+		var allDay bool
+		var warn string
+		switch name {
+		case "UID":
+			e.UID = value
+		case "SUMMARY":
+			e.Summary = icsText( value )
+		case "STATUS":
+			e.Cancelled = strings.EqualFold( value, "CANCELLED" )
+		case "DTSTART":
+			t, allDay, warn, err = icsTime( value, params )
+			e.Start, e.AllDay = t, allDay
+		case "DTEND":
+			t, _, warn, err = icsTime( value, params )
+			e.End = t
+		case "DURATION":
+			var d time.Duration
+			if d, err = icsDuration( value ); err == nil && !e.Start.IsZero() {
+				e.End = e.Start.Add( d )
+			}
+		case "RRULE":
+			e.RRule = make( map[string]string )
+			for _, part := range strings.Split( value, ";" ) {
+				if k, v, ok := strings.Cut( part, "=" ); ok {
+					e.RRule[strings.ToUpper(k)] = v
+				}
+			}
+		case "EXDATE":
+			for _, v := range strings.Split( value, "," ) {
+				if t, _, warn, err = icsTime( v, params ); err == nil {
+					e.ExDates = append( e.ExDates, t )
+				}
+			}
+		case "RECURRENCE-ID":
+			if t, _, warn, err = icsTime( value, params ); err == nil {
+				e.RecurrenceID = &t
+			}
+		}
+		if warn != "" {
+			warnings = append( warnings, fmt.Sprintf( "line %d: %s", n+1, warn ) )
+		}
+		if err != nil {
+			warnings = append( warnings, fmt.Sprintf( "line %d: %s ignored, %v", n+1, name, err ) )
+			err = nil
+		}
+	}
+	return events, warnings, nil
+}	// parseICS
+
+// icsProperty splits NAME;PARAM=x;PARAM="y:z":VALUE
+func icsProperty( line string ) ( name string, params map[string]string, value string ) {
+	quoted, colon := false, -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, ""
+	}
+	value  = line[colon+1:]
+	parts := strings.Split( line[:colon], ";" )
+	name   = strings.ToUpper( parts[0] )
+	params = make( map[string]string )
+	for _, p := range parts[1:] {
+		if k, v, ok := strings.Cut( p, "=" ); ok {
+			params[strings.ToUpper(k)] = strings.Trim( v, `"` )
+		}
+	}
+	if name == "BEGIN" || name == "END" {
+		value = strings.ToUpper( value )
+	}
+	return name, params, value
+}	// icsProperty
+
+func icsText( value string ) string {
+	return strings.NewReplacer( `\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\` ).Replace( value )
+}
+
+// icsTime reads a DATE or DATE-TIME value, the warning is for a time zone that is not known.
+func icsTime( value string, params map[string]string ) ( t time.Time, allDay bool, warning string, err error ) {
+	loc := time.Local
+	if tzid := params["TZID"]; tzid != "" {
+		if l, lerr := time.LoadLocation( tzid ); lerr == nil {
+			loc = l
+		} else {
+			warning = fmt.Sprintf( "time zone %q is not an IANA name, read as local time", tzid )
+		}
+	}
+	switch {
+	case params["VALUE"] == "DATE" || len(value) == 8:
+		t, err = time.ParseInLocation( "20060102", value, time.Local )
+		return t, true, warning, err
+	case strings.HasSuffix( value, "Z" ):
+		t, err = time.Parse( "20060102T150405Z", value )
+		return t, false, warning, err
+	}
+	t, err = time.ParseInLocation( "20060102T150405", value, loc )
+	return t, false, warning, err
+}	// icsTime
+
+// icsDuration reads P1W, P2D, PT1H30M, P1DT12H
+func icsDuration( value string ) ( time.Duration, error ) {
+	var d time.Duration
+
+	rest, ok := strings.CutPrefix( strings.TrimPrefix(value, "+"), "P" )
+	if !ok {
+		return 0, fmt.Errorf( "duration %q", value )
+	}
+	number := ""
+	for _, c := range rest {
+		switch {
+		case c >= '0' && c <= '9':
+			number += string( c )
+			continue
+		case c == 'T':
+			continue
+		}
+		n, err := strconv.Atoi( number )
+		if err != nil {
+			return 0, fmt.Errorf( "duration %q", value )
+		}
+		switch c {
+		case 'W':
+			d += time.Duration( n ) * 7 * 24 * time.Hour
+		case 'D':
+			d += time.Duration( n ) * 24 * time.Hour
+		case 'H':
+			d += time.Duration( n ) * time.Hour
+		case 'M':
+			d += time.Duration( n ) * time.Minute
+		case 'S':
+			d += time.Duration( n ) * time.Second
+		default:
+			return 0, fmt.Errorf( "duration %q", value )
+		}
+		number = ""
+	}
+	return d, nil
+}	// icsDuration
+
+// expandICS returns the occurrences that overlap from..to, moved and cancelled instances applied, by start.
+func expandICS( events []icsEvent, from, to time.Time ) ( list []icsOccurrence, warnings []string ) {
+	moved := make( map[string]bool )
+	for _, e := range events {
+		if e.RecurrenceID != nil {
+			moved[e.UID + "/" + e.RecurrenceID.UTC().Format(time.RFC3339)] = true
+		}
+	}
+	for _, e := range events {
+		if e.Cancelled {
+			continue									// Cancelled instances are in moved, so left out below too
+		}
+		starts := []time.Time{ e.Start }
+		if e.RRule != nil && e.RecurrenceID == nil {
+			var warn string
+			if starts, warn = icsRecurrences( e, from, to ); warn != "" {
+				warnings = append( warnings, fmt.Sprintf( "%q: %s", e.Summary, warn ) )
+			}
+		}
+		days := int( e.End.Sub(e.Start).Hours()/24 + 0.5 )
+		for _, start := range starts {
+			if e.RecurrenceID == nil && ( moved[e.UID + "/" + start.UTC().Format(time.RFC3339)] || icsExcluded(e, start) ) {
+				continue
+			}
+			end := start.Add( e.End.Sub(e.Start) )
+			if e.AllDay {
+				end = start.AddDate( 0, 0, days )			// Whole days across a daylight saving change
+			}
+			if end.After( from ) && start.Before( to ) {
+				list = append( list, icsOccurrence{ UID: e.UID, Summary: e.Summary, Start: start, End: end } )
+			}
+		}
+	}
+	sort.Slice( list, func(i, j int) bool { return list[i].Start.Before( list[j].Start ) } )
+	return list, warnings
+}	// expandICS
+
+func icsExcluded( e icsEvent, start time.Time ) bool {
+	for _, x := range e.ExDates {
+		if x.Equal( start ) || ( e.AllDay && x.Year() == start.Year() && x.YearDay() == start.YearDay() ) {
+			return true
+		}
+	}
+	return false
+}	// icsExcluded
+
+// icsRecurrences lists the starts of a recurring event that may overlap from..limit, the warning is for a rule not fully
+// followed. Without COUNT the periods ending before from are skipped, so a long running series reaches the window.
+func icsRecurrences( e icsEvent, from, limit time.Time ) ( starts []time.Time, warning string ) {
+	rule     := e.RRule
+	interval := 1
+	if v, err := strconv.Atoi( rule["INTERVAL"] ); err == nil && v > 0 {
+		interval = v
+	}
+	count := -1
+	if v, err := strconv.Atoi( rule["COUNT"] ); err == nil {
+		count = v
+	}
+	if v := rule["UNTIL"]; v != "" {
+		if until, _, _, err := icsTime( v, map[string]string{} ); err == nil {
+			if e.AllDay {
+				until = until.AddDate( 0, 0, 1 ).Add( -time.Second )
+			}
+			if until.Before( limit ) {
+				limit = until
+			}
+		}
+	}
+	for k, v := range rule {
+		switch k {
+		case "FREQ", "INTERVAL", "COUNT", "UNTIL", "BYDAY", "BYMONTHDAY", "WKST":
+		default:
+			warning = fmt.Sprintf( "RRULE %s=%s is not supported, ignored", k, v )
+		}
+	}
+	freq := rule["FREQ"]
+	switch {
+	case rule["BYDAY"] != "" && freq == "YEARLY",
+		rule["BYMONTHDAY"] != "" && freq != "MONTHLY":
+		return []time.Time{ e.Start }, fmt.Sprintf( "RRULE FREQ=%s with BYDAY or BYMONTHDAY is not supported, only the first date is used", freq )
+	}
+	start := e.Start
+	add := func( t time.Time ) bool {						// false when done
+		if t.After( limit ) || count == 0 {
+			return false
+		}
+		if !t.Before( start ) {
+			starts = append( starts, t )
+			count--
+		}
+		return true
+	}
+	byDay := strings.Split( rule["BYDAY"], "," )
+	if rule["BYDAY"] == "" {
+		byDay = nil
+	}
+	first := 0
+	if earliest := from.Add( e.Start.Sub(e.End) ); count < 0 && earliest.After( start ) {
+		days := int( earliest.Sub(start).Hours() / 24 )
+		switch freq {										// A period early, for daylight saving and BYDAY in the week
+		case "DAILY":
+			first = days/interval - 1
+		case "WEEKLY":
+			first = days/(7*interval) - 1
+		case "MONTHLY":
+			first = ( (earliest.Year()-start.Year())*12 + int(earliest.Month()-start.Month()) )/interval - 1
+		case "YEARLY":
+			first = ( earliest.Year()-start.Year() )/interval - 1
+		}
+		first = max( first, 0 )
+	}
+	for k := first; k < first + 5000; k++ {				// Only a guard, the limit ends it well before
+		var batch []time.Time
+		switch freq {
+		case "DAILY":
+			t := start.AddDate( 0, 0, k*interval )
+			if byDay == nil {
+				batch = []time.Time{ t }
+				break
+			}
+			for _, d := range byDay {
+				if wd, ok := icsWeekdays[strings.ToUpper(d)]; ok && wd == t.Weekday() {
+					batch = []time.Time{ t }
+				}
+			}
+		case "WEEKLY":
+			if byDay == nil {
+				batch = []time.Time{ start.AddDate(0, 0, 7*k*interval) }
+				break
+			}
+			monday := start.AddDate( 0, 0, 7*k*interval - (int(start.Weekday())+6)%7 )
+			for _, d := range byDay {
+				if wd, ok := icsWeekdays[strings.ToUpper(d)]; ok {
+					batch = append( batch, monday.AddDate(0, 0, (int(wd)+6)%7) )
+				}
+			}
+		case "MONTHLY":
+			first := time.Date( start.Year(), start.Month()+time.Month(k*interval), 1, start.Hour(), start.Minute(), start.Second(), 0, start.Location() )
+			batch = icsMonthDays( first, start, byDay, rule["BYMONTHDAY"] )
+		case "YEARLY":
+			t := start.AddDate( k*interval, 0, 0 )
+			if t.Day() == start.Day() {						// Not Feb 29 in other years
+				batch = []time.Time{ t }
+			}
+		default:
+			return []time.Time{ e.Start }, fmt.Sprintf( "RRULE FREQ=%s is not supported, only the first date is used", freq )
+		}
+		sort.Slice( batch, func(i, j int) bool { return batch[i].Before( batch[j] ) } )
+		for _, t := range batch {
+			if !add( t ) {
+				return starts, warning
+			}
+		}
+	}
+	return starts, warning
+}	// icsRecurrences
+
+// icsMonthDays lists the days of one month for MONTHLY, by BYMONTHDAY, BYDAY like 2SA or -1FR, or the start's day.
+func icsMonthDays( first, start time.Time, byDay []string, byMonthDay string ) []time.Time {
+	var list []time.Time
+
+	at := func( day int ) time.Time {
+		return time.Date( first.Year(), first.Month(), day, first.Hour(), first.Minute(), first.Second(), 0, first.Location() )
+	}
+	days := 32 - at( 32 ).Day()								// Day 32 runs into the next month by this much
+	switch {
+	case byMonthDay != "":
+		for _, v := range strings.Split( byMonthDay, "," ) {
+			n, err := strconv.Atoi( v )
+			if n < 0 {
+				n = days + 1 + n
+			}
+			if err == nil && n >= 1 && n <= days {
+				list = append( list, at(n) )
+			}
+		}
+	case byDay != nil:
+		for _, d := range byDay {
+			if len(d) < 2 {
+				continue
+			}
+			wd, ok := icsWeekdays[strings.ToUpper( d[len(d)-2:] )]
+			if !ok {
+				continue
+			}
+			nth, _ := strconv.Atoi( d[:len(d)-2] )
+			var matches []time.Time
+			for day := 1; day <= days; day++ {
+				if at( day ).Weekday() == wd {
+					matches = append( matches, at(day) )
+				}
+			}
+			switch {
+			case nth == 0:
+				list = append( list, matches... )
+			case nth > 0 && nth <= len(matches):
+				list = append( list, matches[nth-1] )
+			case nth < 0 && -nth <= len(matches):
+				list = append( list, matches[len(matches)+nth] )
+			}
+		}
+	case start.Day() <= days:
+		list = append( list, at(start.Day()) )
+	}
+	return list
+}	// icsMonthDays
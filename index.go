@@ -0,0 +1,369 @@
+package main
+	// Chart index pages, written with html/template:
+	//		index.html				current month calendar, archive navigation, year charts, HomeDocs links
+	//		YYYY-MM/index.html		one calendar page for every month in the archive
+	//		Photos/index.html		links to the photos and documents in the Photos folder
+	// Each calendar day shows its runtime and temperature summary with links to the day's chart and CSV.
+	// URLs are built from the path relative to filePath, the data root served at chartsPrefix and docsPrefix.
+
+import (
+	"errors"
+	"html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var monthDirPattern	= regexp.MustCompile( `^\d{4}-\d{2}$` )
+
+// fileURL returns the served URL of a file under filePath, each path element escaped. Empty if outside filePath.
+//		HomeDocs and Photos are served under docsPrefix, everything else under chartsPrefix.
+func fileURL( path string ) string {
+	rel, err := filepath.Rel( filePath, path )
+	if err != nil || rel == ".." || strings.HasPrefix( rel, "../" ) {
+		return ""
+	}
+	rel    = filepath.ToSlash( rel )
+	prefix := chartsPrefix
+	if strings.HasPrefix( rel+"/", homeDocsFldr ) || strings.HasPrefix( rel+"/", homePhotosFldr ) {
+		prefix = docsPrefix
+	}
+	parts := strings.Split( rel, "/" )
+	for i := range parts {
+		parts[i] = url.PathEscape( parts[i] )
+	}
+	return prefix + strings.Join( parts, "/" )
+}	// fileURL
+
+// A named link on a page
+type pageLink struct {
+	Name			string
+	URL				string
+}
+
+// One calendar cell, Day 0 is padding before the 1st or after the last day
+type calendarDay struct {
+	Day				int
+	Today			bool
+	ChartURL		string
+	CSVURL			string
+	Summary			*daySummary
+}
+
+// One month of the archive for navigation
+type archiveMonth struct {
+	Name			string			// Jan, Feb...
+	URL				string
+	Current			bool
+}
+
+type archiveYear struct {
+	Year			string
+	Months			[]archiveMonth
+}
+
+// Everything a calendar page shows
+type indexPage struct {
+	Title			string
+	Generated		string
+	Month			string			// January 2026
+	Weeks			[][]calendarDay
+	Prev, Next		string			// URLs of the neighbouring months in the archive
+	Archive			[]archiveYear
+	YearCharts		[]pageLink
+	AnalysisURL		string
+	HistoryURL		string
+	IndexURL		string
+	HomeDocs		[]pageLink
+	HomePDFs		[]pageLink
+	PhotosURL		string
+	GitHub			string
+	Version			string
+}
+
+// A folder of the Photos page
+type photoFolder struct {
+	Name			string
+	Files			[]pageLink
+}
+
+type photosPage struct {
+	Title			string
+	Generated		string
+	Folders			[]photoFolder
+	IndexURL		string
+}
+
+const pageStyle = `<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table.calendar { border-collapse: collapse; }
+table.calendar th, table.calendar td { border: 1px solid #888; width: 120px; vertical-align: top; padding: 3px; }
+table.calendar td.pad { border: none; }
+table.calendar td.today { background: #eef5ff; }
+table.calendar .day { font-weight: bold; }
+table.calendar .sum { font-size: 0.8em; color: #444; }
+table.links td { text-align: left; border: none; padding: 1px 6px 1px 0; }
+.archive a.current { font-weight: bold; }
+</style>
+`
+
+var indexTemplate = template.Must( template.New("index").Parse( `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+` + pageStyle + `</head>
+<body>
+<h2>HVAC Saved Measurements {{ .Generated }}</h2>
+<h3>{{ if .Prev }}<a href="{{ .Prev }}">&#x25C0;</a> {{ end }}{{ .Month }}{{ if .Next }} <a href="{{ .Next }}">&#x25B6;</a>{{ end }}
+ &nbsp; <small><a href="{{ .IndexURL }}">current</a></small></h3>
+<table class="calendar">
+<tr><th>Sun</th><th>Mon</th><th>Tue</th><th>Wed</th><th>Thu</th><th>Fri</th><th>Sat</th></tr>
+{{ range .Weeks }}<tr>{{ range . }}{{ if eq .Day 0 }}<td class="pad"></td>{{ else }}<td{{ if .Today }} class="today"{{ end }}>
+<span class="day">{{ if .ChartURL }}<a href="{{ .ChartURL }}">{{ .Day }}</a>{{ else }}{{ .Day }}{{ end }}</span>{{ if .CSVURL }} <small><a href="{{ .CSVURL }}">csv</a></small>{{ end }}
+{{ with .Summary }}<div class="sum">On {{ printf "%.1f" .RuntimeHours }} h ({{ printf "%.0f" .PercentOn }}%)<br>
+In {{ .IndoorMin }}&ndash;{{ .IndoorMax }}&deg;<br>Out {{ .OutdoorMin }}&ndash;{{ .OutdoorMax }}&deg;{{ if .CirculationHours }}<br>Fan {{ printf "%.1f" .CirculationHours }} h{{ end }}</div>{{ end }}</td>{{ end }}{{ end }}</tr>
+{{ end }}</table>
+<h3>Archive</h3>
+<div class="archive">{{ range .Archive }}<div>{{ .Year }}: {{ range .Months }}<a href="{{ .URL }}"{{ if .Current }} class="current"{{ end }}>{{ .Name }}</a> {{ end }}</div>
+{{ end }}</div>
+{{ if .YearCharts }}<h3>Year Charts</h3>
+<table class="links">{{ range .YearCharts }}<tr><td><a href="{{ .URL }}">{{ .Name }}</a></td></tr>{{ end }}</table>{{ end }}
+<h3>Runtime vs Outdoor Temperature: <a href="{{ .AnalysisURL }}">analysis</a></h3>
+<h3>Temperatures and Runtime over Any Range: <a href="{{ .HistoryURL }}">history</a></h3>
+<h3>Infinitive Software Ref: <a href="{{ .GitHub }}">Infinitive-Carrier-HVAC-Enhanced</a> {{ .Version }}</h3>
+{{ if .HomeDocs }}<h3>Helpful .html Files Found in HomeDocs</h3>
+<table class="links">{{ range .HomeDocs }}<tr><td><a href="{{ .URL }}">{{ .Name }}</a></td></tr>{{ end }}</table>{{ end }}
+{{ if .HomePDFs }}<h3>Helpful .pdf Files Found in HomeDocs</h3>
+<table class="links">{{ range .HomePDFs }}<tr><td><a href="{{ .URL }}">{{ .Name }}</a></td></tr>{{ end }}</table>{{ end }}
+{{ if .PhotosURL }}<h3>Photos &amp; Docs: <a href="{{ .PhotosURL }}" target="_blank">index.html</a></h3>{{ end }}
+</body>
+</html>
+` ) )
+
+var photosTemplate = template.Must( template.New("photos").Parse( `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+` + pageStyle + `</head>
+<body>
+<h2>Photos and Documents {{ .Generated }}</h2>
+<p><a href="{{ .IndexURL }}">HVAC Saved Measurements</a></p>
+{{ range .Folders }}<h3>Folder: {{ .Name }}</h3>
+<table class="links">{{ range .Files }}<tr><td><a href="{{ .URL }}">{{ .Name }}</a></td></tr>{{ end }}</table>
+{{ end }}</body>
+</html>
+` ) )
+
+// writeTemplateFile renders to a temporary file and renames it, a browser never sees a half written page.
+func writeTemplateFile( fileName string, tmpl *template.Template, data interface{} ) error {
+	tmp, err := os.CreateTemp( filepath.Dir(fileName), ".index-*" )
+	if err != nil {
+		chartsLog.Error( "writeTemplateFile - create failure: " + fileName + " ", err )
+		return err
+	}
+	err = tmpl.Execute( tmp, data )
+	tmp.Close()
+	if err == nil {
+		os.Chmod( tmp.Name(), 0644 )
+		err = os.Rename( tmp.Name(), fileName )
+	}
+	if err != nil {
+		chartsLog.Error( "writeTemplateFile - write failure: " + fileName + " ", err )
+		os.Remove( tmp.Name() )
+	}
+	return err
+}	// writeTemplateFile
+
+// archiveMonths lists the YYYY-MM month folders of the data root, oldest first.
+func archiveMonths() []time.Time {
+	var months []time.Time
+
+	entries, err := os.ReadDir( filePath )
+	if err != nil {
+		chartsLog.Error( "archiveMonths - read failure: " + filePath + " ", err )
+		return nil
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !monthDirPattern.MatchString( e.Name() ) {
+			continue
+		}
+		if t, err := time.ParseInLocation( "2006-01", e.Name(), time.Local ); err == nil {
+			months = append( months, t )
+		}
+	}
+	sort.Slice( months, func(i, j int) bool { return months[i].Before(months[j]) } )
+	return months
+}	// archiveMonths
+
+func monthIndexFile( month time.Time ) string {
+	return filePath + month.Format("2006-01") + "/" + linksFile
+}	// monthIndexFile
+
+// calendarWeeks lays out the month Sunday first, with a summary for each day that has data.
+func calendarWeeks( month time.Time, today time.Time ) [][]calendarDay {
+	var weeks [][]calendarDay
+
+	week := make( []calendarDay, int(month.Weekday()) )
+	for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+		cell := calendarDay{ Day: day.Day(), Today: day.Equal(today) }
+		csvName   := dailyFileFor( day )
+		chartName := strings.TrimSuffix( csvName, "_Infinitive.csv" ) + chartFileSuffix
+		if dataFileExists( chartName ) {
+			cell.ChartURL = fileURL( chartName )
+		}
+		if sum, ok := dataStore.DailySummary( day ); ok {
+			cell.Summary = &sum
+			if dataFileExists( csvName ) {				// Not after the month was pruned
+				cell.CSVURL = fileURL( csvName )
+			}
+		}
+		week = append( week, cell )
+		if len(week) == 7 {
+			weeks = append( weeks, week )
+			week  = nil
+		}
+	}
+	if len(week) > 0 {
+		weeks = append( weeks, append(week, make([]calendarDay, 7-len(week))...) )
+	}
+	return weeks
+}	// calendarWeeks
+
+// yearChartLinks finds the Year_YYYY-MM, YearHeatmap_YYYY and YearHours_YYYY charts, newest first.
+func yearChartLinks() []pageLink {
+	var links []pageLink
+
+	matches, _ := filepath.Glob( filePath + yearFileString + "*" + htmlExt )
+	sort.Sort( sort.Reverse(sort.StringSlice(matches)) )
+	for _, m := range matches {
+		links = append( links, pageLink{ Name: filepath.Base(m), URL: fileURL(m) } )
+	}
+	return links
+}	// yearChartLinks
+
+// homeDocsLinks finds files in the HomeDocs folder with the extension, the link text is the path within HomeDocs.
+func homeDocsLinks( fileExt string ) []pageLink {
+	var links []pageLink
+
+	walkPath := filePath + homeDocsFldr
+	err := filepath.Walk( walkPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			docsLog.Error( "homeDocsLinks - traversal error: " + path + " ", err )
+			return nil
+		}
+		if !info.IsDir() && filepath.Ext(path) == fileExt {
+			links = append( links, pageLink{ Name: strings.TrimPrefix(path, walkPath), URL: fileURL(path) } )
+		}
+		return nil
+	})
+	if err != nil {
+		docsLog.Error( "homeDocsLinks - Error walking the directory: ", err )
+	}
+	return links
+}	// homeDocsLinks
+
+// makeIndexPages writes index.html and the calendar page of every month in the archive.
+func makeIndexPages() error {
+	var errs []error
+
+	now      := time.Now()
+	today    := time.Date( now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local )
+	thisMonth := time.Date( now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local )
+	months   := archiveMonths()
+	if len(months) == 0 || months[len(months)-1].Before( thisMonth ) {
+		months = append( months, thisMonth )		// Folder not made yet, still show this month
+	}
+	chartsLog.Info( "makeIndexPages - months in archive: ", len(months) )
+
+	// Parts shared by every page
+	base := indexPage{
+		Generated:		now.Format( "2006-01-02 15:04:05" ),
+		YearCharts:		yearChartLinks(),
+		AnalysisURL:	chartsPrefix + "analysis",
+		HistoryURL:		chartsPrefix + "history",
+		IndexURL:		fileURL( filePath + linksFile ),
+		HomeDocs:		homeDocsLinks( htmlExt ),
+		HomePDFs:		homeDocsLinks( pdfExt ),
+		GitHub:			gitHubReference,
+		Version:		Version,
+	}
+	if _, err := os.Stat( filePath + homePhotosFldr ); err == nil {
+		base.PhotosURL = fileURL( filePath + homePhotosFldr + linksFile )
+	}
+	for i, month := range months {
+		page := base
+		page.Title  = "HVAC Saved Measurements " + month.Format( "January 2006" )
+		page.Month  = month.Format( "January 2006" )
+		page.Weeks  = calendarWeeks( month, today )
+		page.Archive = archiveNav( months, month )
+		if i > 0 {
+			page.Prev = fileURL( monthIndexFile(months[i-1]) )
+		}
+		if i < len(months)-1 {
+			page.Next = fileURL( monthIndexFile(months[i+1]) )
+		}
+		if _, err := os.Stat( filepath.Dir(monthIndexFile(month)) ); err == nil {
+			errs = append( errs, writeTemplateFile( monthIndexFile(month), indexTemplate, page ) )
+		}
+		if i == len(months)-1 {
+			page.Title = "HVAC Saved Measurements " + base.Generated
+			errs = append( errs, writeTemplateFile( filePath + linksFile, indexTemplate, page ) )
+		}
+	}
+	return errors.Join( errs... )
+}	// makeIndexPages
+
+// archiveNav groups the archive months by year, newest year first.
+func archiveNav( months []time.Time, current time.Time ) []archiveYear {
+	var years []archiveYear
+
+	for _, m := range months {
+		year := m.Format( "2006" )
+		if len(years) == 0 || years[0].Year != year {
+			years = append( []archiveYear{ {Year: year} }, years... )
+		}
+		years[0].Months = append( years[0].Months, archiveMonth{ Name: m.Format("Jan"), URL: fileURL(monthIndexFile(m)), Current: m.Equal(current) } )
+	}
+	return years
+}	// archiveNav
+
+// createPhotosDocsLinkFile writes the index of jpeg and pdf files in the Photos folder, grouped by folder.
+func createPhotosDocsLinkFile( path2Files string ) error {
+	docsLog.Info( "createPhotosDocsLinkFile -- create links to Photos & Docs from: " + path2Files )
+	if _, err := os.Stat( path2Files ); err != nil {
+		docsLog.Warn( "createPhotosDocsLinkFile - no folder: " + path2Files )
+		return nil
+	}
+	now  := time.Now()
+	page := photosPage{
+		Title:		"Photos and Documents at " + now.Format( "2006-01-02 15:04:05" ),
+		Generated:	now.Format( "2006-01-02 15:04:05" ),
+		IndexURL:	fileURL( filePath + linksFile ),
+	}
+	folderIndex := make( map[string]int )			// Walk can return to a folder after visiting its subfolders
+	err := filepath.Walk( path2Files, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			docsLog.Error( "createPhotosDocsLinkFile - traversal error: " + path + " ", err )
+			return nil
+		}
+		if info.IsDir() {
+			folderIndex[filepath.Clean(path)] = len( page.Folders )
+			page.Folders = append( page.Folders, photoFolder{ Name: strings.TrimPrefix(filepath.Clean(path)+"/", filePath) } )
+		} else if filepath.Ext(path) == jpegExt || filepath.Ext(path) == pdfExt {
+			if i, ok := folderIndex[filepath.Dir(path)]; ok {
+				page.Folders[i].Files = append( page.Folders[i].Files, pageLink{ Name: strings.TrimPrefix(path, path2Files), URL: fileURL(path) } )
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		docsLog.Error( "createPhotosDocsLinkFile - Error walking the directory: ", err )
+	}
+	return errors.Join( err, writeTemplateFile( path2Files + linksFile, photosTemplate, page ) )
+}	// createPhotosDocsLinkFile
@@ -6,6 +6,7 @@ package main
 	
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -16,18 +17,20 @@ import (
 	"time"
 	"strconv"
 	"bufio"
-	"github.com/robfig/cron/v3"
 	"path/filepath"
 	"strings"
+	"sort"
 	"math"
 	"io"
 	"github.com/go-echarts/go-echarts/v2/charts"
 	"github.com/go-echarts/go-echarts/v2/opts"
 	"github.com/go-echarts/go-echarts/v2/types"
-	"net/http"
+	"os/signal"
+	"syscall"
+	"sync"
 )
 
-// Added: Strings used throughout, Version may be changed using -ldflags on build
+// Added: Strings used throughout, Version may be changed using -ldflags on build, paths are set from config.go
 var	Version			= "development"
 var	filePath		= "/var/lib/infinitive/"
 var	monthDir		= ""
@@ -49,9 +52,9 @@ var gitHubReference	= "https://github.com/skutoroff/Infinitive-Carrier-HVAC-Enha
 //		CurrentTemp     uint8
 //		OutdoorTemp     int8
 //		HvacMode		string
+//		Stage			uint8
 
-// Added: package defs to support periodic write to file
-var fileHvacHistory *os.File
+// Added: package defs to support periodic write to the store
 var	currentTempPrev	uint8 = 0		// Save previous value for spike removal
 var	outdoorTempPrev	int8  = 0		// Save previous value for spike removal
 var outTemp			int
@@ -63,180 +66,10 @@ var	todaysYear		int
 
 // Added: Support functions
 
-// timeFromFilePath uses file modified date ttribute
-func timeFromFilePath( filename string ) time.Time {
-	file, err := os.Stat( filename )
-	if (err != nil ) {
-		log.Error( "timeFromFilePath os.Stat error on file: " + filename + " ", err )
-		return todaysDate
-	}
-	return file.ModTime()
-}	// timeFromFilePath
-
-// return TRUE if the filename is older than today by 2nd argument.
-func fileIsTooOld( filename string, limit int ) bool {
-	diff	:= todaysDate.Sub(timeFromFilePath(filename)).Hours()/24	// Compute the difference in days from Hours
-	return int(diff+math.Copysign(0.5, diff)) > limit -1				// The conversion got a little messy
-}	// fileIsTooOld
-
-// Find files in Pictures folder for all found files, create html file
-func createPhotosDocsLinkFile( path2Files string ) {
-	log.Error( "createPhotosDocsLinkFile -- create links to Photos & Docs from: " + path2Files )
-	htmlLink, err := os.OpenFile( path2Files+linksFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Error("createPhotosDocsLinkFile - " + path2Files + " create Failure.")
-		return
-	}
-	lenFile2Path := len(path2Files)		// location of Photos
-	timeStr := time.Now().Format("2006-01-02 15:04:05")
-	htmlLink.WriteString( "<!-- infinitive.createPhotosDocsLinkFile(): " + timeStr + " -->\n" )
-	htmlLink.WriteString( "<!DOCTYPE html>\n<html lang=\"en\">\n" )
-	htmlLink.WriteString( "<head>\n<title>Photos and Documents from: " + path2Files + ", at" + timeStr + "</title>\n" )
-	//	style table 2
-	htmlLink.WriteString( "<style>\n.table2 {\n td {\n    text-align: left;\n    }\n table, th, td {\n    border: none;\n" )
-	htmlLink.WriteString( "    border-spacing: 1px;\n    }\n    border-collapse: collapse;\n  }\n}\n</style>\n" )
-	// The body
-	htmlLink.WriteString( "</head>\n<body>\n<h2>Photos and Documents " + timeStr + "</h2>\n" )
-	count := 0
-	err = filepath.Walk( path2Files, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Error("createPhotosDocsLinkFile - traversal error.")
-			return nil
-		}
-		count++
-		if info.IsDir() {														// It's a folder
-			htmlLink.WriteString( "</table>\n<h3>Folder: " + path + "</h3>\n<table class=\"table2\">\n" )
-			count = 0
-		} else if filepath.Ext(path)==jpegExt || filepath.Ext(path)==pdfExt {	// A file, add link, Future expansion
-			htmlLink.WriteString( "  <tr><td><a href=\"" + filePath[8:]+homePhotosFldr+path[lenFile2Path:] + "\">" + path[lenFile2Path:] + "</a></td></tr>\n" )
-		}
-		return nil
-	})
-	if err != nil {
-		log.Error( "createPhotosDocsLinkFile - Error walking the directory: %v", err)
-		htmlLink.WriteString("createPhotosDocsLinkFile - Error walking the directory.")
-	}
-	htmlLink.WriteString( "</table>\n" )
-	htmlLink.WriteString( "</body>\n</html>\n\n" )
-	htmlLink.Close()
-	return
-}	// createPhotosDocsLinkFile
-
-// Find files in HomeDocs folder using fileExt arg for extension. If any found, add list of links to these files.
-func insertHomeDocsLinks( walkPath string, fileExt string, htmlFile *os.File ) {
-	log.Error( "insertHomeDocsLinks -- create links to Home Docs" )
-	count := 0
-	pos   := 0
-	htmlFile.WriteString( "<table class=\"table2\">\n" )
-	err := filepath.Walk( walkPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Error("insertHomeDocsLinks - traversal error.")
-			return nil
-		}
-		if !info.IsDir() && filepath.Ext(path)==fileExt {			// It's a file with target extension in the Docs folder
-			count++
-			if count == 1 {											// File found, introduce it all
-				htmlFile.WriteString( "<h3>Helpful " + fileExt + " Files Found in " + walkPath + "</h3>\n" )
-			}
-			pos = strings.Index(path,homeDocsFldr)					// Show subfolder name in link text
-			// That [8:] TBD, probably length of "/var/lib/", prefixt to serve point path
-			htmlFile.WriteString( "  <tr><td><a href=\"" + path[8:] + "\">" + path[pos+len(homeDocsFldr):] + "</a></td></tr>\n" )
-		}
-		return nil
-	})
-	htmlFile.WriteString( "</table>\n" )
-	if err != nil {
-		log.Error( "insertHomeDocsLinks - Error walking the directory: %v", err)
-	}
-	return
-}	// insertHomeDocsLinks
-
-// Find HTML files and prepare 3 column link table; bool argument controls table only or full html page.
-func makeTableHTMLfiles( tableOnly bool, tableFileName string, wayBackDays int ) {
-	var files []string
-
-	// Identify the html files, produce table of links, table only or full html page.
-	htmlLink, err := os.OpenFile( tableFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Error("makeTableHTMLfiles - " + tableFileName + " create Failure.")
-	}
-	timeStr := time.Now().Format("2006-01-02 15:04:05")
-	if !tableOnly {
-		htmlLink.WriteString( "<!-- infinitive.makeTableHTMLfiles(): " + timeStr + " -->\n" )
-		htmlLink.WriteString( "<!DOCTYPE html>\n<html lang=\"en\">\n" )
-		htmlLink.WriteString( "<head>\n<title>HVAC Saved Measurements " + timeStr + "</title>\n" )
-		//	style table 1
-		htmlLink.WriteString( "<style>\n.table1 {\n  td {\n    text-align: center;\n    }\n    table, th, tr {\n    border: 1px solid;\n" )
-		htmlLink.WriteString( "    border-collapse: collapse;\n    }\n    tr,td {\n    border: 1px solid;\n    border-collapse: collapse;\n    }\n}\n" )
-		//	style table 2,3
-		htmlLink.WriteString( ".table2 {\n td {\n    text-align: left;\n    }\n table, th, td {\n    border: none;\n" )
-		htmlLink.WriteString( "    border-spacing: 1px;\n   border-collapse: collapse;\n    }\n}\n</style>\n" )
-		// The body
-		htmlLink.WriteString( "<body>\n<h2>HVAC Saved Measurements " + timeStr + "</h2>\n" )
-	}
-	htmlLink.WriteString( "<table class=\"table1\" width=\"720\">\n" )
-	err = filepath.Walk( filePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Error("makeTableHTMLfiles - filepath.Walk error 1." )
-			return nil
-		}
-		// Processs html files, skip directories, skip index.html, and skip files in the Docs folder.
-		if !info.IsDir() && filepath.Base(path)!=linksFile && filepath.Ext(path)==htmlExt && !strings.Contains(path,homeDocsFldr[0:len(homeDocsFldr)-1]) {
-			// Add files newer than the criteria for being to old and the Year_yyyy-mmm.html files
-			base := filepath.Base( path )
-			if base[:3] == yearFileString[:3] {		// The few monthy Year charts are listed without considering age.
-				files = append(files, path)
-			} else {								// The daily chart files
-				if !fileIsTooOld(path,wayBackDays) {
-					files = append(files, path)
-				}
-			}
-		}
-		return nil
-	}	) 	// end filepath.Walk()
-    if err != nil {
-		log.Error("makeTableHTMLfiles - filepath.Walk error 2." )
-		return
-	} else {
-		// Process the filepath list.
-		index := 0
-		for _, file := range files {
-			fileName := file
-			length := len(fileName)
-			// Only process temperature html files...
-			if fileName[length-1] == 'l' {
-				// make three column table...
-				if index % 3 == 0 {
-					htmlLink.WriteString( "  <tr>\n" )
-				}
-				// For target, omit leading folders from the file path. Start where files are served from.
-				htmlLink.WriteString( "    <td><a href=\"" + fileName[8:] + "\">" + filepath.Base(fileName) + "</a></td>\n" )
-				if index % 3 == 2 {
-					htmlLink.WriteString( " </tr>\n" )
-				}
-				index++
-			}	// file ends with 'l' or starts with 'h' (the files we want).
-		}  // end for
-		if index % 3 == 1 {
-			htmlLink.WriteString( " </tr>\n" )
-		}
-	}
-	if !tableOnly {
-		htmlLink.WriteString( "</table>\n" )
-		htmlLink.WriteString( "<h3>Infinitive Software Ref: <a href=\"" + gitHubReference + "\">Infinitive-Carrier-HVAC-Enhanced</a></h3>\n" )
-		insertHomeDocsLinks( filePath+homeDocsFldr, htmlExt, htmlLink )	// Find html files
-		insertHomeDocsLinks( filePath+homeDocsFldr, pdfExt,  htmlLink )	// Find pdf files
-		htmlLink.WriteString( "<h3>Photos & Docs: <a href=\"" + filePath[8:]+homePhotosFldr+linksFile + "\" target=_blank>"+linksFile+"</a></h3>\n" )
-		htmlLink.WriteString( "</body>\n</html>\n\n" )
-	}
-	htmlLink.Close()
-	return
-}	// makeTableHTMLfiles
-
 // Next two functions produce html chart of HVAC blower %On history from saved daily html files
 //		Find the percent on value searching for "On: ". Code from https://zetcode.com/golang/find-file/
 func doOneDailyFile( file string ) int {
-	f, err := os.Open(file)
+	f, err := openDataFile(file)								// Archived months too
 	if err != nil {
 		return	-1		// Should not happen
 	}
@@ -249,7 +82,7 @@ func doOneDailyFile( file string ) int {
 			if index != -1 {
 				pcntOn, err := strconv.ParseFloat( strings.Trim( scanner.Text()[index+3:index+10], " " ), 32 )
 				if err != nil {
-					log.Error("doOneDailyFile conversion error on " + file + ", error: ", err )
+					chartsLog.Error("doOneDailyFile conversion error on " + file + ", error: ", err )
 				}
 				return int( math.Round(pcntOn*10)/10 )		// found it, done with current file (it is always line 19)
 				break
@@ -257,12 +90,12 @@ func doOneDailyFile( file string ) int {
 		}	// line has "On: "
 		line++
 	}	// file scanner
-	log.Error("doOneDailyFile -no On: value in: " + filepath.Base(file) )
+	chartsLog.Warn("doOneDailyFile -no On: value in: " + filepath.Base(file) )
 	return -1
 }	// doOneDailyFile
 
 // Find html files and extracts the percent on time with the date
-func extractPercentFromHTMLfiles( folder string ) {
+func extractPercentFromHTMLfiles( folder string ) error {
 	var files []string
 	var	records	int
 	var data[366] int
@@ -274,7 +107,7 @@ func extractPercentFromHTMLfiles( folder string ) {
 
 	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Error("extractPercentFromHTMLfiles - filepath.Walk() failed 1.", err )
+			chartsLog.Error("extractPercentFromHTMLfiles - filepath.Walk() failed 1.", err )
 			return nil
 		}
 		if !info.IsDir() && filepath.Ext(path)==htmlExt {
@@ -283,9 +116,11 @@ func extractPercentFromHTMLfiles( folder string ) {
 		return nil
 	}	) 	// filepath.Walk()
     if err != nil {
-		log.Error("extractPercentFromHTMLfiles - filepath.Walk failed at end.", err )
-		return
+		chartsLog.Error("extractPercentFromHTMLfiles - filepath.Walk failed at end.", err )
+		return err
 	} else {
+		files = append( files, archivedFiles(htmlExt)... )			// Charts of archived months, in Walk order again
+		sort.Strings( files )
 		for i := 0; i<366; i++ {									// initialze data array to sawtooth
 			dayyr[i]	= i
 			data[i]		= -1										// Flag missing data
@@ -300,7 +135,7 @@ func extractPercentFromHTMLfiles( folder string ) {
 			t, err := time.Parse("2006-01-02", date )				// Get date from file name
 			if err != nil {
 				// There should be few (none?) of these
-				log.Error("extractPercentFromHTMLfiles time.Parse() failed. " +  filepath.Base(file) )
+				chartsLog.Warn("extractPercentFromHTMLfiles time.Parse() failed. " +  filepath.Base(file) )
 			}
 			yrday  := t.YearDay()
 			if yrday < 0 {											// 2025 broke a bounds, range bound value
@@ -324,7 +159,7 @@ func extractPercentFromHTMLfiles( folder string ) {
 		}	// all files
 		//	Fill or Overwrite gap between current and prior year. Current is processed last
 		if gapStart != -1 && gapStart<350 {
-			log.Error("extractPercentFromHTMLfiles - Multi-year fill: ", gapStart )
+			chartsLog.Info("extractPercentFromHTMLfiles - Multi-year fill: ", gapStart )
 			for i := gapStart; i<gapStart+16;i++ {
 				data[i]	= -1										// Fill the gap - 2025-12-12 (removed +1)
 			}
@@ -335,7 +170,7 @@ func extractPercentFromHTMLfiles( folder string ) {
 		//		log.Error( i,data[i],data[i+1],data[i+2],data[i+3],data[i+4],data[i+5],data[i+6],data[i+7],data[i+8],data[i+9] )
 		//	}
 		//}
-		log.Error("extractPercentFromHTMLfiles - Records found: "+  strconv.Itoa(records) )
+		chartsLog.Info("extractPercentFromHTMLfiles - Records found: "+  strconv.Itoa(records) )
 		for i := 0; i<366; i++ {
 			if data[i] != -1 {
 				dayof = append( dayof, opts.LineData{ Value: data[i]  } )
@@ -369,15 +204,17 @@ func extractPercentFromHTMLfiles( folder string ) {
 		fHTML, err := os.OpenFile( filePath + fileStr, os.O_CREATE|os.O_APPEND|os.O_RDWR|os.O_TRUNC, 0664 )
 		if err == nil {
 			// Example Ref: https://github.com/go-echarts/examples/blob/master/examples/boxplot.go
-			log.Error("extractPercentFromHTMLfiles - Render to html:  " + fileStr )
+			chartsLog.Info("extractPercentFromHTMLfiles - Render to html:  " + fileStr )
 			Line.Render(io.MultiWriter(fHTML))
 		} else {
-			log.Error("extractPercentFromHTMLfiles - Error writing html file: " + fileStr )
+			chartsLog.Error("extractPercentFromHTMLfiles - Error writing html file: " + fileStr )
+			return err
 		}
 		// This works in test app GraphInf, but not here. Cause unknown.
 		fHTML.Close()
 		err = os.Chmod( fileStr, 0664 )		// as set in OpeFile, still got 0644
 	}
+	return nil
 }	//extractPercentFromHTMLfiles
 
 // The HVAC data file is opened and closed in different modes at multiple places.
@@ -385,48 +222,255 @@ func openDailyFile( timeIs time.Time, fileFlags int, needHeader bool ) (DailyFil
 	var err error
 
 	fileNameIs = fmt.Sprintf( "%s%4d-%02d-%02d_%s", filePath + monthDir, timeIs.Year(), timeIs.Month(), timeIs.Day(), "Infinitive.csv")
-	log.Error( "openDailyFile, Daily:              " + filepath.Base(fileNameIs) )
+	recorderLog.WithField( "file", filepath.Base(fileNameIs) ).Info( "openDailyFile, Daily" )
 	DailyFile, err = os.OpenFile(fileNameIs, fileFlags, 0664 )
 	if err != nil {
-		log.Error( "openDailyFile Create File Failure." )
+		recorderLog.WithField( "file", fileNameIs ).Error( "openDailyFile Create File Failure: ", err )
 	}
 	if needHeader {
-		DailyFile.WriteString( "Date,Time,FracTime,Heat Set,Cool Set,Outdoor Temp,Current Temp,BlowerRPM\n" )
+		DailyFile.WriteString( csvHeader )
 	}
 	return
 }	// openDailyFile
 
+// renderDailyChart charts a day's file, was cron 2. final is the whole day, rendered after midnight,
+// otherwise the time axis is extended to the end of the day.
+func renderDailyChart( day time.Time, final bool ) error {
+	dayf	:= make( [] float32, 2000 )
+	times	:= make( [] time.Time, 2000 )		// Of each point of dayf, for the plan and the change marks
+	inTmp	:= make( [] int,	 2000 )
+	outTmp	:= make( [] int,	 2000 )
+	motRPM	:= make( [] int,	 2000 )
+	intervalsRun	:= 0
+	intervalsOn		:= 0
+	stops			:= 0				// Restarts after a clean shutdown
+	// Read the day's captured data from the store, the file name still names the chart.
+	dailyFileName := dailyFileFor( day )
+	samples, err := daySamples( day )
+	if err != nil {
+		chartsLog.Error("infinitive cron 2 Unable to read daily samples: "+dailyFileName)
+		return err
+	}
+	summary, _ := dataStore.DailySummary( day )
+	restarts   := summary.Restarts
+	// Read and prepare days data for charting
+	items1 := make( []opts.LineData, 0 )		// Indoor Temperature
+	items2 := make( []opts.LineData, 0 )		// Outdoor Temperature
+	items3 := make( []opts.LineData, 0 )		// Blower RPM
+	items4 := make( []opts.LineData, 0 )		// Heat setpoint
+	items5 := make( []opts.LineData, 0 )		// Cool setpoint
+	index := 0
+	for _, sample := range samples {
+		if index == len(dayf) {
+			break
+		}
+		dayf[index]		= float32( sample.FracDay )
+		times[index]	= sample.When
+		// Save the indoor temp, outdoor temps, and blower RPM in slices.
+		outTmp[index]	= sample.OutdoorTemp
+		inTmp[index]	= sample.CurrentTemp
+		motRPM[index]	= sample.BlowerRPM
+		items4 = append( items4, opts.LineData{ Value: sample.HeatSet } )
+		items5 = append( items5, opts.LineData{ Value: sample.CoolSet } )
+		items1 = append( items1, opts.LineData{ Value: inTmp[index]  } )
+		items2 = append( items2, opts.LineData{ Value: outTmp[index] } )
+		items3 = append( items3, opts.LineData{ Value: motRPM[index] } )
+		// Collect the % active data, fan circulation is not heating or cooling
+		if sample.hvacOn() {
+			intervalsOn++
+		}
+		if sample.Shutdown {
+			stops++
+		}
+		intervalsRun++
+		index++
+	}
+	if index == 0 {
+		return errors.New( "no samples in " + dailyFileName )
+	}
+	lastData := index-1
+	index--
+	// If not end of day run, extend time X-axis to expected length.
+	if !final && day.Hour() != 23 {
+		base := dayf[index] + 0.002777		// bias to match day end time (Fix? golang 1.25 exception)
+		at   := times[index].Add( time.Duration(sampleMinutes) * time.Minute )
+		for i := index; i<359; i++ {		// 60/4 * 24 = 360
+			base += 0.002777				// Next four minute point.
+			at = at.Add( time.Duration(sampleMinutes) * time.Minute )
+			dayf[i]= base
+			times[i] = at
+			index++
+		}
+	}
+	chartsLog.Info("Infinitive cron 2 Preparing chart: " + filepath.Base(dailyFileName) )
+	// echarts referenece: https://github.com/go-echarts/go-echarts
+	pcntOn := 100.0 * float32(intervalsOn) / float32(intervalsRun)
+	text := fmt.Sprintf("Indoor+Outdoor Temperatue w/Blower RPM from %s, #Restarts: %d (%d stopped), On: %6.1f percent, Vsn: %s %s", dailyFileName, restarts-1, stops, pcntOn, Version, infinity.HvacMode )
+	Line := charts.NewLine()
+	Line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeWesteros}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    "Infinitive HVAC Daily Chart",
+			Subtitle: text,
+		}, ),
+	)
+	// Chart the Indoor and Outdoor temps (to start). How to use date/time string as time?
+	Line.SetXAxis( dayf[0:index])
+	Line.AddSeries("Indoor Temp", 	items1[0:lastData])
+	Line.AddSeries("Outdoor Temp",	items2[0:lastData])
+	Line.SetSeriesOptions(charts.WithMarkLineNameTypeItemOpts(opts.MarkLineNameTypeItem{Name: "Minimum", Type: "min"}))
+	Line.SetSeriesOptions(charts.WithMarkLineNameTypeItemOpts(opts.MarkLineNameTypeItem{Name: "Maximum", Type: "max"}))
+	Line.AddSeries("Fan RPM%",		items3[0:lastData], charts.WithMarkPointNameCoordItemOpts(auditMarkPoints(day, times[0:index])...))
+	Line.SetSeriesOptions( charts.WithLineChartOpts( opts.LineChart{Smooth: true} ) )
+	// Setpoints as steps, what the thermostat had and, with a schedule, what was planned.
+	Line.AddSeries("Heat Set",		items4[0:lastData], charts.WithLineChartOpts( opts.LineChart{Step: "end"} ))
+	Line.AddSeries("Cool Set",		items5[0:lastData], charts.WithLineChartOpts( opts.LineChart{Step: "end"} ))
+	if planHeat, planCool := scheduleEngine.plannedSetpoints( times[0:index] ); planHeat != nil {
+		Line.AddSeries("Heat Plan",	planHeat, charts.WithLineChartOpts( opts.LineChart{Step: "end"} ), charts.WithLineStyleOpts( opts.LineStyle{Type: "dashed"} ))
+		Line.AddSeries("Cool Plan",	planCool, charts.WithLineChartOpts( opts.LineChart{Step: "end"} ), charts.WithLineStyleOpts( opts.LineStyle{Type: "dashed"} ))
+	}
+	// -- In Progress -- Need axis name placement fixed. Y-axis name buried under subtitle, X-axis name to right.
+	Line.SetGlobalOptions(
+		charts.WithXAxisOpts( opts.XAxis{ AxisLabel: &opts.AxisLabel{Rotate: 45, ShowMinLabel: true, ShowMaxLabel: true, Interval: "0" }, }, ),
+		charts.WithXAxisOpts( opts.XAxis{ Name: "Time YearDay.frac",  }, ),				//Type: "time",  }, ),	<<-- Results in diagonal plot
+		charts.WithYAxisOpts( opts.YAxis{ Name: "Temp & Blower", Type: "value", }, ), 	//position: "right", }, ),	<<<--wrong.
+		charts.WithYAxisOpts( opts.YAxis{ Min: 0, Max: 100, }, ),			// apply uniform bounds
+	)
+	// Render and save the html file...
+	fileStr := strings.TrimSuffix( dailyFileName, "_Infinitive.csv" ) + chartFileSuffix
+	// Chart it all
+	fHTML, err := os.OpenFile( fileStr, os.O_CREATE|os.O_APPEND|os.O_RDWR|os.O_TRUNC, 0664 )
+	if err == nil {
+		// Example Ref: https://github.com/go-echarts/examples/blob/master/examples/boxplot.go
+		chartsLog.WithField( "file", filepath.Base(fileStr) ).Info("Infinitive cron 2 Render to html")
+		Line.Render(io.MultiWriter(fHTML))
+	} else {
+		chartsLog.WithField( "file", fileStr ).Error("Infinitive cron 2 Error html file: ", err )
+		return err
+	}
+	fHTML.Close()
+	return os.Chmod( fileStr, 0664 )		// as set in OpenFile, still got 0644
+}	// renderDailyChart
+
+// The control engines and the change watcher, they run until stopEngines, a tick in progress finishes first.
+var engineCtx, cancelEngines = context.WithCancel( context.Background() )
+var enginesRunning sync.WaitGroup
+
+func startEngine( run func(context.Context) ) {
+	enginesRunning.Add( 1 )
+	go func() {
+		defer enginesRunning.Done()
+		run( engineCtx )
+	}()
+}	// startEngine
+
+// stopEngines stops every engine and waits for them, up to the deadline in ctx.
+func stopEngines( ctx context.Context ) error {
+	cancelEngines()
+	done := make( chan struct{} )
+	go func() {
+		enginesRunning.Wait()
+		close( done )
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}	// stopEngines
+
 // Resume ACD
 func main() {
-	// Added
-	var dailyFileName, text	string
-	var f64					float64
-	var	index				int
-
-	// ACD
-	httpPort := flag.Int("httpport", 8080, "HTTP port to listen on")
-	serialPort := flag.String("serial", "", "path to serial port")
+	// Added: account management, infinitive user ...
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		_, args, err := configUserPaths( os.Args[2:] )
+		if err == nil {
+			err = runUserCommand( args )
+		}
+		if err != nil {
+			fmt.Fprintln( os.Stderr, err )
+			os.Exit(1)
+		}
+		return
+	}
+	// Restore a backup bundle, infinitive restore ... see backup.go, with the service stopped.
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		_, args, err := configUserPaths( os.Args[2:] )
+		if err == nil {
+			err = runRestoreCommand( args )
+		}
+		if err != nil && !errors.Is( err, flag.ErrHelp ) {
+			fmt.Fprintln( os.Stderr, err )
+			os.Exit(1)
+		}
+		return
+	}
+	// Rebuild the hourly and daily rollups, infinitive rollups ... see rollup.go, with the service stopped.
+	if len(os.Args) > 1 && os.Args[1] == "rollups" {
+		c, args, err := configUserPaths( os.Args[2:] )
+		if err == nil {
+			err = runRollupsCommand( c, args )
+		}
+		if err != nil && !errors.Is( err, flag.ErrHelp ) {
+			fmt.Fprintln( os.Stderr, err )
+			os.Exit(1)
+		}
+		return
+	}
+	// Load the CSV files into the database, infinitive migrate ... see store.go, with the service stopped.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		c, args, err := configUserPaths( os.Args[2:] )
+		if err == nil {
+			err = runMigrateCommand( c, args )
+		}
+		if err != nil && !errors.Is( err, flag.ErrHelp ) {
+			fmt.Fprintln( os.Stderr, err )
+			os.Exit(1)
+		}
+		return
+	}
 
-	flag.Parse()
+	// Config file with flags over it, see config.go. The flags are the same as before.
+	cfg, err := startConfig( os.Args[1:] )
+	if errors.Is( err, flag.ErrHelp ) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println( "config:", err )
+		os.Exit(1)
+	}
 
-	if len(*serialPort) == 0 {
-		fmt.Print("must provide serial\n")
-		flag.PrintDefaults()
+	if err := setupErrorLog( cfg.Logs.Level, cfg.Logs.Format ); err != nil {
+		fmt.Println( "logs:", err )
 		os.Exit(1)
 	}
+	hangup := make( chan os.Signal, 1 )
+	signal.Notify( hangup, syscall.SIGHUP )
+	go func() {
+		for range hangup {
+			reopenLogs()
+			reloadConfig()
+		}
+	}()
 
-	log.SetLevel(log.ErrorLevel)		// Changed from DebugLevel
+	loaded, err := loadLimits( cfg.Limits )
+	if err != nil {
+		fmt.Println( "limits:", err )
+		os.Exit(1)
+	}
+	limits = loaded
+	if dataStore, err = openStore( cfg.Store ); err != nil {
+		fmt.Println( "store:", err )
+		os.Exit(1)
+	}
 
-	infinityApi, err := infinity.NewApi(context.Background(), *serialPort)
+	infinityApi, err := infinity.NewApi(context.Background(), cfg.Serial)
 	if err != nil {
 		log.Panicf("error opening serial port: %s", err.Error())
 	}
 
 	// Added: data collection and charting
-	dayf	:= make( [] float32, 2000 )
-	inTmp	:= make( [] int,	 2000 )
-	outTmp	:= make( [] int,	 2000 )
-	motRPM	:= make( [] int,	 2000 )
 	outdoorTempPrev = 0
 	currentTempPrev = 0
 
@@ -434,235 +478,227 @@ func main() {
 	dt := time.Now()
 	todaysDate	= dt
 	todaysYear	= dt.Year()
-	monthDir	= fmt.Sprintf( "%04d-%02d/", dt.Year(), dt.Month() )
-	fileHvacHistory, dailyFileName = openDailyFile( dt, os.O_APPEND|os.O_CREATE|os.O_WRONLY, true )
-	log.Error("Infinitive Start/Restart.")
+	ensureMonthDir( dt )
+	if err := dataStore.AppendStart( dt ); err != nil {		// The header line of the daily file
+		recorderLog.Error("Infinitive Start/Restart not recorded: ", err)
+	}
+	recorderLog.Info("Infinitive Start/Restart.")
 
 	// References for periodic execution:
 	//		https://pkg.go.dev/github.com/robfig/cron?utm_source=godoc
 	//		https://github.com/robfig/cron
-	// cron Job 1 - collect data to file every 4 minutes, fix funky values, and start new file at top of the day.
-	// cron Job 2 - produce chart and html table before midnight and 2 hours apart from 06:00 to 22:00
-	// cron Job 3 - update the Daily html table file and the Year %on time chart.
-	// cron job 4 - delete log files 2x per month.
-
-	// Set up cron 1 - 4 minute data collection, fix data, cycle file at top of new day.
-	cronJob1 := cron.New(cron.WithSeconds())
-	cronJob1.AddFunc("0 */4 * * * *", func () {
-		dt = time.Now()
-		// Are we at the start of a new day? If so, close yesterdays daily file and open a new one.
-		if dt.Hour()==0 && dt.Minute()==0 {
-			err = fileHvacHistory.Close()
-			if err != nil {
-				log.Error("infinitive cron 1 Error closing daily:  " + dailyFileName)
-			}
-			// Open new file with new date
-			fileHvacHistory, dailyFileName = openDailyFile( dt, os.O_APPEND|os.O_CREATE|os.O_WRONLY, true )
-		}
+	// The cron jobs are named jobs on one scheduler now, see jobs.go, with status at /api/jobs.
+	// sample (was cron 1) - collect data to the store every 4 minutes, fix funky values, the month folder at top of the day.
+	// chart (was cron 2) - produce chart and html table before midnight and 2 hours apart from 06:00 to 22:00
+	// final - chart yesterday to its last sample, the chart job's last run of a day is at 23:00.
+	// daily (was cron 3) - archive old months, update the Daily html table file and the Year %on time chart.
+	// Log files rotate themselves, see logfiles.go, cron 4 that deleted them and exited is gone.
+	jobEngine = newJobScheduler()
+	var dailyMu sync.Mutex			// sample and chart both set dt
+
+	// One sample line at dt, marker is an 11th field, "shutdown" on the last line before a clean stop.
+	writeSample := func( marker string ) error {
 		// Consider decimal part calculation with year from 2023, 2023-01-01 is Julian 2459945.5
 		frcDay :=  float32(dt.YearDay()) + 4.16667*(float32(dt.Hour()) + float32(dt.Minute())/60.0)/100.0
-		// Fix the too frequent 0 or 1 spikes in raw data and range check.
-		if ( ( infinity.OutdoorTemp==0 || infinity.OutdoorTemp==1 ) && outdoorTempPrev>10 ) || infinity.OutdoorTemp>125 {
+		// Fix the too frequent 0 or 1 spikes in raw data and range check, limits from the config.
+		spikes := currentConfig().Spikes
+		if ( ( infinity.OutdoorTemp==0 || infinity.OutdoorTemp==1 ) && int(outdoorTempPrev)>spikes.OutdoorDropout ) || int(infinity.OutdoorTemp)>spikes.OutdoorMax {
 			infinity.OutdoorTemp = outdoorTempPrev
 		} else {
 			outdoorTempPrev = infinity.OutdoorTemp
 		}
 		// indoor temp can also be damaged
-		if infinity.CurrentTemp<32 || infinity.CurrentTemp>115 {
+		if int(infinity.CurrentTemp)<spikes.IndoorMin || int(infinity.CurrentTemp)>spikes.IndoorMax {
 			infinity.CurrentTemp = currentTempPrev
 		} else {
 			currentTempPrev = infinity.CurrentTemp
 		}
 		//  OLd Set blower RPM as % off(0), low(34), med(66), high(100) so rpm range matches temp range
 		// 2025-12-12 Revise to use RPM/10 and cap at 100 to keep chart from changing high range.
-		infinity.BlowerRPM = infinity.BlowerRPM/10
-		if infinity.BlowerRPM > 100 {
-			infinity.BlowerRPM = 100
-		}
+		// The shutdown sample can come right after cron 1, so scale a copy rather than infinity.BlowerRPM itself.
+		blowerRPM := min( infinity.BlowerRPM/10, 100 )
 		// Future: fix HvacMode, it is sometimes "unknown", but we don't use it.
-		outLine := fmt.Sprintf( "%s,%09.4f,%04d,%04d,%04d,%04d,%04d,%s\n", dt.Format("2006-01-02T15:04:05"),
-							frcDay, infinity.HeatSet, infinity.CoolSet, infinity.OutdoorTemp, infinity.CurrentTemp, infinity.BlowerRPM, infinity.HvacMode )
-		fileHvacHistory.WriteString(outLine)
-	} )
-	cronJob1.Start()
+		// Circulate is 1 when the blower runs for fan circulation only, see circulate.go, then the stage for recovery.go.
+		// The CSV store writes it as the same fixed column line as always, see formatSampleLine.
+		sample := hvacSample{ When: dt, FracDay: float64(frcDay), HeatSet: int(infinity.HeatSet), CoolSet: int(infinity.CoolSet),
+			OutdoorTemp: int(infinity.OutdoorTemp), CurrentTemp: int(infinity.CurrentTemp), BlowerRPM: int(blowerRPM), HvacMode: infinity.HvacMode,
+			Circulating: circulationEngine.circulating(), Stage: int(infinity.Stage), Shutdown: marker == "shutdown" }
+		if err := dataStore.AppendSample( sample ); err != nil {
+			return err
+		}
+		// Then the hour and day rollups, see rollup.go
+		return rollups.add( sample )
+	}
 
-	// Set up cron 2 for hourly charting of daily file.
-	cronJob2 := cron.New(cron.WithSeconds())
-	cronJob2.AddFunc( "2 0 */1 * * *", func() {
-		log.Error("Infinitive cron 2 Begins.")
-		intervalsRun	:= 0
-		intervalsOn		:= 0
-		restarts		:= 0
+	// Set up the sample job - 4 minute data collection, fix data, the store cycles the file at top of new day.
+	jobEngine.add( "sample", cfg.Cron.Sample, "one sample in the store, a new daily file at midnight with csv", false, recorderLog, func() error {
+		dailyMu.Lock()
+		defer dailyMu.Unlock()
 		dt = time.Now()
-		// Close, then open new dated Infinitive.csv
-		err = fileHvacHistory.Close()
-		err = os.Chmod( dailyFileName, 0664 )		// beware file permissions! Or you get 0644.
-		if err != nil {
-			log.Error("infinitive cron 2 Error closing: " + dailyFileName)
-		}
-		// Open new file with todays date in name to read captured data.
-		fileHvacHistory, err = os.OpenFile( dailyFileName, os.O_RDONLY, 0 )
-		if err != nil {
-			log.Error("infinitive cron 2 Unable to read daily file: "+dailyFileName)
+		// At the start of a new day the store starts the day's file itself, a new month folder on the 1st.
+		if dt.Hour()==0 && dt.Minute()==0 {
+			ensureMonthDir( dt )
 		}
-		// Read and prepare days data for charting
-		items1 := make( []opts.LineData, 0 )		// Indoor Temperature
-		items2 := make( []opts.LineData, 0 )		// Outdoor Temperature
-		items3 := make( []opts.LineData, 0 )		// Blower RPM
-		index = 0
-		filescan := bufio.NewScanner( fileHvacHistory )
-		for filescan.Scan() {
-			text = filescan.Text()
-			if filescan.Err() != nil {
-				log.Error("infinitive cron 2 file Scan read error:" + text )
-			}
-			if text[0] != 'D' {		// Header lines start with D, skip'em
-				f64, err	= strconv.ParseFloat( text[20:29], 32 )
-				dayf[index]	= float32(f64)
-				// Extract and save the indoor temp, outdoor temps, and blower RPM in slices.
-				outTmp[index], err	= strconv.Atoi( text[40:44] )
-				inTmp[index], err	= strconv.Atoi( text[45:49] )
-				motRPM[index], err	= strconv.Atoi( text[50:54] )
-				items1 = append( items1, opts.LineData{ Value: inTmp[index]  } )
-				items2 = append( items2, opts.LineData{ Value: outTmp[index] } )
-				items3 = append( items3, opts.LineData{ Value: motRPM[index] } )
-				// Collect the % active data
-				if motRPM[index] > 0 {
-					intervalsOn++
-				}
-				intervalsRun++
-				index++
-			} else {
-				restarts++
+		return writeSample( "" )
+	} )
+	jobEngine.scheduledOnly( "sample" )
+
+	// Set up the chart job for hourly charting of daily file.
+	jobEngine.add( "chart", cfg.Cron.Chart, "today's chart, then the index pages", true, chartsLog, func() error {
+		dailyMu.Lock()
+		defer dailyMu.Unlock()
+		dt = time.Now()
+		return errors.Join( renderDailyChart( dt, false ), makeIndexPages() )
+	} )
+
+	// Set up the final job, the whole day chart of each day since it last ran, only yesterday the first time.
+	// Days missed while Infinitive was down are charted after a restart, a month at most.
+	jobEngine.add( "final", cfg.Cron.Final, "yesterday's whole day chart, and any day missed", true, chartsLog, func() error {
+		var errs []error
+		now := time.Now()
+		yesterday := time.Date( now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.Local )
+		day := yesterday
+		if last := jobEngine.lastSuccess( "final" ); !last.IsZero() {		// It covered up to the day before it ran
+			day = time.Date( last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, time.Local )
+			if oldest := yesterday.AddDate( 0, 0, -31 ); day.Before( oldest ) {
+				day = oldest
 			}
 		}
-		lastData := index-1
-		index--
-		// If not end of day run, extend time X-axis to expected length.
-		if dt.Hour() != 23 {
-			base := dayf[index] + 0.002777		// bias to match day end time (Fix? golang 1.25 exception)
-			for i := index; i<359; i++ {		// 60/4 * 24 = 360
-				base += 0.002777				// Next four minute point.
-				dayf[i]= base
-				index++
+		for ; !day.After( yesterday ); day = day.AddDate( 0, 0, 1 ) {
+			if _, ok := dataStore.DailySummary( day ); !ok {
+				continue										// Down all day
+			}
+			chartsLog.Info( "Infinitive final chart for " + day.Format("2006-01-02") )
+			if err := renderDailyChart( day, true ); err != nil {
+				errs = append( errs, fmt.Errorf( "%s: %w", day.Format("2006-01-02"), err ) )
 			}
 		}
-		fileHvacHistory.Close()
-		log.Error("Infinitive cron 2 Preparing chart: " + filepath.Base(dailyFileName) )
-		// echarts referenece: https://github.com/go-echarts/go-echarts
-		pcntOn := 100.0 * float32(intervalsOn) / float32(intervalsRun)
-		text = fmt.Sprintf("Indoor+Outdoor Temperatue w/Blower RPM from %s, #Restarts: %d, On: %6.1f percent, Vsn: %s %s", dailyFileName, restarts-1, pcntOn, Version, infinity.HvacMode )
-		Line := charts.NewLine()
-		Line.SetGlobalOptions(
-			charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeWesteros}),
-			charts.WithTitleOpts(opts.Title{
-				Title:    "Infinitive HVAC Daily Chart",
-				Subtitle: text,
-			}, ),
-		)
-		// Chart the Indoor and Outdoor temps (to start). How to use date/time string as time?
-		Line.SetXAxis( dayf[0:index])
-		Line.AddSeries("Indoor Temp", 	items1[0:lastData])
-		Line.AddSeries("Outdoor Temp",	items2[0:lastData])
-		Line.SetSeriesOptions(charts.WithMarkLineNameTypeItemOpts(opts.MarkLineNameTypeItem{Name: "Minimum", Type: "min"}))
-		Line.SetSeriesOptions(charts.WithMarkLineNameTypeItemOpts(opts.MarkLineNameTypeItem{Name: "Maximum", Type: "max"}))
-		Line.AddSeries("Fan RPM%",		items3[0:lastData])
-		Line.SetSeriesOptions( charts.WithLineChartOpts( opts.LineChart{Smooth: true} ) )
-		// -- In Progress -- Need axis name placement fixed. Y-axis name buried under subtitle, X-axis name to right.
-		Line.SetGlobalOptions(
-			charts.WithXAxisOpts( opts.XAxis{ AxisLabel: &opts.AxisLabel{Rotate: 45, ShowMinLabel: true, ShowMaxLabel: true, Interval: "0" }, }, ),
-			charts.WithXAxisOpts( opts.XAxis{ Name: "Time YearDay.frac",  }, ),				//Type: "time",  }, ),	<<-- Results in diagonal plot
-			charts.WithYAxisOpts( opts.YAxis{ Name: "Temp & Blower", Type: "value", }, ), 	//position: "right", }, ),	<<<--wrong.
-			charts.WithYAxisOpts( opts.YAxis{ Min: 0, Max: 100, }, ),			// apply uniform bounds
-		)
-		// Render and save the html file...
-		fileStr := fmt.Sprintf( "%s%04d-%02d-%02d"+chartFileSuffix, filePath + monthDir, dt.Year(), dt.Month(), dt.Day() )
-		// Chart it all
-		fHTML, err := os.OpenFile( fileStr, os.O_CREATE|os.O_APPEND|os.O_RDWR|os.O_TRUNC, 0664 )
-		if err == nil {
-			// Example Ref: https://github.com/go-echarts/examples/blob/master/examples/boxplot.go
-			log.Error("Infinitive cron 2 Render to html:  " + filepath.Base(fileStr) )
-			Line.Render(io.MultiWriter(fHTML))
-		} else {
-			log.Error("Infinitive cron 2 Error html file: " + fileStr )
-		}
-		fHTML.Close()
-		err = os.Chmod( fileStr, 0664 )		// as set in OpenFile, still got 0644
-		// Re-open the HVAV history file to write more data, hence append.
-		fileHvacHistory, dailyFileName = openDailyFile( dt, os.O_APPEND|os.O_CREATE|os.O_WRONLY, false )
-		makeTableHTMLfiles( false, filePath + linksFile, 24 )
+		return errors.Join( append( errs, makeIndexPages() )... )
 	} )
-	cronJob2.Start()
 
-	// Set up cron 3 to update the Daily html table file and the Year %on time chart.
-	cronJob3 := cron.New(cron.WithSeconds())
-	cronJob3.AddFunc( "3 2 0 * * *", func () {
+	// Set up the daily jobs to update the Daily html table file and the Year %on time chart, one after the other.
+	jobEngine.add( "rollups", "", "the hourly and daily rollups of days since the last, from the samples", false, chartsLog, func() error {
+		return catchUpRollups( time.Now() )
+	} )
+	jobEngine.add( "archive", "", "archive and prune old months, see retention", false, chartsLog, func() error {
+		return applyRetention()
+	} )
+	jobEngine.add( "index", "", "the index calendar pages", false, chartsLog, func() error {
 		todaysDate	= dt				// save and update todays date
 		todaysYear	= dt.Year()
-		// Update the html table file with ~30 days of daily charts and the years chart.
-		log.Error("Infinitive cron 3 Prepare the html table of daily charts.")
-		makeTableHTMLfiles( false, filePath + linksFile, 24 )
+		// Update the index calendar pages of daily charts and the year charts.
+		chartsLog.Info("Infinitive cron 3 Prepare the html table of daily charts.")
+		return makeIndexPages()
+	} )
+	jobEngine.add( "yearchart", "", "the year blower percent on chart", false, chartsLog, func() error {
 		// Produce Yearly chart daily, destination file will change monthly.
 		// Find "On; " in html files to chart extract blower percent on time.
-		log.Error("Infinitive cron 3 Prepare Year blower chart percent on time frrom HTML files.")
-		extractPercentFromHTMLfiles( filePath )
-		// Daily, update the file of links to photos and related documents
-		createPhotosDocsLinkFile(  filePath + homePhotosFldr )
+		chartsLog.Info("Infinitive cron 3 Prepare Year blower chart percent on time frrom HTML files.")
+		return extractPercentFromHTMLfiles( filePath )
 	} )
-	cronJob3.Start()
-
-	// Set up cron 4, Run 1st and 16th of the month to delete log files and exit.
-	cronJob4 := cron.New(cron.WithSeconds())
-	cronJob4.AddFunc( "4 0 1 1,16 * *", func () {
-		log.Error("Infinitive cron 4 Begin log file cycling.")
-		// remove log files least they grow unbounded, using shell commands for this was futile.
-
-		logName := logPath + "infinitiveError.log"
-		log.Error("infinitive cron 4 Removing Error log file:  " + logName )
-		if os.Remove( logName ) != nil {
-			log.Error("infinitive cron 4 Removing Error log FAIL:  " + logName )
-		}
-		logName = logPath + "infinitiveOutput.log"
-		log.Error("infinitive cron 4 Removing Output log file: " + logName )
-		if os.Remove( logName ) != nil {
-			log.Error("infinitive cron 4 Removing Output log FAIL: " + logName )
+	jobEngine.add( "heatmaps", "", "the year heatmaps", false, chartsLog, func() error {
+		// Calendar heatmap and hour-of-day matrix from the CSV samples, finish last year's on January 1st.
+		chartsLog.Info("Infinitive cron 3 Prepare Year heatmap charts from CSV files.")
+		var lastYear error
+		if dt.YearDay() == 1 {
+			lastYear = makeYearHeatmaps( todaysYear-1 )
 		}
-		// On the 1st day of month, create a month folder
-		dt = time.Now()
-		if dt.Day() == 1 {
-			monthDir = fmt.Sprintf( "%04d-%02d/", dt.Year(), dt.Month() )
-			text := filePath + monthDir
-			if err := os.Mkdir( text, os.ModePerm ); err == nil {
-				log.Error("infinitive cron 4 Create New Month folder created: " + text )
-			} else {
-				log.Error("infinitive cron 4 Create New Month folder FAILED:  " + text )
+		return errors.Join( lastYear, makeYearHeatmaps( todaysYear ) )
+	} )
+	jobEngine.add( "photos", "", "the photos and docs links page", false, docsLog, func() error {
+		// Daily, update the file of links to photos and related documents
+		return createPhotosDocsLinkFile(  filePath + homePhotosFldr )
+	} )
+	jobEngine.add( "daily", cfg.Cron.Index, "rollups, archive, index, yearchart, heatmaps and photos in turn", true, chartsLog, func() error {
+		var errs []error
+		for _, name := range []string{ "rollups", "archive", "index", "yearchart", "heatmaps", "photos" } {
+			if err := jobEngine.runJob( name, "daily" ); err != nil {
+				errs = append( errs, fmt.Errorf( "%s: %w", name, err ) )
 			}
 		}
-		// Log files are not re-opened after this purge. Force an exit and let Systemd sort it out.
-		log.Error("Infinitive cron 4 Program Forced Exit after log file purge.")
-		os.Exit(1)		// Required so new log files are opened.
+		return errors.Join( errs... )
 	} )
-	cronJob4.Start()
+	// Every engine is made before any job or engine runs, the jobs and the engines read each other's globals.
+	recoveryEngine = newRecoveryLearner( infinityApi )	// Learned from the stored samples before the schedule starts
+	if scheduleEngine, err = newScheduler( infinityApi ); err != nil {
+		controlLog.Panicf("error loading schedule: %s", err.Error())
+	}
+	if profileEngine, err = newProfileSwitcher( infinityApi ); err != nil {
+		controlLog.Panicf("error loading profiles: %s", err.Error())
+	}
+	if circulationEngine, err = newCirculator( infinityApi ); err != nil {
+		controlLog.Panicf("error loading fan circulation: %s", err.Error())
+	}
+	if occupancyEngine, err = newOccupancyWatcher( infinityApi ); err != nil {
+		controlLog.Panicf("error loading occupancy: %s", err.Error())
+	}
+	if calendarEngine, err = newCalendarImporter( infinityApi ); err != nil {		// After the profiles its rules name
+		controlLog.Panicf("error loading calendar: %s", err.Error())
+	}
+	overrideEngine = newOverrider( infinityApi )
+	jobEngine.start()
 
 	// At launch, create the file of links to photos and related documents
-	createPhotosDocsLinkFile(  filePath + homePhotosFldr )					// Create Photos html file
-
-	// We've started/restarted, update the index.html file to be fresh.
-	makeTableHTMLfiles( false, filePath + linksFile, 24 )
-	// Start static file server for the charts, asyncrhonous
-	log.Error("Infinitive - start FileServer() for Infinitive HVAC charts.")
-	go func() {
-		// Simple static FileServer
-		fs := http.FileServer(http.Dir(filePath[:len(filePath)-1]))			// Remove trailing directory "/"
-		http.Handle("/infinitive/", http.StripPrefix("/infinitive/", fs))	// This must be right.
-		err:= http.ListenAndServe(":8081", nil)								// localhost:8081/infinitive/index.html
-		if err != nil {
-			log.Error("Infinitive - Static File Server failed: ListenAndServe. ", err)
+	jobEngine.runJob( "photos", "startup" )					// Create Photos html file
+
+	// We've started/restarted, update the index pages to be fresh.
+	jobEngine.runJob( "index", "startup" )
+	// Run the chart, final and daily jobs now when their time passed while we were down.
+	go jobEngine.catchUp( time.Now() )
+	// Start the web server for the UI, API, charts and docs. Replaces launchWebserver and the 8081 FileServer.
+	apiLog.Info("Infinitive - start web server for Infinitive HVAC control and charts.")
+	// Record thermostat changes made at the wall unit or by anything else but us.
+	startEngine( func(ctx context.Context) { watchExternalChanges( ctx, infinityApi ) } )
+	// Run the setback schedule, the current period is applied now.
+	startEngine( recoveryEngine.run )
+	startEngine( profileEngine.run )
+	startEngine( circulationEngine.run )
+	startEngine( occupancyEngine.run )
+	startEngine( overrideEngine.run )				// Before the schedule, which waits for an override to end
+	startEngine( scheduleEngine.run )
+	startEngine( calendarEngine.run )
+	server, err := startWebServer( infinityApi, cfg.Web )
+	if err != nil {
+		apiLog.Panicf("error starting web server: %s", err.Error())
+	}
+	stopSignal, stop := signal.NotifyContext( context.Background(), syscall.SIGINT, syscall.SIGTERM )
+	defer stop()
+	select {
+	case err = <-server.errs:
+		apiLog.Error("Infinitive - web server failed: ", err)
+	case <-stopSignal.Done():
+		recorderLog.Info("Infinitive - stop signal, shutting down.")
+	}
+	// Graceful shutdown, systemd waits 90 seconds before it kills us, we give up well before that.
+	shutdownCtx, cancel := context.WithTimeout( context.Background(), 30*time.Second )
+	defer cancel()
+	// Requests in progress finish, both listeners close, then the access log. Nothing more comes in for the store.
+	if err := server.Shutdown( shutdownCtx ); err != nil {
+		apiLog.Error("Infinitive - web server shutdown: ", err)
+	}
+	// The engines stop before the store and the serial port close, none is left mid-change.
+	if err := stopEngines( shutdownCtx ); err != nil {
+		controlLog.Warn("Infinitive - engine still running at the deadline.")
+	}
+	// No new job runs, then wait for a run in progress, the chart job may be mid-render with the daily file read-only.
+	// The last sample carries the shutdown marker, so the charts can tell a stop from a crash.
+	if err := jobEngine.stop( shutdownCtx ); err != nil {
+		recorderLog.Warn("Infinitive - job still running at the deadline, no shutdown sample.")
+	} else {
+		dt = time.Now()
+		if err := writeSample( "shutdown" ); err != nil {
+			recorderLog.Error("Infinitive - shutdown sample: ", err)
 		}
-   	} ()
-
-	// Start infinitive UI
-	log.Error("Infinitive - launchWeserver()   for Infinitive HVAC control.")
-	// ACD
-	launchWebserver(*httpPort, infinityApi)
+	}
+	if err := rollups.flush(); err != nil {
+		recorderLog.Error("Infinitive - rollups: ", err)
+	}
+	if err := dataStore.Close(); err != nil {
+		recorderLog.Error("Infinitive - store close: ", err)
+	}
+	if err := infinityApi.Close(); err != nil {
+		log.Error("Infinitive - serial port close: ", err)
+	}
+	recorderLog.Info("Infinitive - stopped.")
+	closeLogs()
 }
@@ -0,0 +1,331 @@
+package main
+	// Named jobs on one cron scheduler, in place of the cronJob1 to 3 closures main used to start.
+	// Each job keeps its last run, duration, outcome and error, and its last jobHistorySize runs.
+	// A job never overlaps with itself, a run that finds it busy is recorded as skipped. A panic is a failed run.
+	// The last success of a catch-up job is kept in filePath+jobsFileName. At startup a catch-up job whose
+	// scheduled time passed while Infinitive was down runs once, in the order the jobs were added.
+	//		sample		cron.sample		one line in the daily file, a new daily file at midnight, never run by hand
+	//		chart		cron.chart		today's chart, then the index pages, catch-up
+	//		final		cron.final		the whole day chart of every day since its last run, catch-up
+	//		daily		cron.index		rollups, archive, index, yearchart, heatmaps and photos in turn, catch-up
+	//		rollups		by daily		the hourly and daily rollups of days since the last
+	//		archive		by daily		archive and prune old months, see retention
+	//		index		by daily		the index calendar pages
+	//		yearchart	by daily		the year blower percent on chart
+	//		heatmaps	by daily		the year heatmaps
+	//		photos		by daily		the photos and docs links page
+	//		GET /api/jobs					every job with its status and recent runs
+	//		POST /api/jobs/{name}/run		runs it now in the background, 202, 409 when it is running or not run by hand
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+var jobsFileName	= "infinitiveJobs.json"
+var jobHistorySize	= 20
+
+var (
+	errJobUnknown	= errors.New( "no such job" )
+	errJobRunning	= errors.New( "job is already running" )
+	errJobsStopped	= errors.New( "jobs are stopped for shutdown" )
+	errJobNoManual	= errors.New( "job only runs on its schedule" )
+)
+
+// One run of a job
+type jobRun struct {
+	Started			time.Time		`json:"started"`
+	Seconds			float64			`json:"seconds"`
+	Trigger			string			`json:"trigger"`			// schedule, manual or the job that ran it
+	Outcome			string			`json:"outcome"`			// ok, failed or skipped
+	Error			string			`json:"error,omitempty"`
+}
+
+// What /api/jobs shows of a job
+type jobStatus struct {
+	Name			string			`json:"name"`
+	Schedule		string			`json:"schedule"`			// Empty when another job runs it
+	Description		string			`json:"description"`
+	CatchUp			bool			`json:"catchUp"`			// Run at startup when a scheduled time was missed
+	Manual			bool			`json:"manual"`			// May be run by hand
+	Running			bool			`json:"running"`
+	Runs			int				`json:"runs"`
+	Failures		int				`json:"failures"`
+	Last			*jobRun			`json:"last"`
+	LastSuccess		*time.Time		`json:"lastSuccess,omitempty"`
+	Next			*time.Time		`json:"next,omitempty"`
+	History			[]jobRun		`json:"history"`			// Newest first
+}
+
+type job struct {
+	jobStatus
+	run				func() error
+	log				*log.Entry
+	busy			sync.Mutex				// Held while running, so no overlap
+	entry			cron.EntryID
+	schedule		cron.Schedule
+}
+
+type jobScheduler struct {
+	mu				sync.Mutex				// Guards the jobStatus of every job, stopped and the file
+	file			string
+	successes		map[string]time.Time	// Last success of the catch-up jobs, as saved
+	cron			*cron.Cron
+	jobs			map[string]*job
+	order			[]string
+	active			sync.WaitGroup
+	stopped			bool
+}
+
+var jobEngine *jobScheduler
+
+// newJobScheduler reads the last successes, a missing or unreadable file means no catch-up this time.
+func newJobScheduler() *jobScheduler {
+	s := &jobScheduler{ file: filePath + jobsFileName, successes: make(map[string]time.Time),
+		cron: cron.New( cron.WithParser(cronParser) ), jobs: make(map[string]*job) }
+	data, err := os.ReadFile( s.file )
+	if err == nil {
+		err = json.Unmarshal( data, &s.successes )
+	}
+	if err != nil && !errors.Is( err, os.ErrNotExist ) {
+		recorderLog.Warn( "jobs - ignoring unreadable " + s.file + " ", err )
+	}
+	return s
+}	// newJobScheduler
+
+// save writes the last successes, call with s.mu held.
+func ( s *jobScheduler ) save() {
+	data, err := json.MarshalIndent( s.successes, "", "\t" )
+	if err == nil {
+		tmp := filepath.Join( filepath.Dir(s.file), ".jobs.tmp" )
+		if err = os.WriteFile( tmp, append(data, '\n'), 0644 ); err == nil {
+			err = os.Rename( tmp, s.file )
+		}
+	}
+	if err != nil {
+		recorderLog.Error( "jobs - save failure: ", err )
+	}
+}	// save
+
+// add registers a job before start, spec empty for a job only run by another job or by hand.
+func ( s *jobScheduler ) add( name, spec, description string, catchUp bool, logger *log.Entry, run func() error ) error {
+	j := &job{ jobStatus: jobStatus{ Name: name, Schedule: spec, Description: description, CatchUp: catchUp, Manual: true, History: []jobRun{} },
+		run: run, log: logger }
+	if last, ok := s.successes[name]; ok {
+		j.LastSuccess = &last
+	}
+	if spec != "" {
+		schedule, err := cronParser.Parse( spec )
+		if err != nil {
+			return fmt.Errorf( "job %s: %w", name, err )
+		}
+		j.schedule = schedule
+		j.entry = s.cron.Schedule( schedule, cron.FuncJob( func() { s.runJob( name, "schedule" ) } ) )
+	}
+	s.jobs[name] = j
+	s.order = append( s.order, name )
+	return nil
+}	// add
+
+func ( s *jobScheduler ) start() {
+	s.cron.Start()
+}	// start
+
+// runJob runs a job now and waits for it, trigger is recorded with the run.
+func ( s *jobScheduler ) runJob( name, trigger string ) error {
+	j, ok := s.jobs[name]
+	if !ok {
+		return fmt.Errorf( "%w: %s", errJobUnknown, name )
+	}
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return errJobsStopped
+	}
+	s.active.Add( 1 )
+	s.mu.Unlock()
+	defer s.active.Done()
+
+	if !j.busy.TryLock() {
+		s.record( j, jobRun{ Started: time.Now(), Trigger: trigger, Outcome: "skipped", Error: errJobRunning.Error() } )
+		return errJobRunning
+	}
+	defer j.busy.Unlock()
+	s.mu.Lock()
+	j.Running = true
+	s.mu.Unlock()
+	started := time.Now()
+	err := j.call()
+	run := jobRun{ Started: started, Seconds: time.Since( started ).Seconds(), Trigger: trigger, Outcome: "ok" }
+	if err != nil {
+		run.Outcome, run.Error = "failed", err.Error()
+	}
+	s.record( j, run )
+	return err
+}	// runJob
+
+// call runs the job function, a panic is returned as an error rather than ending Infinitive.
+func ( j *job ) call() ( err error ) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf( "panic: %v", p )
+		}
+	}()
+	return j.run()
+}	// call
+
+// record adds a run to the job's status and logs it.
+func ( s *jobScheduler ) record( j *job, run jobRun ) {
+	s.mu.Lock()
+	if run.Outcome != "skipped" {
+		j.Running = false
+		j.Runs++
+	}
+	if run.Outcome == "failed" {
+		j.Failures++
+	}
+	if run.Outcome == "ok" {
+		j.LastSuccess = &run.Started
+		if j.CatchUp {
+			s.successes[j.Name] = run.Started
+			s.save()
+		}
+	}
+	j.Last = &run
+	j.History = append( []jobRun{ run }, j.History[:min(len(j.History), jobHistorySize-1)]... )
+	s.mu.Unlock()
+
+	entry := j.log.WithFields( log.Fields{ "job": j.Name, "trigger": run.Trigger, "seconds": fmt.Sprintf("%.1f", run.Seconds) } )
+	switch run.Outcome {
+	case "failed":
+		entry.Error( "jobs - failed: ", run.Error )
+	case "skipped":
+		entry.Warn( "jobs - skipped, still running" )
+	default:
+		entry.Debug( "jobs - done" )
+	}
+}	// record
+
+// lastSuccess is when the job last started a run that succeeded, zero if never.
+func ( s *jobScheduler ) lastSuccess( name string ) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[name]; ok && j.LastSuccess != nil {
+		return *j.LastSuccess
+	}
+	return time.Time{}
+}	// lastSuccess
+
+// catchUp runs once each catch-up job that missed a scheduled time since its last success.
+// A job that never succeeded has nothing to catch up, its first scheduled run does it.
+func ( s *jobScheduler ) catchUp( now time.Time ) {
+	for _, name := range s.order {
+		j := s.jobs[name]
+		last := s.lastSuccess( name )
+		if !j.CatchUp || j.schedule == nil || last.IsZero() {
+			continue
+		}
+		if missed := j.schedule.Next( last ); missed.Before( now ) {
+			j.log.WithFields( log.Fields{ "job": name, "missed": missed.Format("2006-01-02 15:04:05") } ).Info( "jobs - catching up" )
+			s.runJob( name, "catch-up" )
+		}
+	}
+}	// catchUp
+
+// scheduledOnly refuses runs by hand of a job added before, a sample out of its time would skew the day.
+func ( s *jobScheduler ) scheduledOnly( name string ) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[name]; ok {
+		j.Manual = false
+	}
+}	// scheduledOnly
+
+// trigger starts a job in the background, for the API.
+func ( s *jobScheduler ) trigger( name string ) error {
+	j, ok := s.jobs[name]
+	if !ok {
+		return fmt.Errorf( "%w: %s", errJobUnknown, name )
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.stopped:
+		return errJobsStopped
+	case !j.Manual:
+		return fmt.Errorf( "%w: %s", errJobNoManual, name )
+	case j.Running:
+		return errJobRunning
+	}
+	go s.runJob( name, "manual" )
+	return nil
+}	// trigger
+
+// stop takes no new runs and waits for the ones in progress until ctx is done.
+func ( s *jobScheduler ) stop( ctx context.Context ) error {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	cronDone := s.cron.Stop()
+	done := make( chan struct{} )
+	go func() {
+		<-cronDone.Done()
+		s.active.Wait()
+		close( done )
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}	// stop
+
+// snapshot copies the status of every job, in the order they were added.
+func ( s *jobScheduler ) snapshot() []jobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make( []jobStatus, 0, len(s.order) )
+	for _, name := range s.order {
+		j := s.jobs[name]
+		status := j.jobStatus
+		status.History = append( []jobRun{}, j.History... )
+		if j.Schedule != "" && !s.stopped {
+			next := s.cron.Entry( j.entry ).Next
+			status.Next = &next
+		}
+		list = append( list, status )
+	}
+	return list
+}	// snapshot
+
+func mountJobsAPI( mux *http.ServeMux, s *jobScheduler ) {
+	mux.HandleFunc( "GET /api/jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON( w, http.StatusOK, s.snapshot() )
+	} )
+	mux.HandleFunc( "POST /api/jobs/{name}/run", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue( "name" )
+		err := s.trigger( name )
+		switch {
+		case errors.Is( err, errJobUnknown ):
+			writeError( w, http.StatusNotFound, err.Error() )
+		case errors.Is( err, errJobRunning ), errors.Is( err, errJobNoManual ):
+			writeError( w, http.StatusConflict, err.Error() )
+		case err != nil:
+			writeError( w, http.StatusServiceUnavailable, err.Error() )
+		default:
+			controlLog.WithField( "job", name ).Info( "jobs - run by " + requestIdentity(r).User )
+			writeJSON( w, http.StatusAccepted, map[string]string{ "job": name, "status": "started" } )
+		}
+	} )
+}	// mountJobsAPI
@@ -0,0 +1,140 @@
+package main
+	// Setpoint and mode limits, checked here before any change reaches Api.UpdateZoneConfig.
+	// The limits are read at startup from -limits (default filePath+limitsFileName), a missing file uses defaultLimits.
+	// The UI gets them from GET /api/limits, they used to be constants in app.js that any client could ignore.
+	//		{ "heatMin": 64, "heatMax": 74, "coolMin": 70, "coolMax": 78, "deadband": 2,
+	//		  "modes": ["off", "auto", "heat", "cool"], "fanModes": ["auto", "low", "med", "high"] }
+	// modes may also list electric and heatpump, the heat only modes of a dual fuel system, see zoneModes.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/acd/infinitive/infinity"
+)
+
+var limitsFileName = "infinitiveLimits.json"
+
+// Every mode the thermostat reports and takes, heatModes are the ones that only heat
+var heatModes	= []string{ "heat", "electric", "heatpump" }
+var zoneModes	= append( []string{ "off", "auto", "cool" }, heatModes... )
+
+// Allowed thermostat settings
+type zoneLimits struct {
+	HeatMin		uint8		`json:"heatMin"`
+	HeatMax		uint8		`json:"heatMax"`
+	CoolMin		uint8		`json:"coolMin"`
+	CoolMax		uint8		`json:"coolMax"`
+	Deadband	uint8		`json:"deadband"`			// Cool setpoint at least this far above heat
+	Modes		[]string	`json:"modes"`
+	FanModes	[]string	`json:"fanModes"`
+}
+
+// The old app.js constants, and a 2 degree deadband
+func defaultLimits() zoneLimits {
+	return zoneLimits{ HeatMin: 64, HeatMax: 74, CoolMin: 70, CoolMax: 78, Deadband: 2,
+		Modes: []string{ "off", "auto", "heat", "cool" }, FanModes: []string{ "auto", "low", "med", "high" } }
+}
+
+var limits = defaultLimits()
+
+// A change outside the limits, the message is shown in the UI
+type limitError struct {
+	msg		string
+}
+
+func ( e *limitError ) Error() string { return e.msg }
+
+var errUpdateFailed = errors.New( "thermostat update failed" )
+
+// loadLimits reads the limits file over the defaults, fields left out keep their default.
+func loadLimits( fileName string ) ( zoneLimits, error ) {
+	l := defaultLimits()
+	data, err := os.ReadFile( fileName )
+	if errors.Is( err, os.ErrNotExist ) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+	if err = json.Unmarshal( data, &l ); err != nil {
+		return l, fmt.Errorf( "%s: %w", fileName, err )
+	}
+	if err = l.validate(); err != nil {
+		return l, fmt.Errorf( "%s: %w", fileName, err )
+	}
+	return l, nil
+}	// loadLimits
+
+// validate checks the limits make sense together.
+func ( l zoneLimits ) validate() error {
+	switch {
+	case l.HeatMin > l.HeatMax:
+		return errors.New( "heatMin is above heatMax" )
+	case l.CoolMin > l.CoolMax:
+		return errors.New( "coolMin is above coolMax" )
+	case int(l.HeatMin) + int(l.Deadband) > int(l.CoolMax):
+		return errors.New( "no cool setpoint fits heatMin plus the deadband" )
+	}
+	for _, m := range l.Modes {
+		if !slices.Contains( zoneModes, m ) {
+			return fmt.Errorf( "unknown mode %q", m )
+		}
+	}
+	for _, m := range l.FanModes {
+		if !slices.Contains( defaultLimits().FanModes, m ) {
+			return fmt.Errorf( "unknown fan mode %q", m )
+		}
+	}
+	return nil
+}	// validate
+
+// check returns a limitError when applying change to current would break a limit. current may be nil when
+// the thermostat has not been read yet, then the deadband is only checked when both setpoints are in change.
+func ( l zoneLimits ) check( current *infinity.TStatZoneConfig, change infinity.TStatZoneConfig ) error {
+	if change.Mode != "" && !slices.Contains( l.Modes, change.Mode ) {
+		return &limitError{ fmt.Sprintf( "mode %s is not allowed, allowed: %v", change.Mode, l.Modes ) }
+	}
+	if change.FanMode != "" && !slices.Contains( l.FanModes, change.FanMode ) {
+		return &limitError{ fmt.Sprintf( "fan mode %s is not allowed, allowed: %v", change.FanMode, l.FanModes ) }
+	}
+	if sp := change.HeatSetpoint; sp > 0 && ( sp < l.HeatMin || sp > l.HeatMax ) {
+		return &limitError{ fmt.Sprintf( "heat setpoint %d is outside %d to %d", sp, l.HeatMin, l.HeatMax ) }
+	}
+	if sp := change.CoolSetpoint; sp > 0 && ( sp < l.CoolMin || sp > l.CoolMax ) {
+		return &limitError{ fmt.Sprintf( "cool setpoint %d is outside %d to %d", sp, l.CoolMin, l.CoolMax ) }
+	}
+	if change.HeatSetpoint == 0 && change.CoolSetpoint == 0 {
+		return nil
+	}
+	heat, cool := change.HeatSetpoint, change.CoolSetpoint
+	if current != nil {
+		if heat == 0 {
+			heat = current.HeatSetpoint
+		}
+		if cool == 0 {
+			cool = current.CoolSetpoint
+		}
+	}
+	if heat > 0 && cool > 0 && int(cool) - int(heat) < int(l.Deadband) {
+		return &limitError{ fmt.Sprintf( "cool setpoint %d must be at least %d above heat setpoint %d", cool, l.Deadband, heat ) }
+	}
+	return nil
+}	// check
+
+// changeZoneConfig is the one way settings are changed: checked against the limits, written, and audited.
+func changeZoneConfig( api *infinity.Api, change infinity.TStatZoneConfig, by changeSource ) error {
+	current, ok := api.GetZoneConfig()
+	if !ok {
+		current = nil
+	}
+	err := limits.check( current, change )
+	if err == nil && !api.UpdateZoneConfig( change ) {
+		err = errUpdateFailed
+	}
+	auditChange( by, current, change, err )
+	return err
+}	// changeZoneConfig
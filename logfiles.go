@@ -0,0 +1,242 @@
+package main
+	// Log files kept by Infinitive itself, replacing the cron 4 purge and exit.
+	// A log file is rotated when it passes -logmaxmb or is older than -logmaxdays: renamed to NAME.YYYYMMDD-HHMMSS.mmm,
+	// then gzipped in the background. Rotated files older than -logkeepdays are removed. logs: in the config sets them too.
+	// A file's age counts from its newest rotation, so restarts don't reset it, a file with none is rotated when next written.
+	// SIGHUP reopens the files, for an outside logrotate that moved them.
+	//		infinitiveError.log		the logrus messages
+	//		infinitiveAccess.log	the web server requests, see server.go
+	// infinitiveOutput.log is systemd's, the standard output and error such as a panic, see infinitive.service.
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errorLogName	= "infinitiveError.log"
+var logStamp		= "20060102-150405.000"
+var logStampOld		= "20060102-150405"						// Rotations before milliseconds
+
+// A log file that rotates itself
+type rotatingLog struct {
+	mu				sync.Mutex
+	name			string
+	file			*os.File
+	size			int64
+	started			time.Time						// When the file was begun, zero when not known
+	retryAt			time.Time						// After a failed rotation
+}
+
+var openLogs	[]*rotatingLog
+var openLogsMu	sync.Mutex
+
+// openRotatingLog opens or creates a log file for appending.
+func openRotatingLog( name string ) ( *rotatingLog, error ) {
+	l := &rotatingLog{ name: name }
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	openLogsMu.Lock()
+	openLogs = append( openLogs, l )
+	openLogsMu.Unlock()
+	return l, nil
+}	// openRotatingLog
+
+// open opens the file, call with l.mu held. An empty file begins now, another one when it was last rotated.
+func ( l *rotatingLog ) open() error {
+	if err := os.MkdirAll( filepath.Dir(l.name), 0755 ); err != nil {
+		return err
+	}
+	f, err := os.OpenFile( l.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644 )
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size, l.started = f, info.Size(), time.Now()
+	if l.size > 0 {
+		l.started = newestRotation( l.name )
+	}
+	return nil
+}	// open
+
+func ( l *rotatingLog ) Write( p []byte ) ( int, error ) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	rotation := currentConfig().Logs			// Rotation settings can change on a config reload
+	maxBytes, maxAge := int64(rotation.MaxMB) << 20, time.Duration(rotation.MaxDays) * 24 * time.Hour
+	if l.size > 0 && ( l.size + int64(len(p)) > maxBytes || time.Since( l.started ) > maxAge ) && time.Now().After( l.retryAt ) {
+		if err := l.rotate(); err != nil {
+			l.retryAt = time.Now().Add( time.Minute )
+			fmt.Fprintln( os.Stderr, "log rotation of " + l.name + " failed:", err )
+		}
+	}
+	n, err := l.file.Write( p )
+	l.size += int64( n )
+	return n, err
+}	// Write
+
+// rotate renames the file and starts a new one, call with l.mu held. The open file is written until the new one opens.
+func ( l *rotatingLog ) rotate() error {
+	now := time.Now()
+	rotated := l.name + "." + now.Format( logStamp )
+	for fileExists( rotated ) || fileExists( rotated + ".gz" ) {			// Two rotations in one millisecond
+		now = now.Add( time.Millisecond )
+		rotated = l.name + "." + now.Format( logStamp )
+	}
+	if err := os.Rename( l.name, rotated ); err != nil {
+		return err
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		os.Rename( rotated, l.name )								// Back under its name, still the one written
+		return err
+	}
+	old.Close()
+	go compressLog( rotated, l.name )
+	return nil
+}	// rotate
+
+func fileExists( name string ) bool {
+	_, err := os.Stat( name )
+	return err == nil
+}	// fileExists
+
+// newestRotation is when the log was last rotated, zero when never.
+func newestRotation( name string ) time.Time {
+	var newest time.Time
+	rotations, _ := filepath.Glob( name + ".*" )
+	for _, r := range rotations {
+		if t, ok := rotationTime( name, r ); ok && t.After( newest ) {
+			newest = t
+		}
+	}
+	return newest
+}	// newestRotation
+
+// rotationTime reads the time from a rotated file's name.
+func rotationTime( name, rotated string ) ( time.Time, bool ) {
+	stamp := strings.TrimSuffix( strings.TrimPrefix(rotated, name + "."), ".gz" )
+	for _, layout := range []string{ logStamp, logStampOld } {
+		if t, err := time.ParseInLocation( layout, stamp, time.Local ); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}	// rotationTime
+
+// Reopen closes and opens the file again under its name.
+func ( l *rotatingLog ) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	return l.open()
+}	// Reopen
+
+func ( l *rotatingLog ) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}	// Close
+
+// compressLog gzips a rotated file and removes old rotations of the log.
+func compressLog( rotated, name string ) {
+	err := gzipFile( rotated )
+	if err != nil {
+		recorderLog.Error( "logs - compress failure: ", err )
+	}
+	pruneLogs( name, time.Now() )
+}	// compressLog
+
+func gzipFile( name string ) error {
+	in, err := os.Open( name )
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile( name + ".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644 )
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter( out )
+	_, err = io.Copy( zw, in )
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove( name + ".gz" )
+		return err
+	}
+	return os.Remove( name )
+}	// gzipFile
+
+// pruneLogs removes rotations of a log older than KeepDays.
+func pruneLogs( name string, now time.Time ) {
+	rotations, _ := filepath.Glob( name + ".*" )
+	for _, r := range rotations {
+		t, ok := rotationTime( name, r )
+		if !ok || now.Sub( t ) < time.Duration(currentConfig().Logs.KeepDays) * 24 * time.Hour {
+			continue
+		}
+		if err := os.Remove( r ); err != nil {
+			recorderLog.Error( "logs - remove failure: ", err )
+		}
+	}
+}	// pruneLogs
+
+// reopenLogs reopens every rotating log, on SIGHUP.
+func reopenLogs() {
+	openLogsMu.Lock()
+	defer openLogsMu.Unlock()
+	for _, l := range openLogs {
+		if err := l.Reopen(); err != nil {
+			fmt.Fprintln( os.Stderr, "log reopen of " + l.name + " failed:", err )
+		}
+	}
+	recorderLog.Info( "logs - reopened" )
+}	// reopenLogs
+
+// closeLogs closes every rotating log, the last thing before exit.
+func closeLogs() {
+	openLogsMu.Lock()
+	defer openLogsMu.Unlock()
+	for _, l := range openLogs {
+		l.Close()
+	}
+}	// closeLogs
+
+// ensureMonthDir sets monthDir for the day and makes the folder if needed, before the day's file is opened.
+func ensureMonthDir( day time.Time ) {
+	monthDir = fmt.Sprintf( "%04d-%02d/", day.Year(), day.Month() )
+	if _, err := os.Stat( filePath + monthDir ); err == nil {
+		return
+	}
+	if err := os.MkdirAll( filePath + monthDir, 0755 ); err != nil {
+		recorderLog.Error( "Create New Month folder FAILED:  " + filePath + monthDir + " ", err )
+		return
+	}
+	recorderLog.Info( "Create New Month folder created: " + filePath + monthDir )
+}	// ensureMonthDir
@@ -0,0 +1,261 @@
+package main
+	// Leveled logging by component, each with its own level, all to infinitiveError.log, see logfiles.go.
+	//		recorder	the 4 minute samples, daily files, month folders and log files
+	//		charts		daily and year charts, heatmaps, index pages and the analysis page
+	//		bus			the infinity package and the RS-485 bus, the logrus standard logger
+	//		api			the web server, sign in and the API
+	//		docs		the photo and document links and file serving
+	//		control		schedule, overrides, profiles, circulation, occupancy, recovery, calendar, limits, audit and config
+	// -loglevel or logs.level in the config sets them, "info" for all or "info,bus=error,charts=debug",
+	// bus is error unless set since it is noisy. A config reload sets them again, see config.go.
+	// -logformat is logfmt or text (key=value, the logrus text format) or json. Every entry has a component field.
+	// The last logRingSize entries are kept in memory for /debug/logs, which filters them by level, component and text.
+	//		GET /debug/logs				the page, refreshing itself
+	//		GET /debug/logs?format=json	the entries, ?level=warn&component=control&q=text&n=200
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var logRingSize	= 2000
+
+var logComponentNames	= []string{ "recorder", "charts", "bus", "api", "docs", "control" }
+
+// One logger per component, bus is the standard logger
+var (
+	recorderLog		= newComponentLog( "recorder" )
+	chartsLog		= newComponentLog( "charts" )
+	apiLog			= newComponentLog( "api" )
+	docsLog			= newComponentLog( "docs" )
+	controlLog		= newComponentLog( "control" )
+)
+
+var componentLoggers = map[string]*log.Logger{ "bus": log.StandardLogger() }
+
+func newComponentLog( name string ) *log.Entry {
+	l := log.New()
+	l.SetLevel( log.InfoLevel )
+	componentLoggers[name] = l
+	return l.WithField( "component", name )
+}	// newComponentLog
+
+// One kept entry
+type logRecord struct {
+	Time			time.Time		`json:"time"`
+	Level			string			`json:"level"`
+	Component		string			`json:"component"`
+	Message			string			`json:"msg"`
+	Fields			map[string]any	`json:"fields,omitempty"`
+	level			log.Level
+}
+
+// The ring buffer, a logrus hook on every logger
+type logRing struct {
+	mu				sync.Mutex
+	records			[]logRecord
+	next			int
+	full			bool
+}
+
+var recentLogs = &logRing{ records: make([]logRecord, logRingSize) }
+
+func ( r *logRing ) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func ( r *logRing ) Fire( e *log.Entry ) error {
+	rec := logRecord{ Time: e.Time, Level: e.Level.String(), Component: "bus", Message: e.Message, level: e.Level }
+	for k, v := range e.Data {
+		if k == "component" {
+			rec.Component = fmt.Sprint( v )
+			continue
+		}
+		if rec.Fields == nil {
+			rec.Fields = make( map[string]any )
+		}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		rec.Fields[k] = v
+	}
+	r.mu.Lock()
+	r.records[r.next] = rec
+	r.next = ( r.next + 1 ) % len( r.records )
+	r.full = r.full || r.next == 0
+	r.mu.Unlock()
+	return nil
+}	// Fire
+
+// filter returns the newest n entries at or above level, of component when set, holding q when set, newest first.
+func ( r *logRing ) filter( level log.Level, component, q string, n int ) []logRecord {
+	list := []logRecord{}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := r.next
+	if r.full {
+		count = len( r.records )
+	}
+	q = strings.ToLower( q )
+	for i := 1; i <= count && len(list) < n; i++ {
+		rec := r.records[( r.next - i + len(r.records) ) % len(r.records)]
+		if rec.level > level || ( component != "" && rec.Component != component ) {
+			continue
+		}
+		if q != "" && !strings.Contains( strings.ToLower(rec.Message + " " + fmt.Sprint(rec.Fields)), q ) {
+			continue
+		}
+		list = append( list, rec )
+	}
+	return list
+}	// filter
+
+// parseLogLevels reads -loglevel: a level for all, then component=level pairs.
+func parseLogLevels( spec string ) ( map[string]log.Level, error ) {
+	levels := map[string]log.Level{ "bus": log.ErrorLevel }
+	for _, name := range logComponentNames {
+		if name != "bus" {
+			levels[name] = log.InfoLevel
+		}
+	}
+	for _, part := range strings.Split( spec, "," ) {
+		part = strings.TrimSpace( part )
+		if part == "" {
+			continue
+		}
+		name, value, pair := strings.Cut( part, "=" )
+		if !pair {
+			value = name
+		}
+		level, err := log.ParseLevel( value )
+		if err != nil {
+			return nil, fmt.Errorf( "-loglevel %q: %w", part, err )
+		}
+		if !pair {
+			for n := range levels {
+				if n != "bus" {
+					levels[n] = level
+				}
+			}
+			continue
+		}
+		if _, ok := levels[name]; !ok {
+			return nil, fmt.Errorf( "-loglevel: unknown component %q, there are %s", name, strings.Join(logComponentNames, ", ") )
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}	// parseLogLevels
+
+// setupLogging sets the levels, format and output of every component, and hooks them to the ring buffer.
+func setupLogging( levelSpec, format string, out io.Writer ) error {
+	if err := setLogLevels( levelSpec, format ); err != nil {
+		return err
+	}
+	for _, l := range componentLoggers {
+		l.SetOutput( out )
+		l.AddHook( recentLogs )
+	}
+	return nil
+}	// setupLogging
+
+// setLogLevels sets the levels and format, again on a config reload.
+func setLogLevels( levelSpec, format string ) error {
+	levels, err := parseLogLevels( levelSpec )
+	if err != nil {
+		return err
+	}
+	var formatter log.Formatter
+	switch format {
+	case "logfmt", "text":
+		formatter = &log.TextFormatter{ DisableColors: true, FullTimestamp: true }
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return errors.New( "-logformat is logfmt, text or json" )
+	}
+	for name, l := range componentLoggers {
+		l.SetLevel( levels[name] )
+		l.SetFormatter( formatter )
+	}
+	return nil
+}	// setLogLevels
+
+// logLevels is each component's level, for the page.
+func logLevels() map[string]string {
+	levels := make( map[string]string )
+	for name, l := range componentLoggers {
+		levels[name] = l.GetLevel().String()
+	}
+	return levels
+}	// logLevels
+
+var logsTemplate = template.Must( template.New( "logs" ).Parse( `<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><title>Infinitive logs</title>
+<meta http-equiv="refresh" content="10">
+` + pageStyle + `<style>
+	table { border-collapse: collapse; font-family: monospace; font-size: 12px; }
+	td { padding: 1px 6px; vertical-align: top; }
+	.error, .fatal, .panic { color: #b00; } .warning { color: #a60; } .debug, .trace { color: #888; }
+</style></head><body>
+<h3>Infinitive logs</h3>
+<form method="get">
+	level <select name="level">{{ range .LevelNames }}<option{{ if eq . $.Level }} selected{{ end }}>{{ . }}</option>{{ end }}</select>
+	component <select name="component"><option value="">all</option>{{ range .Components }}<option{{ if eq . $.Component }} selected{{ end }}>{{ . }}</option>{{ end }}</select>
+	text <input name="q" value="{{ .Q }}"> <input type="submit" value="Filter">
+</form>
+<p>Levels: {{ range $name, $level := .Levels }}{{ $name }}={{ $level }} {{ end }}</p>
+<table>{{ range .Records }}
+<tr class="{{ .Level }}"><td>{{ .Time.Format "01-02 15:04:05" }}</td><td>{{ .Level }}</td><td>{{ .Component }}</td>
+<td>{{ .Message }}{{ range $k, $v := .Fields }} <i>{{ $k }}</i>={{ $v }}{{ end }}</td></tr>{{ end }}
+</table></body></html>
+` ) )
+
+// logsHandler serves /debug/logs.
+func logsHandler( w http.ResponseWriter, r *http.Request ) {
+	query := r.URL.Query()
+	level, err := log.ParseLevel( query.Get("level") )
+	if err != nil {
+		level = log.DebugLevel
+	}
+	n, err := strconv.Atoi( query.Get("n") )
+	if err != nil || n < 1 {
+		n = 500
+	}
+	records := recentLogs.filter( level, query.Get("component"), query.Get("q"), n )
+	if query.Get( "format" ) == "json" {
+		writeJSON( w, http.StatusOK, records )
+		return
+	}
+	components := append( []string{}, logComponentNames... )
+	sort.Strings( components )
+	names := []string{ "panic", "fatal", "error", "warning", "info", "debug", "trace" }
+	w.Header().Set( "Content-Type", "text/html; charset=utf-8" )
+	err = logsTemplate.Execute( w, map[string]any{ "Records": records, "Level": level.String(), "LevelNames": names,
+		"Component": query.Get("component"), "Components": components, "Q": query.Get("q"), "Levels": logLevels() } )
+	if err != nil {
+		apiLog.Error( "logsHandler - template failure: ", err )
+	}
+}	// logsHandler
+
+// setupErrorLog sends every component to logPath+errorLogName, stderr stays for panics and systemd.
+func setupErrorLog( levelSpec, format string ) error {
+	var out io.Writer = os.Stderr
+	if l, err := openRotatingLog( logPath + errorLogName ); err == nil {
+		out = l
+	} else {
+		fmt.Fprintln( os.Stderr, "logs - " + errorLogName + " not available, using stderr:", err )
+	}
+	return setupLogging( levelSpec, format, out )
+}	// setupErrorLog
@@ -0,0 +1,276 @@
+package main
+	// Occupancy, home/away reports per person from phones, a router script or an alarm panel, kept in
+	// filePath+occupancyFileName with the settings.
+	//		{ "enabled": true, "awayProfile": "away", "homeProfile": "home", "awayDelayMinutes": 15, "homeDelayMinutes": 0 }
+	// When everyone has been away for awayDelayMinutes the away profile is entered, when the first person has been
+	// home for homeDelayMinutes the home profile is entered again, only when it was us that left it. Vacation and
+	// profiles entered by hand are left alone. Reports and switches are audit log events, and so marks on the daily chart.
+	//		POST /api/occupancy/{person}	{ "state": "away" } or ?state=away, needs an API token of the presence role
+	//		GET  /api/occupancy				settings and everyone's state
+	//		PUT  /api/occupancy				replace the settings
+	// From a script:
+	//		curl -X POST -H "Authorization: Bearer inf_..." "http://host:8080/api/occupancy/alice?state=away"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+)
+
+var occupancyFileName	= "infinitiveOccupancy.json"
+var occupancyTick		= 30 * time.Second
+var personName			= regexp.MustCompile( `^[A-Za-z0-9_-]{1,32}$` )
+
+// One person's last report
+type presence struct {
+	State			string		`json:"state"`				// home or away
+	Since			time.Time	`json:"since"`
+}
+
+// The occupancy file
+type occupancyState struct {
+	Enabled			bool					`json:"enabled"`
+	AwayProfile		string					`json:"awayProfile"`
+	HomeProfile		string					`json:"homeProfile"`
+	AwayDelay		int						`json:"awayDelayMinutes"`
+	HomeDelay		int						`json:"homeDelayMinutes"`
+	People			map[string]presence		`json:"people"`
+	SetAway			bool					`json:"setAway"`			// We entered the away profile, so we may leave it
+}
+
+// The occupancy engine
+type occupancyWatcher struct {
+	mu				sync.Mutex
+	api				*infinity.Api
+	file			string
+	state			occupancyState
+}
+
+var occupancyEngine *occupancyWatcher
+
+// newOccupancyWatcher loads the occupancy file, a missing file is occupancy off.
+func newOccupancyWatcher( api *infinity.Api ) ( *occupancyWatcher, error ) {
+	o := &occupancyWatcher{ api: api, file: filePath + occupancyFileName, state: occupancyState{
+		AwayProfile: "away", HomeProfile: homeProfile, AwayDelay: 15, People: make(map[string]presence) } }
+	data, err := os.ReadFile( o.file )
+	if errors.Is( err, os.ErrNotExist ) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal( data, &o.state ); err != nil {
+		return nil, fmt.Errorf( "%s: %w", o.file, err )
+	}
+	if o.state.People == nil {
+		o.state.People = make( map[string]presence )
+	}
+	if err = o.state.validate(); err != nil {
+		return nil, fmt.Errorf( "%s: %w", o.file, err )
+	}
+	return o, nil
+}	// newOccupancyWatcher
+
+// validate checks the settings, the profiles must exist and not be vacation.
+func ( st occupancyState ) validate() error {
+	switch {
+	case st.AwayDelay < 0 || st.AwayDelay > 24*60 || st.HomeDelay < 0 || st.HomeDelay > 24*60:
+		return errors.New( "delays are 0 to 1440 minutes" )
+	case st.AwayProfile == st.HomeProfile:
+		return errors.New( "awayProfile and homeProfile must differ" )
+	case st.AwayProfile == vacationProfile || st.HomeProfile == vacationProfile:
+		return errors.New( "vacation is set by its dates, not by occupancy" )
+	}
+	if profileEngine != nil {
+		profiles := profileEngine.snapshot().Profiles
+		for _, name := range []string{ st.AwayProfile, st.HomeProfile } {
+			if _, ok := profiles[name]; !ok {
+				return fmt.Errorf( "no profile %s, there are %v", name, profileNames(profiles) )
+			}
+		}
+	}
+	return nil
+}	// validate
+
+// save writes the occupancy file, call with o.mu held.
+func ( o *occupancyWatcher ) save() {
+	data, err := json.MarshalIndent( o.state, "", "\t" )
+	if err == nil {
+		tmp := filepath.Join( filepath.Dir(o.file), ".occupancy.tmp" )
+		if err = os.WriteFile( tmp, append(data, '\n'), 0644 ); err == nil {
+			err = os.Rename( tmp, o.file )
+		}
+	}
+	if err != nil {
+		controlLog.Error( "occupancy - save failure: ", err )
+	}
+}	// save
+
+// report records one person's state, a repeat of the same state keeps the first time.
+func ( o *occupancyWatcher ) report( name, state string, by changeSource ) {
+	o.mu.Lock()
+	p, known := o.state.People[name]
+	changed := !known || p.State != state
+	if changed {
+		o.state.People[name] = presence{ State: state, Since: time.Now() }
+		o.save()
+	}
+	o.mu.Unlock()
+	if changed {
+		controlLog.Info( "occupancy - " + name + " is " + state )
+		writeAudit( auditEntry{ Time: time.Now(), changeSource: by, Event: "presence " + name + " " + state, Result: "ok" } )
+		go o.tick( time.Now() )
+	}
+}	// report
+
+// run switches profiles as people come and go.
+func ( o *occupancyWatcher ) run( ctx context.Context ) {
+	for {
+		o.tick( time.Now() )
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After( occupancyTick ):
+		}
+	}
+}	// run
+
+func ( o *occupancyWatcher ) tick( now time.Time ) {
+	var enter string
+
+	o.mu.Lock()
+	st := o.state
+	allAway, lastLeft, firstHome := len( st.People ) > 0, time.Time{}, time.Time{}
+	for _, p := range st.People {
+		switch p.State {
+		case "home":
+			allAway = false
+			if firstHome.IsZero() || p.Since.Before( firstHome ) {
+				firstHome = p.Since
+			}
+		default:
+			if p.Since.After( lastLeft ) {
+				lastLeft = p.Since
+			}
+		}
+	}
+	o.mu.Unlock()
+	if !st.Enabled || profileEngine == nil {
+		return
+	}
+	active := profileEngine.snapshot().Active
+	switch {
+	case allAway && !st.SetAway && active == st.HomeProfile && !now.Before( lastLeft.Add(time.Duration(st.AwayDelay)*time.Minute) ):
+		enter = st.AwayProfile
+	case !allAway && st.SetAway && active == st.AwayProfile && !now.Before( firstHome.Add(time.Duration(st.HomeDelay)*time.Minute) ):
+		enter = st.HomeProfile
+	case st.SetAway && active != st.AwayProfile:
+		o.setAway( false )							// Someone switched by hand or vacation started, not ours to undo
+		return
+	default:
+		return
+	}
+	controlLog.Info( "occupancy - entering " + enter )
+	if err := profileEngine.enter( enter, changeSource{ Source: "occupancy" } ); err != nil {
+		controlLog.Error( "occupancy - " + enter + " not applied: ", err )
+		if errors.Is( err, errUpdateFailed ) {
+			return										// Tried again on the next tick
+		}
+	}
+	o.setAway( enter == st.AwayProfile )
+}	// tick
+
+func ( o *occupancyWatcher ) setAway( away bool ) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.state.SetAway != away {
+		o.state.SetAway = away
+		o.save()
+	}
+}	// setAway
+
+// snapshot is a copy of the state for the API.
+func ( o *occupancyWatcher ) snapshot() occupancyState {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	st := o.state
+	st.People = make( map[string]presence, len(o.state.People) )
+	for name, p := range o.state.People {
+		st.People[name] = p
+	}
+	return st
+}	// snapshot
+
+// occupancyNames lists the people reporting, for the log.
+func occupancyNames( people map[string]presence ) []string {
+	names := make( []string, 0, len(people) )
+	for name := range people {
+		names = append( names, name )
+	}
+	sort.Strings( names )
+	return names
+}	// occupancyNames
+
+// mountOccupancyAPI adds the presence webhook to mux, which only takes API tokens, and the occupancy handlers to apiMux.
+func mountOccupancyAPI( mux, apiMux *http.ServeMux, auth *authenticator, o *occupancyWatcher ) {
+	mux.Handle( "POST /api/occupancy/{person}", auth.requireToken( rolePresence, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			State		string		`json:"state"`
+		}
+		name  := r.PathValue( "person" )
+		state := r.URL.Query().Get( "state" )
+		if state == "" {
+			if err := json.NewDecoder( r.Body ).Decode( &body ); err != nil {
+				writeError( w, http.StatusBadRequest, "invalid report, send { \"state\": \"home\" } or ?state=home" )
+				return
+			}
+			state = body.State
+		}
+		switch {
+		case !personName.MatchString( name ):
+			writeError( w, http.StatusBadRequest, "person is 1 to 32 letters, digits, - or _" )
+			return
+		case state != "home" && state != "away":
+			writeError( w, http.StatusBadRequest, "state is home or away" )
+			return
+		}
+		by := requestSource( r )
+		by.Source = "occupancy"
+		o.report( name, state, by )
+		writeJSON( w, http.StatusOK, o.snapshot() )
+	})) )
+
+	apiMux.HandleFunc( "GET /api/occupancy", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON( w, http.StatusOK, o.snapshot() )
+	} )
+
+	apiMux.HandleFunc( "PUT /api/occupancy", func(w http.ResponseWriter, r *http.Request) {
+		var body occupancyState
+		if err := json.NewDecoder( r.Body ).Decode( &body ); err != nil {
+			writeError( w, http.StatusBadRequest, "invalid occupancy: " + err.Error() )
+			return
+		}
+		if err := body.validate(); err != nil {
+			writeError( w, http.StatusUnprocessableEntity, err.Error() )
+			return
+		}
+		o.mu.Lock()
+		body.People, body.SetAway = o.state.People, o.state.SetAway		// Reported, not set
+		o.state = body
+		o.save()
+		o.mu.Unlock()
+		controlLog.Info( "occupancy - settings saved, people ", occupancyNames(body.People) )
+		go o.tick( time.Now() )
+		writeJSON( w, http.StatusOK, o.snapshot() )
+	} )
+}	// mountOccupancyAPI
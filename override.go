@@ -0,0 +1,280 @@
+package main
+	// Temporary overrides, settings that revert by themselves, kept in filePath+overrideFileName so they survive restarts.
+	//		POST   /api/override		{ "heatSetpoint": 72, "hours": 3 } or { ..., "until": "2026-10-19T23:00:00-04:00" }
+	//									optional "restore": "previous" or "schedule", default schedule when it is on, previous outside home
+	//		GET    /api/override		the override in effect, null when none
+	//		DELETE /api/override		revert now
+	// The override turns hold on, so the thermostat's own program leaves it alone, and the schedule waits until it ends.
+	// At the end the previous settings, hold included, are put back, or the current schedule period is applied, in the home profile only.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+)
+
+var overrideFileName	= "infinitiveOverride.json"
+var overrideTick		= 15 * time.Second
+var overrideMaxHours	= 24.0 * 14
+
+// POST /api/override body
+type overrideRequest struct {
+	HeatSetpoint	uint8		`json:"heatSetpoint"`
+	CoolSetpoint	uint8		`json:"coolSetpoint"`
+	FanMode			string		`json:"fanMode"`
+	Mode			string		`json:"mode"`
+	Hours			float64		`json:"hours"`
+	Until			*time.Time	`json:"until"`
+	Restore			string		`json:"restore"`
+}
+
+// The override in effect
+type zoneOverride struct {
+	Change			zoneSettings	`json:"change"`			// Zero fields are not changed
+	Previous		zoneSettings	`json:"previous"`
+	Restore			string			`json:"restore"`			// previous or schedule
+	Started			time.Time		`json:"started"`
+	Until			time.Time		`json:"until"`
+	User			string			`json:"user,omitempty"`
+	Remaining		int64			`json:"remaining"`			// Seconds, for the UI countdown
+}
+
+// The override engine
+type overrider struct {
+	mu				sync.Mutex
+	api				*infinity.Api
+	file			string
+	current			*zoneOverride
+}
+
+var overrideEngine *overrider
+
+// newOverrider loads a pending override, one that ended while stopped is reverted on the first tick.
+func newOverrider( api *infinity.Api ) *overrider {
+	o := &overrider{ api: api, file: filePath + overrideFileName }
+	data, err := os.ReadFile( o.file )
+	if err != nil {
+		return o
+	}
+	var ov zoneOverride
+	if err = json.Unmarshal( data, &ov ); err != nil {
+		controlLog.Warn( "override - ignoring unreadable " + o.file + " ", err )
+		return o
+	}
+	o.current = &ov
+	return o
+}	// newOverrider
+
+// save writes or removes the override file, call with o.mu held.
+func ( o *overrider ) save() {
+	var err error
+
+	if o.current == nil {
+		err = os.Remove( o.file )
+		if errors.Is( err, os.ErrNotExist ) {
+			err = nil
+		}
+	} else {
+		var data []byte
+		if data, err = json.MarshalIndent( o.current, "", "\t" ); err == nil {
+			tmp := filepath.Join( filepath.Dir(o.file), ".override.tmp" )
+			if err = os.WriteFile( tmp, data, 0644 ); err == nil {
+				err = os.Rename( tmp, o.file )
+			}
+		}
+	}
+	if err != nil {
+		controlLog.Error( "override - save failure: ", err )
+	}
+}	// save
+
+// active is true while an override is in effect, the schedule does nothing then.
+func ( o *overrider ) active() bool {
+	if o == nil {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.current != nil
+}	// active
+
+// get returns a copy of the override with the seconds left, nil when none.
+func ( o *overrider ) get() *zoneOverride {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.current == nil {
+		return nil
+	}
+	ov := *o.current
+	ov.Remaining = int64( time.Until(ov.Until).Seconds() )
+	if ov.Remaining < 0 {
+		ov.Remaining = 0
+	}
+	return &ov
+}	// get
+
+// changeOf turns settings into a config change, zero fields stay unchanged.
+func changeOf( s zoneSettings, hold bool ) infinity.TStatZoneConfig {
+	return infinity.TStatZoneConfig{ Mode: s.Mode, FanMode: s.FanMode, HeatSetpoint: s.HeatSetpoint, CoolSetpoint: s.CoolSetpoint, Hold: &hold }
+}
+
+// start applies an override, replacing any override in effect but keeping its previous settings.
+func ( o *overrider ) start( req overrideRequest, by changeSource ) ( *zoneOverride, int, error ) {
+	now := time.Now()
+	ov  := zoneOverride{ Change: zoneSettings{ Mode: req.Mode, FanMode: req.FanMode, HeatSetpoint: req.HeatSetpoint, CoolSetpoint: req.CoolSetpoint },
+		Restore: req.Restore, Started: now, User: by.User }
+	switch {
+	case req.Until != nil:
+		ov.Until = *req.Until
+	case req.Hours > 0 && req.Hours <= overrideMaxHours:
+		ov.Until = now.Add( time.Duration(req.Hours * float64(time.Hour)) )
+	default:
+		return nil, http.StatusBadRequest, errors.New( "hours (up to two weeks) or until is needed" )
+	}
+	if !ov.Until.After( now ) || ov.Until.Sub( now ).Hours() > overrideMaxHours {
+		return nil, http.StatusBadRequest, errors.New( "until must be in the next two weeks" )
+	}
+	if ov.Change == (zoneSettings{}) {
+		return nil, http.StatusBadRequest, errors.New( "nothing to override" )
+	}
+	switch ov.Restore {
+	case "":
+		ov.Restore = "previous"
+		if scheduleEngine != nil && scheduleEngine.enabled() && profileEngine.scheduleAllowed() {
+			ov.Restore = "schedule"
+		}
+	case "previous", "schedule":
+	default:
+		return nil, http.StatusBadRequest, errors.New( "restore is previous or schedule" )
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.current != nil {
+		ov.Previous = o.current.Previous
+	} else if cfg, ok := o.api.GetZoneConfig(); ok && cfg != nil {
+		ov.Previous = settingsOf( cfg )
+		ov.Previous.FanMode = circulationEngine.fanSetting( cfg )	// Not circulation's speed
+	} else {
+		return nil, http.StatusServiceUnavailable, errors.New( "thermostat config not available yet" )
+	}
+	if err := changeZoneConfig( o.api, changeOf(ov.Change, true), by ); err != nil {
+		if errors.Is( err, errUpdateFailed ) {
+			return nil, http.StatusBadGateway, err
+		}
+		return nil, http.StatusUnprocessableEntity, err
+	}
+	o.current = &ov
+	o.save()
+	return &ov, http.StatusOK, nil
+}	// start
+
+// end reverts the override now. The override stays until the revert is written, a failed write is tried
+// again on the next tick, a revert the limits refuse is given up.
+func ( o *overrider ) end( by changeSource ) error {
+	o.mu.Lock()
+	ov := o.current
+	o.mu.Unlock()
+	if ov == nil {
+		return nil
+	}
+	toSchedule := ov.Restore == "schedule" && scheduleEngine != nil && scheduleEngine.enabled() && profileEngine.scheduleAllowed()
+	var err error
+	if toSchedule {
+		err = changeZoneConfig( o.api, infinity.TStatZoneConfig{ Hold: &ov.Previous.Hold }, by )
+	} else {
+		err = changeZoneConfig( o.api, changeOf(ov.Previous, ov.Previous.Hold), by )
+	}
+	o.mu.Lock()
+	if o.current != ov {
+		o.mu.Unlock()										// Replaced or discarded meanwhile
+		return err
+	}
+	if errors.Is( err, errUpdateFailed ) {
+		controlLog.Error( "override - not reverted, trying again: ", err )
+		o.current.Until = time.Now()						// Due, so run tries again
+		o.save()
+		o.mu.Unlock()
+		return err
+	}
+	if err != nil {
+		controlLog.Error( "override - previous settings refused, override dropped: ", err )
+	}
+	o.current = nil
+	o.save()
+	o.mu.Unlock()
+	if toSchedule {
+		scheduleEngine.reapply()							// Not before the override is gone, the schedule waits for it
+	}
+	return err
+}	// end
+
+// discard drops the override without reverting, entering a profile replaces it.
+func ( o *overrider ) discard() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.current != nil {
+		o.current = nil
+		o.save()
+	}
+}	// discard
+
+// run ends the override when its time is up.
+func ( o *overrider ) run( ctx context.Context ) {
+	for {
+		o.mu.Lock()
+		due := o.current != nil && !time.Now().Before( o.current.Until )
+		o.mu.Unlock()
+		if due {
+			controlLog.Info( "override - time is up, reverting" )
+			o.end( changeSource{ Source: "override" } )
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After( overrideTick ):
+		}
+	}
+}	// run
+
+// mountOverrideAPI adds the override handlers to mux.
+func mountOverrideAPI( mux *http.ServeMux, o *overrider ) {
+	mux.HandleFunc( "GET /api/override", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON( w, http.StatusOK, o.get() )
+	} )
+
+	mux.HandleFunc( "POST /api/override", func(w http.ResponseWriter, r *http.Request) {
+		var req overrideRequest
+		if err := json.NewDecoder( r.Body ).Decode( &req ); err != nil {
+			writeError( w, http.StatusBadRequest, "invalid override: " + err.Error() )
+			return
+		}
+		by := requestSource( r )
+		by.Source = "override"
+		if _, status, err := o.start( req, by ); err != nil {
+			writeError( w, status, err.Error() )
+			return
+		}
+		writeJSON( w, http.StatusOK, o.get() )
+	} )
+
+	mux.HandleFunc( "DELETE /api/override", func(w http.ResponseWriter, r *http.Request) {
+		by := requestSource( r )
+		by.Source = "override"
+		if err := o.end( by ); errors.Is( err, errUpdateFailed ) {
+			writeError( w, http.StatusBadGateway, err.Error() )
+			return
+		}
+		writeJSON( w, http.StatusOK, o.get() )
+	} )
+}	// mountOverrideAPI
@@ -0,0 +1,332 @@
+package main
+	// Named profiles, each a full set of mode, fan mode, hold and setpoints, kept in filePath+profilesFileName.
+	//		{ "profiles": { "home": { "mode": "auto", "fanMode": "auto", "hold": false, "heatSetpoint": 68, "coolSetpoint": 76 }, ... },
+	//		  "active": "home",
+	//		  "vacation": { "start": "2026-12-20T08:00:00-05:00", "end": "2026-12-28T12:00:00-05:00", "returnTo": "home" } }
+	// The schedule only runs in the home profile, entering home with the schedule on applies its current period.
+	// Entering a profile ends a temporary override without reverting it. Profiles are checked against the limits when
+	// saved and again when applied. Every switch is an audit log event, and so a mark on the daily chart.
+	//		GET    /api/profiles			profiles, the active one and the vacation dates
+	//		PUT    /api/profiles			replace the profiles, { "profiles": { ... } }
+	//		POST   /api/profile/{name}		switch now
+	//		POST   /api/vacation			{ "start": ..., "end": ..., "returnTo": "home" }, vacation between the dates
+	//		DELETE /api/vacation			cancel the dates, leaving vacation now when in it
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+)
+
+var profilesFileName	= "infinitiveProfiles.json"
+var profileTick			= 30 * time.Second
+var homeProfile			= "home"
+var vacationProfile		= "vacation"
+
+// Vacation dates
+type vacationPlan struct {
+	Start			time.Time		`json:"start"`
+	End				time.Time		`json:"end"`
+	ReturnTo		string			`json:"returnTo"`
+	Entered			bool			`json:"entered"`			// Entered once, leaving early does not enter again
+}
+
+// The profiles file
+type profileState struct {
+	Profiles		map[string]zoneSettings		`json:"profiles"`
+	Active			string						`json:"active"`
+	Vacation		*vacationPlan				`json:"vacation,omitempty"`
+}
+
+// The profile switcher
+type profileSwitcher struct {
+	mu				sync.Mutex
+	api				*infinity.Api
+	file			string
+	state			profileState
+}
+
+var profileEngine *profileSwitcher
+
+// Inside the default limits, with hold on away from home so the thermostat's program stays out of it
+func defaultProfiles() map[string]zoneSettings {
+	return map[string]zoneSettings{
+		"home":		{ Mode: "auto", FanMode: "auto", Hold: false, HeatSetpoint: 68, CoolSetpoint: 76 },
+		"away":		{ Mode: "auto", FanMode: "auto", Hold: true,  HeatSetpoint: 64, CoolSetpoint: 78 },
+		"vacation":	{ Mode: "auto", FanMode: "auto", Hold: true,  HeatSetpoint: 64, CoolSetpoint: 78 },
+		"sleep":	{ Mode: "auto", FanMode: "auto", Hold: true,  HeatSetpoint: 66, CoolSetpoint: 76 },
+	}
+}
+
+// newProfileSwitcher loads the profiles file, a missing file has the default profiles with home active.
+func newProfileSwitcher( api *infinity.Api ) ( *profileSwitcher, error ) {
+	p := &profileSwitcher{ api: api, file: filePath + profilesFileName,
+		state: profileState{ Profiles: defaultProfiles(), Active: homeProfile } }
+	data, err := os.ReadFile( p.file )
+	if errors.Is( err, os.ErrNotExist ) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal( data, &p.state ); err != nil {
+		return nil, fmt.Errorf( "%s: %w", p.file, err )
+	}
+	if err = validateProfiles( p.state.Profiles ); err != nil {
+		return nil, fmt.Errorf( "%s: %w", p.file, err )
+	}
+	return p, nil
+}	// newProfileSwitcher
+
+// validateProfiles needs home and vacation, and every profile inside the limits.
+func validateProfiles( profiles map[string]zoneSettings ) error {
+	for _, name := range []string{ homeProfile, vacationProfile } {
+		if _, ok := profiles[name]; !ok {
+			return fmt.Errorf( "profile %s is needed", name )
+		}
+	}
+	for name, s := range profiles {
+		if err := limits.check( nil, changeOf(s, s.Hold) ); err != nil {
+			return fmt.Errorf( "profile %s: %w", name, err )
+		}
+	}
+	return nil
+}	// validateProfiles
+
+// save writes the profiles file, call with p.mu held.
+func ( p *profileSwitcher ) save() error {
+	data, err := json.MarshalIndent( p.state, "", "\t" )
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join( filepath.Dir(p.file), ".profiles.tmp" )
+	if err = os.WriteFile( tmp, append(data, '\n'), 0644 ); err != nil {
+		return err
+	}
+	return os.Rename( tmp, p.file )
+}	// save
+
+// scheduleAllowed is true in the home profile, the only one the schedule runs in.
+func ( p *profileSwitcher ) scheduleAllowed() bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state.Active == homeProfile
+}	// scheduleAllowed
+
+// enter switches to the named profile: applies the settings, then ends any override and records the event.
+// A profile whose settings are not written is not entered. Home with the schedule on is the schedule's to apply.
+func ( p *profileSwitcher ) enter( name string, by changeSource ) error {
+	p.mu.Lock()
+	settings, ok := p.state.Profiles[name]
+	from := p.state.Active
+	p.mu.Unlock()
+	if !ok {
+		return &limitError{ fmt.Sprintf( "no profile %s", name ) }
+	}
+
+	toSchedule := name == homeProfile && scheduleEngine != nil && scheduleEngine.enabled()
+	var err error
+	if !toSchedule {
+		err = changeZoneConfig( p.api, changeOf(settings, settings.Hold), by )
+	}
+	e := auditEntry{ Time: time.Now(), changeSource: by, Event: "profile " + from + ">" + name, New: settings, Result: "ok" }
+	if err != nil {
+		e.Result, e.Error = "failed", err.Error()
+		writeAudit( e )
+		return err
+	}
+	p.mu.Lock()
+	p.state.Active = name
+	if err := p.save(); err != nil {
+		controlLog.Error( "profiles - save failure: ", err )
+	}
+	p.mu.Unlock()
+	writeAudit( e )
+	overrideEngine.discard()
+	if toSchedule {
+		scheduleEngine.reapply()							// After Active, the schedule only runs at home
+	}
+	return nil
+}	// enter
+
+// run enters and leaves vacation on its dates.
+func ( p *profileSwitcher ) run( ctx context.Context ) {
+	for {
+		p.tick( time.Now() )
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After( profileTick ):
+		}
+	}
+}	// run
+
+func ( p *profileSwitcher ) tick( now time.Time ) {
+	var enter string
+
+	p.mu.Lock()
+	v := p.state.Vacation
+	switch {
+	case v == nil:
+	case !now.Before( v.End ):
+		if p.state.Active == vacationProfile {
+			enter = v.ReturnTo
+		}
+		p.state.Vacation = nil
+		p.save()
+	case !now.Before( v.Start ) && !v.Entered:
+		v.Entered = true
+		enter = vacationProfile
+		p.save()
+	}
+	p.mu.Unlock()
+	if enter != "" {
+		controlLog.Info( "profiles - vacation dates, entering " + enter )
+		err := p.enter( enter, changeSource{ Source: "profile" } )
+		if err != nil && !errors.Is( err, errUpdateFailed ) {
+			controlLog.Error( "profiles - " + enter + " refused: ", err )
+		}
+		if errors.Is( err, errUpdateFailed ) {
+			controlLog.Error( "profiles - " + enter + " not applied, trying again: ", err )
+			p.mu.Lock()
+			if p.state.Vacation == nil || p.state.Vacation == v {		// Not changed meanwhile, the next tick tries again
+				v.Entered = enter != vacationProfile
+				p.state.Vacation = v
+				p.save()
+			}
+			p.mu.Unlock()
+		}
+	}
+}	// tick
+
+func ( p *profileSwitcher ) snapshot() profileState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.state
+	if st.Vacation != nil {
+		v := *st.Vacation
+		st.Vacation = &v
+	}
+	return st
+}	// snapshot
+
+// profileNames lists the profiles, for error messages.
+func profileNames( profiles map[string]zoneSettings ) []string {
+	names := make( []string, 0, len(profiles) )
+	for name := range profiles {
+		names = append( names, name )
+	}
+	sort.Strings( names )
+	return names
+}	// profileNames
+
+// mountProfileAPI adds the profile and vacation handlers to mux.
+func mountProfileAPI( mux *http.ServeMux, p *profileSwitcher ) {
+	mux.HandleFunc( "GET /api/profiles", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON( w, http.StatusOK, p.snapshot() )
+	} )
+
+	mux.HandleFunc( "PUT /api/profiles", func(w http.ResponseWriter, r *http.Request) {
+		var body profileState
+		if err := json.NewDecoder( r.Body ).Decode( &body ); err != nil {
+			writeError( w, http.StatusBadRequest, "invalid profiles: " + err.Error() )
+			return
+		}
+		if err := validateProfiles( body.Profiles ); err != nil {
+			writeError( w, http.StatusUnprocessableEntity, err.Error() )
+			return
+		}
+		p.mu.Lock()
+		if _, ok := body.Profiles[p.state.Active]; !ok {
+			p.mu.Unlock()
+			writeError( w, http.StatusUnprocessableEntity, "the active profile " + p.state.Active + " can't be removed" )
+			return
+		}
+		p.state.Profiles = body.Profiles
+		err := p.save()
+		p.mu.Unlock()
+		if err != nil {
+			writeError( w, http.StatusInternalServerError, "profiles not saved: " + err.Error() )
+			return
+		}
+		writeJSON( w, http.StatusOK, p.snapshot() )
+	} )
+
+	mux.HandleFunc( "POST /api/profile/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue( "name" )
+		if _, ok := p.snapshot().Profiles[name]; !ok {
+			writeError( w, http.StatusNotFound, fmt.Sprintf( "no profile %s, there are %v", name, profileNames(p.snapshot().Profiles) ) )
+			return
+		}
+		by := requestSource( r )
+		by.Source = "profile"
+		if err := p.enter( name, by ); err != nil {
+			writeChangeError( w, err )
+			return
+		}
+		writeJSON( w, http.StatusOK, p.snapshot() )
+	} )
+
+	mux.HandleFunc( "POST /api/vacation", func(w http.ResponseWriter, r *http.Request) {
+		var plan vacationPlan
+		if err := json.NewDecoder( r.Body ).Decode( &plan ); err != nil {
+			writeError( w, http.StatusBadRequest, "invalid vacation: " + err.Error() )
+			return
+		}
+		if plan.ReturnTo == "" {
+			plan.ReturnTo = homeProfile
+		}
+		plan.Entered = false
+		p.mu.Lock()
+		_, known := p.state.Profiles[plan.ReturnTo]
+		switch {
+		case !plan.End.After( plan.Start ) || !plan.End.After( time.Now() ):
+			p.mu.Unlock()
+			writeError( w, http.StatusBadRequest, "end must be after start and in the future" )
+			return
+		case !known || plan.ReturnTo == vacationProfile:
+			p.mu.Unlock()
+			writeError( w, http.StatusBadRequest, "returnTo must be another profile" )
+			return
+		}
+		p.state.Vacation = &plan
+		err := p.save()
+		p.mu.Unlock()
+		if err != nil {
+			writeError( w, http.StatusInternalServerError, "vacation not saved: " + err.Error() )
+			return
+		}
+		p.tick( time.Now() )						// Enters now when start is past
+		writeJSON( w, http.StatusOK, p.snapshot() )
+	} )
+
+	mux.HandleFunc( "DELETE /api/vacation", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		v := p.state.Vacation
+		p.state.Vacation = nil
+		p.save()
+		inVacation := p.state.Active == vacationProfile
+		p.mu.Unlock()
+		if v != nil && inVacation {
+			by := requestSource( r )
+			by.Source = "profile"
+			if err := p.enter( v.ReturnTo, by ); err != nil {
+				writeChangeError( w, err )
+				return
+			}
+		}
+		writeJSON( w, http.StatusOK, p.snapshot() )
+	} )
+}	// mountProfileAPI
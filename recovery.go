@@ -0,0 +1,340 @@
+package main
+	// Adaptive recovery, learns how fast the house heats and cools from the stored samples so the schedule can start
+	// a warmer or cooler period early enough to be there at its start time, see schedule.go.
+	// A recovery run is a stretch of samples with the blower on for heating or cooling, starting at least
+	// recoveryMinGap degrees from the setpoint and ending at the setpoint or when the blower stops.
+	// Rates are degrees per hour for heat or cool, the highest stage seen in the run and the outdoor temperature in
+	// recoveryOutdoorBin degree bins, relearned every day from the last recoveryLearnDays days.
+	// A bin needs recoveryMinRuns runs before it is used, otherwise the bins next to it are tried, otherwise no early start.
+	// A prediction uses the rate of the stage the system recovered with most in the bin, stages are never pooled.
+	// Every early start is logged with its predicted arrival, then the actual arrival, in filePath+recoveryFileName.
+	//		GET /api/recovery		the learned rates, the recovery in progress and the recent predictions
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+)
+
+var recoveryFileName	= "infinitiveRecovery.jsonl"
+var recoveryLearnDays	= 60
+var recoveryOutdoorBin	= 10
+var recoveryMinGap		= 2
+var recoveryMinRuns		= 3
+var recoveryMaxLead		= 3 * time.Hour
+var recoveryTick		= time.Minute
+
+// Learned rate of one mode, stage and outdoor bin
+type recoveryRate struct {
+	Mode			string		`json:"mode"`				// heat or cool
+	Stage			int			`json:"stage"`				// -1 for runs from before the stage was recorded
+	Outdoor			int			`json:"outdoor"`			// Low end of the bin
+	Degrees			float64		`json:"degrees"`
+	Hours			float64		`json:"hours"`
+	Runs			int			`json:"runs"`
+	Rate			float64		`json:"rate"`				// Degrees per hour
+}
+
+// One early start, with how it turned out
+type recoveryPrediction struct {
+	Period			time.Time	`json:"period"`				// Start of the schedule period
+	Started			time.Time	`json:"started"`
+	Mode			string		`json:"mode"`
+	StartTemp		int			`json:"startTemp"`
+	Target			int			`json:"target"`
+	Outdoor			int			`json:"outdoor"`
+	Stage			int			`json:"stage"`					// Stage of the rate, the one most used there
+	Rate			float64		`json:"rate"`
+	Predicted		time.Time	`json:"predicted"`
+	Arrived			*time.Time	`json:"arrived,omitempty"`
+	ErrorMinutes	float64		`json:"errorMinutes"`			// Arrived after predicted is positive
+	Result			string		`json:"result,omitempty"`		// arrived, missed or interrupted
+}
+
+// The recovery engine
+type recoveryLearner struct {
+	mu				sync.Mutex
+	api				*infinity.Api
+	learned			time.Time
+	rates			[]recoveryRate
+	open			*recoveryPrediction
+}
+
+var recoveryEngine *recoveryLearner
+
+func newRecoveryLearner( api *infinity.Api ) *recoveryLearner {
+	r := &recoveryLearner{ api: api }
+	r.learn( time.Now() )
+	return r
+}	// newRecoveryLearner
+
+// learn rebuilds the rates from the samples of the last recoveryLearnDays days.
+func ( r *recoveryLearner ) learn( now time.Time ) {
+	bins := make( map[string]*recoveryRate )
+	for back := 1; back <= recoveryLearnDays; back++ {
+		samples, err := daySamples( now.AddDate(0, 0, -back) )
+		if err != nil {
+			continue
+		}
+		for _, run := range recoveryRuns( samples ) {
+			key := fmt.Sprintf( "%s/%d/%d", run.Mode, run.Stage, run.Outdoor )
+			b, ok := bins[key]
+			if !ok {
+				b = &recoveryRate{ Mode: run.Mode, Stage: run.Stage, Outdoor: run.Outdoor }
+				bins[key] = b
+			}
+			b.Degrees += run.Degrees
+			b.Hours   += run.Hours
+			b.Runs++
+		}
+	}
+	rates := make( []recoveryRate, 0, len(bins) )
+	for _, b := range bins {
+		b.Rate = b.Degrees / b.Hours
+		rates = append( rates, *b )
+	}
+	sort.Slice( rates, func(i, j int) bool {
+		if rates[i].Mode != rates[j].Mode {
+			return rates[i].Mode < rates[j].Mode
+		}
+		if rates[i].Outdoor != rates[j].Outdoor {
+			return rates[i].Outdoor < rates[j].Outdoor
+		}
+		return rates[i].Stage < rates[j].Stage
+	} )
+	r.mu.Lock()
+	r.rates, r.learned = rates, now
+	r.mu.Unlock()
+	controlLog.Info( fmt.Sprintf( "recovery - learned %d rate bins from %d days", len(rates), recoveryLearnDays ) )
+}	// learn
+
+// recoveryRuns finds the heating and cooling runs of one day, as rates with one run each.
+func recoveryRuns( samples []hvacSample ) []recoveryRate {
+	var runs []recoveryRate
+
+	for i := 0; i < len(samples); i++ {
+		start := samples[i]
+		mode, set := "", 0
+		switch {
+		case !start.hvacOn():
+			continue
+		case start.CurrentTemp <= start.HeatSet - recoveryMinGap:
+			mode, set = "heat", start.HeatSet
+		case start.CurrentTemp >= start.CoolSet + recoveryMinGap:
+			mode, set = "cool", start.CoolSet
+		default:
+			continue
+		}
+		end, stage, outdoor, n := i, start.Stage, start.OutdoorTemp, 1
+		for j := i+1; j < len(samples); j++ {
+			s := samples[j]
+			if !s.hvacOn() || s.When.Sub( samples[j-1].When ) > 2*sampleMinutes*time.Minute ||
+				( mode == "heat" && s.HeatSet != set ) || ( mode == "cool" && s.CoolSet != set ) {
+				break
+			}
+			end = j
+			stage    = max( stage, s.Stage )
+			outdoor += s.OutdoorTemp
+			n++
+			if ( mode == "heat" && s.CurrentTemp >= set ) || ( mode == "cool" && s.CurrentTemp <= set ) {
+				break
+			}
+		}
+		i = end
+		hours   := samples[end].When.Sub( start.When ).Hours()
+		degrees := math.Abs( float64(samples[end].CurrentTemp - start.CurrentTemp) )
+		if hours < 0.2 || degrees < 1 {
+			continue
+		}
+		runs = append( runs, recoveryRate{ Mode: mode, Stage: stage, Outdoor: outdoorBin( outdoor / n ), Degrees: degrees, Hours: hours, Runs: 1 } )
+	}
+	return runs
+}	// recoveryRuns
+
+func outdoorBin( outdoor int ) int {
+	return int( math.Floor(float64(outdoor) / float64(recoveryOutdoorBin)) ) * recoveryOutdoorBin
+}
+
+// rate is the learned degrees per hour for mode and stage at an outdoor temperature, from the bin itself or else
+// the bins either side. The stage is the one with the most recovery time there among those with enough runs.
+func ( r *recoveryLearner ) rate( mode string, outdoor int ) ( float64, int, bool ) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bin := outdoorBin( outdoor )
+	for _, bins := range [][]int{ { bin }, { bin - recoveryOutdoorBin, bin + recoveryOutdoorBin } } {
+		stages := make( map[int]*recoveryRate )
+		for _, rt := range r.rates {
+			for _, b := range bins {
+				if rt.Mode == mode && rt.Outdoor == b {
+					st, ok := stages[rt.Stage]
+					if !ok {
+						st = &recoveryRate{ Mode: mode, Stage: rt.Stage }
+						stages[rt.Stage] = st
+					}
+					st.Degrees += rt.Degrees
+					st.Hours   += rt.Hours
+					st.Runs    += rt.Runs
+				}
+			}
+		}
+		var best *recoveryRate
+		for _, st := range stages {
+			if st.Runs < recoveryMinRuns || st.Degrees <= 0 {
+				continue
+			}
+			if best == nil || st.Hours > best.Hours || st.Hours == best.Hours && st.Stage < best.Stage {
+				best = st
+			}
+		}
+		if best != nil {
+			return best.Degrees / best.Hours, best.Stage, true
+		}
+	}
+	return 0, 0, false
+}	// rate
+
+// lead is how long before a period to start with the rate and its stage, false when there is no rate yet.
+func ( r *recoveryLearner ) lead( mode string, from, to, outdoor int ) ( time.Duration, float64, int, bool ) {
+	if r == nil {
+		return 0, 0, 0, false
+	}
+	rate, stage, ok := r.rate( mode, outdoor )
+	if !ok {
+		return 0, 0, 0, false
+	}
+	hours := math.Abs( float64(to - from) ) / rate
+	return min( time.Duration(hours * float64(time.Hour)), recoveryMaxLead ), rate, stage, true
+}	// lead
+
+// track starts following an early start, a recovery still open is closed as interrupted.
+func ( r *recoveryLearner ) track( p recoveryPrediction ) {
+	r.mu.Lock()
+	prev := r.open
+	r.open = &p
+	r.mu.Unlock()
+	if prev != nil {
+		r.close( prev, "interrupted", time.Now() )
+	}
+	controlLog.Info( fmt.Sprintf( "recovery - %s from %d to %d for %s, %.1f deg/h stage %d at %d outdoor, predicted %s",
+		p.Mode, p.StartTemp, p.Target, p.Period.Format("15:04"), p.Rate, p.Stage, p.Outdoor, p.Predicted.Format("15:04") ) )
+}	// track
+
+// close records how a prediction turned out.
+func ( r *recoveryLearner ) close( p *recoveryPrediction, result string, now time.Time ) {
+	p.Result = result
+	if result == "arrived" {
+		p.Arrived = &now
+		p.ErrorMinutes = math.Round( now.Sub(p.Predicted).Minutes() )
+	}
+	controlLog.Info( fmt.Sprintf( "recovery - %s to %d for %s %s, predicted %s, %+.0f min",
+		p.Mode, p.Target, p.Period.Format("15:04"), result, p.Predicted.Format("15:04"), p.ErrorMinutes ) )
+	line, err := json.Marshal( p )
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile( filePath + recoveryFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644 ); err == nil {
+			_, err = f.Write( append(line, '\n') )
+			f.Close()
+		}
+	}
+	if err != nil {
+		controlLog.Error( "recovery - log failure: ", err )
+	}
+}	// close
+
+// run relearns once a day and follows the recovery in progress to its arrival.
+func ( r *recoveryLearner ) run( ctx context.Context ) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After( recoveryTick ):
+		}
+		now := time.Now()
+		r.mu.Lock()
+		stale := now.YearDay() != r.learned.YearDay()
+		r.mu.Unlock()
+		if stale {
+			r.learn( now )
+		}
+		r.tick( now )
+	}
+}	// run
+
+func ( r *recoveryLearner ) tick( now time.Time ) {
+	tstat, ok := r.api.GetZoneConfig()
+	if !ok || tstat == nil {
+		return
+	}
+	r.mu.Lock()
+	p := r.open
+	result := ""
+	switch {
+	case p == nil:
+	case ( p.Mode == "heat" && int(tstat.CurrentTemp) >= p.Target ) || ( p.Mode == "cool" && int(tstat.CurrentTemp) <= p.Target ):
+		result = "arrived"
+	case ( p.Mode == "heat" && int(tstat.HeatSetpoint) != p.Target ) || ( p.Mode == "cool" && int(tstat.CoolSetpoint) != p.Target ):
+		result = "interrupted"							// Someone or something else changed the setpoint
+	case now.After( p.Period.Add(recoveryMaxLead) ):
+		result = "missed"
+	}
+	if result != "" {
+		r.open = nil
+	}
+	r.mu.Unlock()
+	if result != "" {
+		r.close( p, result, now )
+	}
+}	// tick
+
+// readRecoveryLog returns the last n predictions, newest first.
+func readRecoveryLog( n int ) []recoveryPrediction {
+	var list []recoveryPrediction
+
+	f, err := os.Open( filePath + recoveryFileName )
+	if err != nil {
+		return []recoveryPrediction{}
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner( f )
+	for scanner.Scan() {
+		var p recoveryPrediction
+		if json.Unmarshal( scanner.Bytes(), &p ) == nil {
+			list = append( list, p )
+		}
+	}
+	if len(list) > n {
+		list = list[len(list)-n:]
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	if list == nil {
+		list = []recoveryPrediction{}
+	}
+	return list
+}	// readRecoveryLog
+
+// mountRecoveryAPI adds the recovery handler to mux.
+func mountRecoveryAPI( mux *http.ServeMux, r *recoveryLearner ) {
+	mux.HandleFunc( "GET /api/recovery", func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		reply := struct {
+			Learned		time.Time				`json:"learned"`
+			Rates		[]recoveryRate			`json:"rates"`
+			Open		*recoveryPrediction		`json:"open"`
+			Recent		[]recoveryPrediction	`json:"recent"`
+		}{ Learned: r.learned, Rates: r.rates, Open: r.open }
+		r.mu.Unlock()
+		reply.Recent = readRecoveryLog( 30 )
+		writeJSON( w, http.StatusOK, reply )
+	} )
+}	// mountRecoveryAPI
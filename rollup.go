@@ -0,0 +1,457 @@
+package main
+	// Hourly and daily rollups, so year and multi-year views need not read every 4 minute sample.
+	// Each rollup has the sample count, indoor and outdoor min, max and mean, the setpoint means, and the hours
+	// the blower ran heating, cooling and circulating, the heating and cooling hours also by stage.
+	// The sample job adds each sample to the hour and day in progress, they are stored when the next begins and at shutdown.
+	// The rollups job rebuilds the days after the last stored day from the samples, every month the first time,
+	// and infinitive rollups rebuilds a range, or everything, with the service stopped:
+	//		infinitive rollups [-from 2024-01-01] [-to 2024-12-31]
+	// Charts and the history API pick the resolution from the span, samples up to rollupSampleDays, then hours
+	// up to rollupHourDays, then days:
+	//		GET /api/history?from=2024-01-01&to=2024-12-31&res=auto		or res=sample, hour, day
+	//		http://yo.ur.i.p:8080/charts/history?from=2024-01-01&to=2024-12-31
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+)
+
+// Rollup resolutions, sample is the raw samples each as its own rollup
+type rollupRes string
+
+const (
+	rollupSample	rollupRes = "sample"
+	rollupHour		rollupRes = "hour"
+	rollupDay		rollupRes = "day"
+)
+
+var rollupSampleDays	= 2			// Spans up to this many days chart every sample
+var rollupHourDays		= 62		// then hours, then days
+
+var rollupsUsage = `usage: infinitive rollups [-config FILE] [-from YYYY-MM-DD] [-to YYYY-MM-DD]`
+
+// One hour or one day of samples
+type rollup struct {
+	Start				time.Time			`json:"start"`
+	Samples				int					`json:"samples"`
+	IndoorMin			int					`json:"indoorMin"`
+	IndoorMax			int					`json:"indoorMax"`
+	IndoorMean			float64				`json:"indoorMean"`
+	OutdoorMin			int					`json:"outdoorMin"`
+	OutdoorMax			int					`json:"outdoorMax"`
+	OutdoorMean			float64				`json:"outdoorMean"`
+	HeatSetMean			float64				`json:"heatSetMean"`
+	CoolSetMean			float64				`json:"coolSetMean"`
+	HeatHours			float64				`json:"heatHours"`			// Blower on, heating
+	CoolHours			float64				`json:"coolHours"`
+	CirculationHours	float64				`json:"circulationHours"`
+	StageHours			map[string]float64	`json:"stageHours"`			// Heating and cooling hours by stage
+}
+
+// start is the beginning of the hour or day t is in.
+func ( res rollupRes ) start( t time.Time ) time.Time {
+	if res == rollupHour {
+		return time.Date( t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local )
+	}
+	return startOfDay( t )
+}	// start
+
+// add takes one more sample into the rollup, the means are running means so a stored rollup carries on.
+func ( r *rollup ) add( s hvacSample ) {
+	r.Samples++
+	n := float64( r.Samples )
+	if r.Samples == 1 || s.CurrentTemp < r.IndoorMin {
+		r.IndoorMin = s.CurrentTemp
+	}
+	if r.Samples == 1 || s.CurrentTemp > r.IndoorMax {
+		r.IndoorMax = s.CurrentTemp
+	}
+	if r.Samples == 1 || s.OutdoorTemp < r.OutdoorMin {
+		r.OutdoorMin = s.OutdoorTemp
+	}
+	if r.Samples == 1 || s.OutdoorTemp > r.OutdoorMax {
+		r.OutdoorMax = s.OutdoorTemp
+	}
+	r.IndoorMean  += ( float64(s.CurrentTemp) - r.IndoorMean ) / n
+	r.OutdoorMean += ( float64(s.OutdoorTemp) - r.OutdoorMean ) / n
+	r.HeatSetMean += ( float64(s.HeatSet) - r.HeatSetMean ) / n
+	r.CoolSetMean += ( float64(s.CoolSet) - r.CoolSetMean ) / n
+	hours := sampleMinutes / 60.0
+	switch {
+	case s.Circulating:
+		r.CirculationHours += hours
+	case s.BlowerRPM > 0:
+		if sampleIsHeating( s ) {
+			r.HeatHours += hours
+		} else {
+			r.CoolHours += hours
+		}
+		if r.StageHours == nil {
+			r.StageHours = make( map[string]float64 )
+		}
+		r.StageHours[strconv.Itoa(s.Stage)] += hours
+	}
+}	// add
+
+// percentOn is the heating and cooling share of the sampled time.
+func ( r rollup ) percentOn() float64 {
+	if r.Samples == 0 {
+		return 0
+	}
+	return 100.0 * ( r.HeatHours + r.CoolHours ) / ( float64(r.Samples*sampleMinutes) / 60.0 )
+}	// percentOn
+
+// rollUp groups the samples, oldest first, into rollups of the resolution.
+func rollUp( res rollupRes, samples []hvacSample ) []rollup {
+	var list []rollup
+
+	for _, s := range samples {
+		start := s.When
+		if res != rollupSample {
+			start = res.start( s.When )
+		}
+		if len(list) == 0 || !list[len(list)-1].Start.Equal( start ) {
+			list = append( list, rollup{ Start: start } )
+		}
+		list[len(list)-1].add( s )
+	}
+	return list
+}	// rollUp
+
+// The hour and day in progress, kept up by the sample job
+type rollupKeeper struct {
+	mu				sync.Mutex
+	hour			*rollup
+	day				*rollup
+	last			time.Time				// Newest sample in them, a sample already counted is not added twice
+}
+
+var rollups = &rollupKeeper{}
+
+// add counts the sample, storing the hour and the day it ends. The first sample starts from the day's stored samples.
+func ( k *rollupKeeper ) add( s hvacSample ) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var errs []error
+	if k.day == nil {
+		if err := k.rebuild( s.When ); err != nil {
+			return err
+		}
+	}
+	if !s.When.After( k.last ) {
+		return nil
+	}
+	if !k.hour.Start.Equal( rollupHour.start(s.When) ) {
+		errs = append( errs, putRollup( rollupHour, *k.hour ) )
+		k.hour = &rollup{ Start: rollupHour.start(s.When) }
+	}
+	if !k.day.Start.Equal( rollupDay.start(s.When) ) {
+		errs = append( errs, putRollup( rollupDay, *k.day ) )
+		k.day = &rollup{ Start: rollupDay.start(s.When) }
+	}
+	k.hour.add( s )
+	k.day.add( s )
+	k.last = s.When
+	return errors.Join( errs... )
+}	// add
+
+// rebuild starts the hour and day of t from the stored samples, call with k.mu held.
+func ( k *rollupKeeper ) rebuild( t time.Time ) error {
+	samples, err := daySamples( t )
+	if err != nil {
+		return err
+	}
+	k.hour = &rollup{ Start: rollupHour.start(t) }
+	k.day  = &rollup{ Start: rollupDay.start(t) }
+	k.last = time.Time{}
+	for _, s := range samples {
+		if s.When.After( t ) {
+			break
+		}
+		if rollupHour.start( s.When ).Equal( k.hour.Start ) {
+			k.hour.add( s )
+		}
+		k.day.add( s )
+		k.last = s.When
+	}
+	return nil
+}	// rebuild
+
+// flush stores the hour and day in progress, at shutdown.
+func ( k *rollupKeeper ) flush() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.day == nil {
+		return nil
+	}
+	return errors.Join( putRollup( rollupHour, *k.hour ), putRollup( rollupDay, *k.day ) )
+}	// flush
+
+// current is the rollup in progress of the resolution, false before the first sample.
+func ( k *rollupKeeper ) current( res rollupRes ) ( rollup, bool ) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch {
+	case k.day == nil:
+		return rollup{}, false
+	case res == rollupHour:
+		return *k.hour, k.hour.Samples > 0
+	default:
+		return *k.day, k.day.Samples > 0
+	}
+}	// current
+
+// putRollup stores one rollup in place of what the store has for its hour or day.
+func putRollup( res rollupRes, r rollup ) error {
+	if r.Samples == 0 {
+		return nil
+	}
+	end := r.Start.Add( time.Hour )
+	if res == rollupDay {
+		end = r.Start.AddDate( 0, 0, 1 )
+	}
+	return dataStore.PutRollups( res, r.Start, end, []rollup{ r } )
+}	// putRollup
+
+// rollupRange is the stored rollups from..to with the one in progress, or the samples for rollupSample.
+func rollupRange( res rollupRes, from, to time.Time ) ( []rollup, error ) {
+	if res == rollupSample {
+		samples, err := dataStore.Samples( from, to )
+		return rollUp( rollupSample, samples ), err
+	}
+	list, err := dataStore.Rollups( res, from, to )
+	if r, ok := rollups.current( res ); ok && !r.Start.Before( from ) && r.Start.Before( to ) {
+		if n := len(list); n > 0 && list[n-1].Start.Equal( r.Start ) {
+			list[n-1] = r
+		} else {
+			list = append( list, r )
+		}
+	}
+	return list, err
+}	// rollupRange
+
+// rebuildRollups works out the hours and day of each day from..to, to exclusive, from the samples.
+// Days without samples are left as they are, a pruned day keeps its rollups.
+func rebuildRollups( from, to time.Time ) ( int, error ) {
+	days := 0
+	for day := startOfDay( from ); day.Before( to ); day = day.AddDate(0, 0, 1) {
+		samples, err := daySamples( day )
+		if err != nil {
+			return days, fmt.Errorf( "%s: %w", day.Format("2006-01-02"), err )
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		next := day.AddDate( 0, 0, 1 )
+		err = errors.Join( dataStore.PutRollups( rollupHour, day, next, rollUp(rollupHour, samples) ),
+			dataStore.PutRollups( rollupDay, day, next, rollUp(rollupDay, samples) ) )
+		if err != nil {
+			return days, fmt.Errorf( "%s: %w", day.Format("2006-01-02"), err )
+		}
+		days++
+	}
+	return days, nil
+}	// rebuildRollups
+
+// catchUpRollups rebuilds the days after the last stored day up to yesterday, every month the first time.
+func catchUpRollups( now time.Time ) error {
+	today := startOfDay( now )
+	months := archiveMonths()
+	if len(months) == 0 {
+		return nil
+	}
+	from := months[0]
+	stored, err := dataStore.Rollups( rollupDay, from, today )
+	if err != nil {
+		return err
+	}
+	if n := len(stored); n > 0 {
+		from = stored[n-1].Start.AddDate( 0, 0, 1 )
+	}
+	days, err := rebuildRollups( from, today )
+	if days > 0 {
+		chartsLog.WithField( "days", days ).Info( "rollups - rebuilt from ", from.Format("2006-01-02") )
+	}
+	return err
+}	// catchUpRollups
+
+// resolutionFor picks samples, hours or days by the span.
+func resolutionFor( from, to time.Time ) rollupRes {
+	switch span := to.Sub( from ); {
+	case span <= time.Duration(rollupSampleDays) * 24 * time.Hour:
+		return rollupSample
+	case span <= time.Duration(rollupHourDays) * 24 * time.Hour:
+		return rollupHour
+	}
+	return rollupDay
+}	// resolutionFor
+
+// historyArgs reads from, to and res, to is inclusive, the last 7 days by default. res=sample is for rollupHourDays at most.
+func historyArgs( r *http.Request ) ( time.Time, time.Time, rollupRes, error ) {
+	today := startOfDay( time.Now() )
+	from, err1 := parseDateArg( r, "from", today.AddDate(0, 0, -6) )
+	to,   err2 := parseDateArg( r, "to",   today )
+	if err1 != nil || err2 != nil || to.Before(from) {
+		return from, to, "", errors.New( "from and to must be YYYY-MM-DD dates, from before to" )
+	}
+	to = to.AddDate( 0, 0, 1 )
+	switch res := rollupRes( r.URL.Query().Get("res") ); res {
+	case "", "auto":
+		return from, to, resolutionFor( from, to ), nil
+	case rollupSample:
+		if to.Sub( from ) > time.Duration(rollupHourDays) * 24 * time.Hour {		// Every sample of a long span is too many to read
+			return from, to, "", fmt.Errorf( "res sample is for at most %d days, use hour or day", rollupHourDays )
+		}
+		return from, to, res, nil
+	case rollupHour, rollupDay:
+		return from, to, res, nil
+	default:
+		return from, to, "", fmt.Errorf( "res %q is not auto, sample, hour or day", res )
+	}
+}	// historyArgs
+
+func mountHistoryAPI( mux *http.ServeMux ) {
+	mux.HandleFunc( "GET /api/history", func(w http.ResponseWriter, r *http.Request) {
+		from, to, res, err := historyArgs( r )
+		if err != nil {
+			writeError( w, http.StatusBadRequest, err.Error() )
+			return
+		}
+		list, err := rollupRange( res, from, to )
+		if err != nil {
+			writeError( w, http.StatusInternalServerError, err.Error() )
+			return
+		}
+		if list == nil {
+			list = []rollup{}
+		}
+		writeJSON( w, http.StatusOK, map[string]any{ "resolution": res, "rollups": list } )
+	} )
+}	// mountHistoryAPI
+
+// historyHandler serves the temperatures, setpoints and percent on of a range at the resolution its span needs.
+func historyHandler( w http.ResponseWriter, r *http.Request ) {
+	from, to, res, err := historyArgs( r )
+	if err != nil {
+		http.Error( w, err.Error(), http.StatusBadRequest )
+		return
+	}
+	list, err := rollupRange( res, from, to )
+	if err != nil {
+		chartsLog.Error( "historyHandler - read failure: ", err )
+		http.Error( w, "history read failed", http.StatusInternalServerError )
+		return
+	}
+	label := "2006-01-02"
+	if res != rollupDay {
+		label = "01-02 15:04"
+	}
+	xAxis   := make( []string, 0, len(list) )
+	indoor  := make( []opts.LineData, 0, len(list) )
+	outdoor := make( []opts.LineData, 0, len(list) )
+	heatSet := make( []opts.LineData, 0, len(list) )
+	coolSet := make( []opts.LineData, 0, len(list) )
+	percent := make( []opts.LineData, 0, len(list) )
+	round   := func( v float64 ) float64 { return math.Round( v*10 ) / 10 }
+	for _, ru := range list {
+		xAxis   = append( xAxis, ru.Start.Format(label) )
+		indoor  = append( indoor,  opts.LineData{ Value: round(ru.IndoorMean) } )
+		outdoor = append( outdoor, opts.LineData{ Value: round(ru.OutdoorMean) } )
+		heatSet = append( heatSet, opts.LineData{ Value: round(ru.HeatSetMean) } )
+		coolSet = append( coolSet, opts.LineData{ Value: round(ru.CoolSetMean) } )
+		percent = append( percent, opts.LineData{ Value: round(ru.percentOn()) } )
+	}
+
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts( opts.Initialization{ PageTitle: "Infinitive History", Theme: types.ThemeWesteros, Width: "1100px", Height: "600px" } ),
+		charts.WithTitleOpts( opts.Title{ Title: "Infinitive HVAC History", Subtitle: fmt.Sprintf( "%s to %s by %s, Vsn: %s",
+			from.Format("2006-01-02"), to.AddDate(0, 0, -1).Format("2006-01-02"), res, Version ) } ),
+		charts.WithTooltipOpts( opts.Tooltip{ Show: true, Trigger: "axis" } ),
+		charts.WithLegendOpts( opts.Legend{ Show: true, Top: "bottom" } ),
+		charts.WithDataZoomOpts( opts.DataZoom{ Type: "slider" } ),
+		charts.WithYAxisOpts( opts.YAxis{ Name: "Temp & Pcnt On", Type: "value" } ),
+	)
+	line.SetXAxis( xAxis )
+	line.AddSeries( "Indoor Temp",  indoor )
+	line.AddSeries( "Outdoor Temp", outdoor )
+	line.AddSeries( "Heat Set",     heatSet, charts.WithLineChartOpts( opts.LineChart{Step: "end"} ) )
+	line.AddSeries( "Cool Set",     coolSet, charts.WithLineChartOpts( opts.LineChart{Step: "end"} ) )
+	line.AddSeries( "Pcnt On",      percent, charts.WithAreaStyleOpts( opts.AreaStyle{ Opacity: 0.2 } ) )
+
+	var page bytes.Buffer
+	if err := line.Render( &page ); err != nil {
+		chartsLog.Error( "historyHandler - Render failed: ", err )
+		http.Error( w, "chart render failed", http.StatusInternalServerError )
+		return
+	}
+	w.Header().Set( "Content-Type", "text/html; charset=utf-8" )
+	w.Write( []byte( strings.Replace( page.String(), "<body>", "<body>\n"+historyForm(r), 1 ) ) )
+}	// historyHandler
+
+func historyForm( r *http.Request ) string {
+	q := r.URL.Query()
+	field := func( name string, label string ) string {
+		return fmt.Sprintf( "%s <input name=\"%s\" value=\"%s\" size=\"10\"> ", label, name, html.EscapeString(q.Get(name)) )
+	}
+	return "<form method=\"get\">" + field("from", "From") + field("to", "To") + field("res", "Resolution") +
+		"<input type=\"submit\" value=\"Chart\"></form>\n"
+}	// historyForm
+
+// runRollupsCommand rebuilds the rollups of a range from the samples, args follow "rollups".
+func runRollupsCommand( c config, args []string ) error {
+	var fromText, toText string
+
+	fs := flag.NewFlagSet( "rollups", flag.ContinueOnError )
+	fs.StringVar( &fromText, "from", "", "first day, YYYY-MM-DD, the oldest month by default" )
+	fs.StringVar( &toText, "to", "", "last day, YYYY-MM-DD, today by default" )
+	fs.Usage = func() { fmt.Fprintln( os.Stderr, rollupsUsage ); fs.PrintDefaults() }
+	if err := fs.Parse( args ); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New( rollupsUsage )
+	}
+	today := startOfDay( time.Now() )
+	from, to := today, today
+	if months := archiveMonths(); len(months) > 0 {
+		from = months[0]
+	}
+	var err error
+	if fromText != "" {
+		if from, err = time.ParseInLocation( "2006-01-02", fromText, time.Local ); err != nil {
+			return fmt.Errorf( "from %q is not YYYY-MM-DD", fromText )
+		}
+	}
+	if toText != "" {
+		if to, err = time.ParseInLocation( "2006-01-02", toText, time.Local ); err != nil {
+			return fmt.Errorf( "to %q is not YYYY-MM-DD", toText )
+		}
+	}
+	if to.Before( from ) {
+		return errors.New( "to is before from" )
+	}
+	if dataStore, err = openStore( c.Store ); err != nil {
+		return err
+	}
+	days, err := rebuildRollups( from, to.AddDate(0, 0, 1) )
+	if cerr := dataStore.Close(); err == nil {
+		err = cerr
+	}
+	fmt.Printf( "%d days rebuilt, %s to %s.\n", days, from.Format("2006-01-02"), to.Format("2006-01-02") )
+	return err
+}	// runRollupsCommand
@@ -0,0 +1,184 @@
+package main
+	// Daily CSV sample reading shared by the year heatmap and other charts built from recorded data.
+	// The daily files are written by cron 1 in infinitive.go, one line per 4 minute sample.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sampleMinutes		= 4			// cron 1 interval
+
+// One recorded line of a daily YYYY-MM-DD_Infinitive.csv file
+type hvacSample struct {
+	When			time.Time	`json:"when"`
+	FracDay			float64		`json:"fracDay"`
+	HeatSet			int			`json:"heatSet"`
+	CoolSet			int			`json:"coolSet"`
+	OutdoorTemp		int			`json:"outdoor"`
+	CurrentTemp		int			`json:"indoor"`
+	BlowerRPM		int			`json:"blower"`					// Recorded as RPM/10, capped at 100
+	HvacMode		string		`json:"mode"`
+	Circulating		bool		`json:"circulating,omitempty"`	// Blower on for fan circulation only, circulate.go
+	Stage			int			`json:"stage"`					// Heating or cooling stage, -1 in files from before it was recorded
+	Shutdown		bool		`json:"shutdown,omitempty"`		// The last sample before a clean stop, see main
+}
+
+// dailyFileFor returns the CSV file name for a date, same layout as openDailyFile but not tied to monthDir.
+func dailyFileFor( day time.Time ) string {
+	return fmt.Sprintf( "%s%04d-%02d/%04d-%02d-%02d_%s", filePath, day.Year(), day.Month(), day.Year(), day.Month(), day.Day(), "Infinitive.csv" )
+}	// dailyFileFor
+
+// readDailySamples parses a daily file. Header lines (one per start/restart) are counted, not returned.
+//		Lines damaged by a crash or power loss are skipped rather than failing the whole day.
+func readDailySamples( fileName string ) ( samples []hvacSample, restarts int, err error ) {
+	f, err := openDataFile( fileName )				// On disk or archived
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner( f )
+	for scanner.Scan() {
+		text := scanner.Text()
+		if len(text) == 0 {
+			continue
+		}
+		if text[0] == 'D' {				// Header lines start with D
+			restarts++
+			continue
+		}
+		if s, ok := parseSampleLine( text ); ok {
+			samples = append( samples, s )
+		}
+	}
+	return samples, restarts, scanner.Err()
+}	// readDailySamples
+
+// parseSampleLine splits on commas rather than fixed columns, negative outdoor temps are fine.
+func parseSampleLine( text string ) ( hvacSample, bool ) {
+	var s hvacSample
+	var err error
+
+	field := strings.Split( text, "," )
+	if len(field) < 7 {
+		return s, false
+	}
+	if s.When, err = time.ParseInLocation( "2006-01-02T15:04:05", field[0], time.Local ); err != nil {
+		return s, false
+	}
+	if s.FracDay, err = strconv.ParseFloat( field[1], 64 ); err != nil {
+		return s, false
+	}
+	value := make( []int, 5 )
+	for i := range value {
+		if value[i], err = strconv.Atoi( strings.TrimSpace(field[i+2]) ); err != nil {
+			return s, false
+		}
+	}
+	s.HeatSet, s.CoolSet, s.OutdoorTemp, s.CurrentTemp, s.BlowerRPM = value[0], value[1], value[2], value[3], value[4]
+	if len(field) > 7 {
+		s.HvacMode = field[7]
+	}
+	s.Circulating = len(field) > 8 && field[8] == "1"
+	s.Stage = -1
+	if len(field) > 9 {
+		if stage, err := strconv.Atoi( strings.TrimSpace(field[9]) ); err == nil {
+			s.Stage = stage
+		}
+	}
+	s.Shutdown = len(field) > 10 && field[10] == "shutdown"
+	return s, true
+}	// parseSampleLine
+
+// Runtime and temperature summary of one day, shown in the index calendar
+type daySummary struct {
+	Date			time.Time		`json:"date"`
+	Samples			int				`json:"samples"`
+	Restarts		int				`json:"restarts"`
+	RuntimeHours	float64			`json:"runtimeHours"`			// Heating and cooling, not circulation
+	PercentOn		float64			`json:"percentOn"`
+	CirculationHours float64		`json:"circulationHours"`
+	IndoorMin		int				`json:"indoorMin"`
+	IndoorMax		int				`json:"indoorMax"`
+	OutdoorMin		int				`json:"outdoorMin"`
+	OutdoorMax		int				`json:"outdoorMax"`
+	OutdoorMean		float64			`json:"outdoorMean"`
+}
+
+// Summaries of past days do not change, keep them keyed by file name and modification time.
+type cachedSummary struct {
+	modTime			time.Time
+	summary			daySummary
+}
+
+var summaryCache	= make( map[string]cachedSummary )
+var summaryMutex	sync.Mutex
+
+// summarizeDay returns the day's summary, false when there is no daily file or it holds no samples.
+//		The summary of an archived or pruned day comes from its month's summaries file.
+func summarizeDay( day time.Time ) ( daySummary, bool ) {
+	fileName := dailyFileFor( day )
+	info, err := os.Stat( fileName )
+	if err != nil {
+		return archivedSummary( day )
+	}
+	summaryMutex.Lock()
+	cached, ok := summaryCache[fileName]
+	summaryMutex.Unlock()
+	if ok && cached.modTime.Equal( info.ModTime() ) {
+		return cached.summary, cached.summary.Samples > 0
+	}
+	samples, restarts, err := readDailySamples( fileName )
+	if err != nil {
+		return daySummary{}, false
+	}
+	sum := summarizeSamples( day, samples )
+	sum.Restarts = restarts
+	summaryMutex.Lock()
+	summaryCache[fileName] = cachedSummary{ modTime: info.ModTime(), summary: sum }
+	summaryMutex.Unlock()
+	return sum, sum.Samples > 0
+}	// summarizeDay
+
+// hvacOn is a sample with the blower on for heating or cooling.
+func ( s hvacSample ) hvacOn() bool {
+	return s.BlowerRPM > 0 && !s.Circulating
+}
+
+func summarizeSamples( day time.Time, samples []hvacSample ) daySummary {
+	sum := daySummary{ Date: day, Samples: len(samples) }
+	on, circulating := 0, 0
+	for i, s := range samples {
+		if i == 0 || s.CurrentTemp < sum.IndoorMin {
+			sum.IndoorMin = s.CurrentTemp
+		}
+		if i == 0 || s.CurrentTemp > sum.IndoorMax {
+			sum.IndoorMax = s.CurrentTemp
+		}
+		if i == 0 || s.OutdoorTemp < sum.OutdoorMin {
+			sum.OutdoorMin = s.OutdoorTemp
+		}
+		if i == 0 || s.OutdoorTemp > sum.OutdoorMax {
+			sum.OutdoorMax = s.OutdoorTemp
+		}
+		sum.OutdoorMean += float64( s.OutdoorTemp )
+		switch {
+		case s.Circulating:
+			circulating++
+		case s.BlowerRPM > 0:
+			on++
+		}
+	}
+	if sum.Samples > 0 {
+		sum.OutdoorMean /= float64( sum.Samples )
+		sum.PercentOn    = 100.0 * float64(on) / float64(sum.Samples)
+	}
+	sum.RuntimeHours = float64( on*sampleMinutes ) / 60.0
+	sum.CirculationHours = float64( circulating*sampleMinutes ) / 60.0
+	return sum
+}	// summarizeSamples
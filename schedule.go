@@ -0,0 +1,456 @@
+package main
+	// Weekly setback schedule run by Infinitive, kept in filePath+scheduleFileName.
+	//		{ "enabled": true,
+	//		  "days": { "monday": [ { "start": "06:00", "heatSetpoint": 68, "coolSetpoint": 76, "fanMode": "auto" },
+	//		                        { "start": "22:00", "heatSetpoint": 64, "coolSetpoint": 78 } ], ... },
+	//		  "holidays": [ { "date": "2026-12-25", "name": "Christmas", "useDay": "sunday" } ],
+	//		  "skipNext": "2026-10-19T22:00:00-04:00", "recovery": true }
+	// A day without periods keeps the last period of the day before. A holiday uses the periods of useDay, or its own.
+	// skipNext is the start of a period that will not be applied, the settings stay until the period after it.
+	// The current period is applied at startup and whenever a new period starts, through changeZoneConfig.
+	// While a temporary override is in effect, or a profile other than home, nothing is applied, see override.go and profiles.go.
+	// With recovery on, a warmer or cooler period is started early by the learned recovery time, see recovery.go.
+	//		GET    /api/schedule			the schedule, with the current and next period
+	//		PUT    /api/schedule			replace the schedule
+	//		POST   /api/schedule/skip		skip the next period
+	//		DELETE /api/schedule/skip		cancel the skip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+	"github.com/go-echarts/go-echarts/v2/opts"
+)
+
+var scheduleFileName	= "infinitiveSchedule.json"
+var scheduleTick		= 30 * time.Second
+var weekdayNames		= []string{ "sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday" }
+
+// One period of a day, from Start until the next period
+type schedulePeriod struct {
+	Start			string		`json:"start"`						// HH:MM
+	HeatSetpoint	uint8		`json:"heatSetpoint"`
+	CoolSetpoint	uint8		`json:"coolSetpoint"`
+	FanMode			string		`json:"fanMode,omitempty"`
+	Mode			string		`json:"mode,omitempty"`
+}
+
+// A date that does not follow its weekday
+type scheduleHoliday struct {
+	Date			string				`json:"date"`				// YYYY-MM-DD
+	Name			string				`json:"name,omitempty"`
+	UseDay			string				`json:"useDay,omitempty"`	// Weekday whose periods apply
+	Periods			[]schedulePeriod	`json:"periods,omitempty"`	// Or periods of its own
+}
+
+// The schedule file
+type weekSchedule struct {
+	Enabled			bool							`json:"enabled"`
+	Days			map[string][]schedulePeriod		`json:"days"`
+	Holidays		[]scheduleHoliday				`json:"holidays,omitempty"`
+	SkipNext		*time.Time						`json:"skipNext,omitempty"`
+	Recovery		bool							`json:"recovery,omitempty"`		// Start early to be there on time
+}
+
+// A period placed in time
+type activePeriod struct {
+	schedulePeriod
+	At				time.Time		`json:"at"`
+}
+
+// The schedule engine
+type scheduler struct {
+	mu				sync.Mutex
+	api				*infinity.Api
+	file			string
+	sched			weekSchedule
+	applied			time.Time			// Start of the period last applied
+	recovering		time.Time			// Start of the period started early
+}
+
+var scheduleEngine *scheduler
+
+// newScheduler loads the schedule file, a missing file is an empty disabled schedule.
+func newScheduler( api *infinity.Api ) ( *scheduler, error ) {
+	s := &scheduler{ api: api, file: filePath + scheduleFileName }
+	data, err := os.ReadFile( s.file )
+	if errors.Is( err, os.ErrNotExist ) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal( data, &s.sched ); err != nil {
+		return nil, fmt.Errorf( "%s: %w", s.file, err )
+	}
+	if err = s.sched.validate(); err != nil {
+		return nil, fmt.Errorf( "%s: %w", s.file, err )
+	}
+	return s, nil
+}	// newScheduler
+
+// save writes the schedule file, call with s.mu held.
+func ( s *scheduler ) save() error {
+	data, err := json.MarshalIndent( s.sched, "", "\t" )
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join( filepath.Dir(s.file), ".schedule.tmp" )
+	if err = os.WriteFile( tmp, append(data, '\n'), 0644 ); err != nil {
+		return err
+	}
+	return os.Rename( tmp, s.file )
+}	// save
+
+func parseClock( hhmm string ) ( time.Duration, error ) {
+	t, err := time.Parse( "15:04", hhmm )
+	if err != nil {
+		return 0, fmt.Errorf( "start %q is not HH:MM", hhmm )
+	}
+	return time.Duration( t.Hour() )*time.Hour + time.Duration( t.Minute() )*time.Minute, nil
+}	// parseClock
+
+// validate checks times, names and that every period is inside the limits.
+func ( w *weekSchedule ) validate() error {
+	checkPeriods := func( where string, periods []schedulePeriod ) error {
+		for _, p := range periods {
+			if _, err := parseClock( p.Start ); err != nil {
+				return fmt.Errorf( "%s: %w", where, err )
+			}
+			if p.HeatSetpoint == 0 || p.CoolSetpoint == 0 {
+				return fmt.Errorf( "%s %s: heatSetpoint and coolSetpoint are needed", where, p.Start )
+			}
+			if err := limits.check( nil, p.change() ); err != nil {
+				return fmt.Errorf( "%s %s: %w", where, p.Start, err )
+			}
+		}
+		return nil
+	}
+	for day, periods := range w.Days {
+		if !isWeekday( day ) {
+			return fmt.Errorf( "unknown day %q", day )
+		}
+		if err := checkPeriods( day, periods ); err != nil {
+			return err
+		}
+	}
+	for _, h := range w.Holidays {
+		if _, err := time.ParseInLocation( "2006-01-02", h.Date, time.Local ); err != nil {
+			return fmt.Errorf( "holiday date %q is not YYYY-MM-DD", h.Date )
+		}
+		if h.UseDay != "" && !isWeekday( h.UseDay ) {
+			return fmt.Errorf( "holiday %s: unknown day %q", h.Date, h.UseDay )
+		}
+		if err := checkPeriods( h.Date, h.Periods ); err != nil {
+			return err
+		}
+	}
+	return nil
+}	// validate
+
+func isWeekday( day string ) bool {
+	for _, name := range weekdayNames {
+		if name == day {
+			return true
+		}
+	}
+	return false
+}	// isWeekday
+
+// change is the config change a period makes.
+func ( p schedulePeriod ) change() infinity.TStatZoneConfig {
+	return infinity.TStatZoneConfig{ HeatSetpoint: p.HeatSetpoint, CoolSetpoint: p.CoolSetpoint, FanMode: p.FanMode, Mode: p.Mode }
+}
+
+// periodsOn returns the periods of one day placed in time, holidays first, oldest first.
+func ( w *weekSchedule ) periodsOn( day time.Time ) []activePeriod {
+	var list []activePeriod
+
+	periods := w.Days[weekdayNames[day.Weekday()]]
+	date    := day.Format( "2006-01-02" )
+	for _, h := range w.Holidays {
+		if h.Date != date {
+			continue
+		}
+		if len(h.Periods) > 0 {
+			periods = h.Periods
+		} else if h.UseDay != "" {
+			periods = w.Days[h.UseDay]
+		}
+	}
+	for _, p := range periods {
+		offset, err := parseClock( p.Start )
+		if err != nil {
+			continue
+		}
+		list = append( list, activePeriod{ schedulePeriod: p, At: clockOn( day, offset ) } )
+	}
+	sort.Slice( list, func(i, j int) bool { return list[i].At.Before( list[j].At ) } )
+	return list
+}	// periodsOn
+
+// clockOn is the wall clock time of day, not the time elapsed since midnight, which differs on daylight saving days.
+func clockOn( day time.Time, clock time.Duration ) time.Time {
+	return time.Date( day.Year(), day.Month(), day.Day(), int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, time.Local )
+}	// clockOn
+
+// periodAt finds the period in effect at t, looking back up to a week.
+func ( w *weekSchedule ) periodAt( t time.Time ) ( activePeriod, bool ) {
+	for back := 0; back <= 7; back++ {
+		periods := w.periodsOn( t.AddDate(0, 0, -back) )
+		for i := len(periods)-1; i >= 0; i-- {
+			if !periods[i].At.After( t ) {
+				return periods[i], true
+			}
+		}
+	}
+	return activePeriod{}, false
+}	// periodAt
+
+// nextPeriod finds the first period starting after t, looking ahead up to a week.
+func ( w *weekSchedule ) nextPeriod( t time.Time ) ( activePeriod, bool ) {
+	for ahead := 0; ahead <= 7; ahead++ {
+		for _, p := range w.periodsOn( t.AddDate(0, 0, ahead) ) {
+			if p.At.After( t ) {
+				return p, true
+			}
+		}
+	}
+	return activePeriod{}, false
+}	// nextPeriod
+
+// run applies the current period every scheduleTick when it changed, the first tick is at startup.
+func ( s *scheduler ) run( ctx context.Context ) {
+	for {
+		s.tick( time.Now() )
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After( scheduleTick ):
+		}
+	}
+}	// run
+
+func ( s *scheduler ) tick( now time.Time ) {
+	if overrideEngine.active() {
+		return											// The override ends with reapply
+	}
+	if !profileEngine.scheduleAllowed() {
+		return											// Away from home, entering home reapplies
+	}
+	s.applyCurrent( now )
+	s.recover( now )
+}	// tick
+
+// applyCurrent applies the period in effect when it was not applied yet.
+func ( s *scheduler ) applyCurrent( now time.Time ) {
+	s.mu.Lock()
+	if !s.sched.Enabled {
+		s.mu.Unlock()
+		return
+	}
+	period, ok := s.sched.periodAt( now )
+	if !ok || period.At.Equal( s.applied ) {
+		s.mu.Unlock()
+		return
+	}
+	if s.sched.SkipNext != nil && period.At.Equal( *s.sched.SkipNext ) {
+		controlLog.Warn( "schedule - skipping period starting " + period.At.Format("2006-01-02 15:04") )
+		s.applied = period.At
+		s.mu.Unlock()
+		return
+	}
+	if s.sched.SkipNext != nil && period.At.After( *s.sched.SkipNext ) {
+		s.sched.SkipNext = nil						// Skipped period is over
+		if err := s.save(); err != nil {
+			controlLog.Error( "schedule - save failure: ", err )
+		}
+	}
+	s.mu.Unlock()
+
+	err := changeZoneConfig( s.api, period.change(), changeSource{ Source: "schedule" } )
+	if errors.Is( err, errUpdateFailed ) {
+		return											// Try again next tick
+	}
+	if err != nil {
+		controlLog.Error( "schedule - period " + period.Start + " not applied: ", err )
+	}
+	s.mu.Lock()
+	s.applied = period.At
+	s.mu.Unlock()
+}	// applyCurrent
+
+// recover applies the next period early when it is warmer or cooler and the learned rate says it is time.
+func ( s *scheduler ) recover( now time.Time ) {
+	s.mu.Lock()
+	next, ok := s.sched.nextPeriod( now )
+	due := s.sched.Enabled && s.sched.Recovery && ok && !next.At.Equal( s.recovering ) &&
+		next.At.Sub( now ) <= recoveryMaxLead && ( s.sched.SkipNext == nil || !next.At.Equal(*s.sched.SkipNext) )
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+	tstat, ok := s.api.GetZoneConfig()
+	if !ok || tstat == nil {
+		return
+	}
+	p := recoveryPrediction{ Period: next.At, Started: now, StartTemp: int( tstat.CurrentTemp ), Outdoor: int( tstat.OutdoorTemp ) }
+	switch {
+	case tstat.Mode != "cool" && next.HeatSetpoint > tstat.HeatSetpoint && tstat.CurrentTemp < next.HeatSetpoint:
+		p.Mode, p.Target = "heat", int( next.HeatSetpoint )
+	case tstat.Mode != "heat" && next.CoolSetpoint < tstat.CoolSetpoint && tstat.CurrentTemp > next.CoolSetpoint:
+		p.Mode, p.Target = "cool", int( next.CoolSetpoint )
+	default:
+		return											// Setback or already there, the period starts on time
+	}
+	lead, rate, stage, ok := recoveryEngine.lead( p.Mode, p.StartTemp, p.Target, p.Outdoor )
+	if !ok || now.Before( next.At.Add(-lead) ) {
+		return
+	}
+	err := changeZoneConfig( s.api, next.change(), changeSource{ Source: "recovery" } )
+	if errors.Is( err, errUpdateFailed ) {
+		return											// Try again next tick
+	}
+	s.mu.Lock()
+	s.recovering = next.At
+	s.mu.Unlock()
+	if err != nil {
+		controlLog.Error( "schedule - recovery for " + next.Start + " not applied: ", err )
+		return
+	}
+	p.Rate, p.Stage = rate, stage
+	p.Predicted = now.Add( time.Duration(math.Abs(float64(p.Target - p.StartTemp)) / rate * float64(time.Hour)) )
+	recoveryEngine.track( p )
+}	// recover
+
+func ( s *scheduler ) enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sched.Enabled
+}	// enabled
+
+// reapply applies the current period now, even if it was applied before.
+func ( s *scheduler ) reapply() {
+	s.mu.Lock()
+	s.applied    = time.Time{}
+	s.recovering = time.Time{}
+	s.mu.Unlock()
+	s.tick( time.Now() )
+}	// reapply
+
+// Reply to GET /api/schedule
+type scheduleStatus struct {
+	Schedule		weekSchedule		`json:"schedule"`
+	Current			*activePeriod		`json:"current,omitempty"`
+	Next			*activePeriod		`json:"next,omitempty"`
+}
+
+func ( s *scheduler ) status() scheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	st  := scheduleStatus{ Schedule: s.sched }
+	if p, ok := s.sched.periodAt( now ); ok {
+		st.Current = &p
+	}
+	if p, ok := s.sched.nextPeriod( now ); ok {
+		st.Next = &p
+	}
+	return st
+}	// status
+
+// mountScheduleAPI adds the schedule handlers to mux.
+func mountScheduleAPI( mux *http.ServeMux, s *scheduler ) {
+	mux.HandleFunc( "GET /api/schedule", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON( w, http.StatusOK, s.status() )
+	} )
+
+	mux.HandleFunc( "PUT /api/schedule", func(w http.ResponseWriter, r *http.Request) {
+		var sched weekSchedule
+		if err := json.NewDecoder( r.Body ).Decode( &sched ); err != nil {
+			writeError( w, http.StatusBadRequest, "invalid schedule: " + err.Error() )
+			return
+		}
+		if err := sched.validate(); err != nil {
+			writeError( w, http.StatusUnprocessableEntity, err.Error() )
+			return
+		}
+		s.mu.Lock()
+		old := s.sched
+		s.sched   = sched
+		s.applied = time.Time{}					// Apply the current period of the new schedule
+		err := s.save()
+		if err != nil {
+			s.sched = old
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError( w, http.StatusInternalServerError, "schedule not saved: " + err.Error() )
+			return
+		}
+		controlLog.Info( "schedule - replaced by " + requestIdentity(r).User )
+		go s.tick( time.Now() )
+		writeJSON( w, http.StatusOK, s.status() )
+	} )
+
+	mux.HandleFunc( "POST /api/schedule/skip", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		next, ok := s.sched.nextPeriod( time.Now() )
+		err := errors.New( "no next period to skip" )
+		if ok {
+			s.sched.SkipNext = &next.At
+			err = s.save()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError( w, http.StatusConflict, err.Error() )
+			return
+		}
+		writeJSON( w, http.StatusOK, s.status() )
+	} )
+
+	mux.HandleFunc( "DELETE /api/schedule/skip", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.sched.SkipNext = nil
+		err := s.save()
+		s.mu.Unlock()
+		if err != nil {
+			writeError( w, http.StatusInternalServerError, err.Error() )
+			return
+		}
+		writeJSON( w, http.StatusOK, s.status() )
+	} )
+}	// mountScheduleAPI
+
+// plannedSetpoints returns the scheduled heat and cool setpoints at each time, the daily chart's samples,
+// nil when the schedule is off or has nothing for them.
+func ( s *scheduler ) plannedSetpoints( times []time.Time ) ( heat []opts.LineData, cool []opts.LineData ) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.sched.Enabled {
+		return nil, nil
+	}
+	for _, t := range times {
+		p, ok := s.sched.periodAt( t )
+		if !ok {
+			return nil, nil
+		}
+		heat = append( heat, opts.LineData{ Value: p.HeatSetpoint } )
+		cool = append( cool, opts.LineData{ Value: p.CoolSetpoint } )
+	}
+	return heat, cool
+}	// plannedSetpoints
+
@@ -0,0 +1,234 @@
+package main
+	// The one HTTP server for the control UI, the API, the charts and the documents.
+	//		/				redirect to /ui/
+	//		/ui/			control UI, app.html + ui.html + app.js embedded in the binary
+	//		/api/			thermostat control API, controlapi.go, /api/backup needs the control role, backup.go
+	//		/charts/		chart, CSV and index files under filePath, plus /charts/analysis and /charts/history
+	//		/docs/			HomeDocs and Photos folders under filePath
+	//		/infinitive/	old 8081 path to charts and docs, so bookmarks keep working
+	//		/login			sign in page, /logout ends the session, see auth.go
+	// The content served under /charts/, /docs/ and /infinitive/ is limited by docserver.go.
+	// The UI and the API need an account when auth is on, the charts and docs too unless -anoncharts.
+	// The main listener is -listen (default :8080, or -httpport), with TLS when -tlscert and -tlskey are given.
+	// The same router is also on -compatlisten (default :8081, plain http) unless that is set empty.
+	// Requests are logged to the access log in combined log format.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acd/infinitive/infinity"
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed app.html ui.html app.js
+var uiAssets embed.FS
+
+var chartsPrefix	= "/charts/"
+var docsPrefix		= "/docs/"
+var legacyPrefix	= "/infinitive/"		// The 8081 static server path before the single server
+var accessLogName	= "infinitiveAccess.log"
+
+// The running server and its listeners
+type webServer struct {
+	servers		[]*http.Server
+	errs		chan error
+	accessLog	io.WriteCloser
+}
+
+// Listener and content settings, web: in the config file
+type webOptions struct {
+	Listen			string			`yaml:"listen" json:"listen"`
+	CompatListen	string			`yaml:"compatListen" json:"compatListen"`
+	TLSCert			string			`yaml:"tlsCert" json:"tlsCert"`
+	TLSKey			string			`yaml:"tlsKey" json:"tlsKey"`
+	Content			string			`yaml:"content" json:"content"`			// Content roots served, see docserver.go
+	Auth			string			`yaml:"auth" json:"auth"`				// auto, on or off, see auth.go
+	AnonCharts		bool			`yaml:"anonCharts" json:"anonCharts"`	// Charts and docs need no account
+}
+
+// newRouter mounts the UI, the API, the charts and the documents.
+// Everything under /api/ is on its own mux behind the auth guard, so new API handlers are covered.
+func newRouter( api *infinity.Api, content *contentServer, auth *authenticator ) *http.ServeMux {
+	mux    := http.NewServeMux()
+	apiMux := http.NewServeMux()
+
+	mux.Handle( "GET /{$}", http.RedirectHandler( "/ui/", http.StatusFound ) )
+	mux.Handle( "GET /ui/", auth.require( roleViewer, http.HandlerFunc(serveUI) ) )
+	auth.mount( mux, apiMux )
+	mountControlAPI( apiMux, api )
+	mountScheduleAPI( apiMux, scheduleEngine )
+	mountOverrideAPI( apiMux, overrideEngine )
+	mountProfileAPI( apiMux, profileEngine )
+	mountCirculationAPI( apiMux, circulationEngine )
+	mountOccupancyAPI( mux, apiMux, auth, occupancyEngine )
+	mountRecoveryAPI( apiMux, recoveryEngine )
+	mountCalendarAPI( apiMux, calendarEngine )
+	mountConfigAPI( apiMux )
+	mountJobsAPI( apiMux, jobEngine )
+	mountArchiveAPI( apiMux )
+	mountHistoryAPI( apiMux )
+	mux.Handle( "/api/", auth.apiGuard( apiMux ) )
+	mountBackupAPI( mux, auth )
+	mux.Handle( "GET /debug/logs", auth.require( roleControl, http.HandlerFunc(logsHandler) ) )
+	mux.Handle( "GET " + chartsPrefix, auth.content( content.chartsHandler(chartsPrefix) ) )
+	mux.Handle( "GET " + chartsPrefix + "analysis", auth.content( http.HandlerFunc(analysisHandler) ) )
+	mux.Handle( "GET " + chartsPrefix + "history", auth.content( http.HandlerFunc(historyHandler) ) )
+	mux.Handle( "GET " + docsPrefix, auth.content( content.docsHandler(docsPrefix) ) )
+	mux.Handle( "GET " + legacyPrefix, auth.content( content.legacyHandler(legacyPrefix) ) )
+	mux.Handle( "GET " + legacyPrefix + "analysis", auth.content( http.HandlerFunc(analysisHandler) ) )
+	mux.Handle( "GET " + legacyPrefix + "history", auth.content( http.HandlerFunc(historyHandler) ) )
+	return mux
+}	// newRouter
+
+// serveUI serves the embedded UI files, app.html is the page for /ui/.
+func serveUI( w http.ResponseWriter, r *http.Request ) {
+	name := strings.TrimPrefix( r.URL.Path, "/ui/" )
+	if name == "" {
+		name = "app.html"
+	}
+	data, err := uiAssets.ReadFile( name )
+	if err != nil {
+		http.NotFound( w, r )
+		return
+	}
+	http.ServeContent( w, r, name, startTime, bytes.NewReader(data) )
+}	// serveUI
+
+var startTime = time.Now()				// Modification time of the embedded files
+
+// startWebServer starts the listeners. Errors after startup arrive on ws.errs.
+func startWebServer( api *infinity.Api, opt webOptions ) ( *webServer, error ) {
+	ws := &webServer{ errs: make(chan error, 2) }
+	if (opt.TLSCert == "") != (opt.TLSKey == "") {
+		return nil, errors.New( "both -tlscert and -tlskey are needed for TLS" )
+	}
+	content, err := newContentServer( opt.Content )
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newAuthenticator( opt.Auth, opt.AnonCharts )
+	if err != nil {
+		return nil, err
+	}
+	var accessLog io.Writer = os.Stderr
+	if l, err := openRotatingLog( logPath + accessLogName ); err == nil {
+		ws.accessLog, accessLog = l, l
+	} else {
+		apiLog.Warn( "startWebServer - access log not available, using stderr: ", err )
+	}
+	handler := logAccess( newRouter(api, content, auth), accessLog )
+
+	ws.listen( &http.Server{ Addr: opt.Listen, Handler: handler, ReadHeaderTimeout: 10*time.Second }, opt.TLSCert, opt.TLSKey )
+	if opt.CompatListen != "" && opt.CompatListen != opt.Listen {
+		ws.listen( &http.Server{ Addr: opt.CompatListen, Handler: handler, ReadHeaderTimeout: 10*time.Second }, "", "" )
+	}
+	return ws, nil
+}	// startWebServer
+
+func ( ws *webServer ) listen( srv *http.Server, tlsCert string, tlsKey string ) {
+	ws.servers = append( ws.servers, srv )
+	go func() {
+		var err error
+		if tlsCert != "" {
+			apiLog.WithFields( log.Fields{ "addr": srv.Addr, "tls": true } ).Info( "webServer - listening" )
+			err = srv.ListenAndServeTLS( tlsCert, tlsKey )
+		} else {
+			apiLog.WithField( "addr", srv.Addr ).Info( "webServer - listening" )
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is( err, http.ErrServerClosed ) {
+			ws.errs <- fmt.Errorf( "%s: %w", srv.Addr, err )
+		}
+	}()
+}	// listen
+
+// Shutdown stops accepting connections and waits for requests in progress until ctx is done.
+func ( ws *webServer ) Shutdown( ctx context.Context ) error {
+	var wg sync.WaitGroup
+
+	errs := make( []error, len(ws.servers) )
+	for i, srv := range ws.servers {
+		wg.Add( 1 )
+		go func() {
+			defer wg.Done()
+			errs[i] = srv.Shutdown( ctx )
+		}()
+	}
+	wg.Wait()
+	if ws.accessLog != nil {
+		ws.accessLog.Close()
+	}
+	return errors.Join( errs... )
+}	// Shutdown
+
+// Response writer that keeps the status and size for the access log
+type loggingWriter struct {
+	http.ResponseWriter
+	status		int
+	size		int64
+}
+
+func ( lw *loggingWriter ) WriteHeader( status int ) {
+	lw.status = status
+	lw.ResponseWriter.WriteHeader( status )
+}
+
+func ( lw *loggingWriter ) Write( b []byte ) ( int, error ) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write( b )
+	lw.size += int64( n )
+	return n, err
+}
+
+// Hijack passes through for the websocket
+func ( lw *loggingWriter ) Hijack() ( net.Conn, *bufio.ReadWriter, error ) {
+	h, ok := lw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New( "hijack not supported" )
+	}
+	lw.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func ( lw *loggingWriter ) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logAccess writes one combined log format line per request.
+func logAccess( next http.Handler, out io.Writer ) http.Handler {
+	var mu sync.Mutex
+
+	return http.HandlerFunc( func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw    := &loggingWriter{ ResponseWriter: w }
+		next.ServeHTTP( lw, r )
+		if lw.status == 0 {
+			lw.status = http.StatusOK					// Nothing written, net/http sends 200
+		}
+		host, _, err := net.SplitHostPort( r.RemoteAddr )
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		line := fmt.Sprintf( "%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %dms\n", host, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, r.URL.RequestURI(), r.Proto, lw.status, lw.size, r.Referer(), r.UserAgent(), time.Since(start).Milliseconds() )
+		mu.Lock()
+		io.WriteString( out, line )
+		mu.Unlock()
+	} )
+}	// logAccess
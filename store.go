@@ -0,0 +1,360 @@
+package main
+	// Where samples and events are kept, store: in the config file. Charts, reports and the APIs read through
+	// dataStore rather than opening files, the sample job and the audit log write through it.
+	//		csv		the daily YYYY-MM/YYYY-MM-DD_Infinitive.csv files and infinitiveAudit.jsonl, as always,
+	//				the hourly and daily rollups in YYYY-MM/rollups.json, see rollup.go
+	//		bolt	one embedded database file, filePath+dbFileName unless store.file, see storebolt.go
+	// The chart HTML files and the month folders stay either way, only the data behind them moves.
+	// infinitive migrate loads the CSV files, archived days included, the rollups and the audit log into the database,
+	// run it with the service stopped and then set store.backend to bolt. It may be run again, nothing is doubled.
+	//		infinitive migrate [-db /var/lib/infinitive/infinitive.db]
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var dbFileName	= "infinitive.db"
+var rollupsFileName	= "rollups.json"
+var csvHeader	= "Date,Time,FracTime,Heat Set,Cool Set,Outdoor Temp,Current Temp,BlowerRPM,Mode,Circulate,Stage\n"
+
+var migrateUsage = `usage: infinitive migrate [-config FILE] [-db FILE]`
+
+// Store keeps the samples and events. Ranges are from inclusive, to exclusive, oldest first.
+type Store interface {
+	AppendStart( t time.Time ) error							// Infinitive started, counted as a restart of the day
+	AppendSample( s hvacSample ) error
+	AppendEvent( e auditEntry ) error
+	Samples( from, to time.Time ) ( []hvacSample, error )
+	Events( from, to time.Time ) ( []auditEntry, error )
+	DailySummary( day time.Time ) ( daySummary, bool )			// False when the day has no samples
+	Rollups( res rollupRes, from, to time.Time ) ( []rollup, error )	// By their start
+	PutRollups( res rollupRes, from, to time.Time, list []rollup ) error	// In place of those from..to
+	Close() error
+}
+
+var dataStore Store
+
+// openStore opens the configured store, the database is created when missing.
+func openStore( c configStore ) ( Store, error ) {
+	switch c.Backend {
+	case "bolt":
+		file := c.File
+		if file == "" {
+			file = filePath + dbFileName
+		}
+		return openBoltStore( file )
+	default:
+		return &csvStore{}, nil
+	}
+}	// openStore
+
+// startOfDay is midnight at the start of the day.
+func startOfDay( t time.Time ) time.Time {
+	return time.Date( t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local )
+}	// startOfDay
+
+// daySamples are the samples of the day the time is in.
+func daySamples( day time.Time ) ( []hvacSample, error ) {
+	start := startOfDay( day )
+	return dataStore.Samples( start, start.AddDate(0, 0, 1) )
+}	// daySamples
+
+// formatSampleLine is one line of a daily CSV file, the fixed columns the charts were first written for.
+func formatSampleLine( s hvacSample ) string {
+	circulate, marker := 0, ""
+	if s.Circulating {
+		circulate = 1
+	}
+	if s.Shutdown {
+		marker = ",shutdown"
+	}
+	return fmt.Sprintf( "%s,%09.4f,%04d,%04d,%04d,%04d,%04d,%s,%d,%d%s\n", s.When.Format("2006-01-02T15:04:05"),
+		s.FracDay, s.HeatSet, s.CoolSet, s.OutdoorTemp, s.CurrentTemp, s.BlowerRPM, s.HvacMode, circulate, s.Stage, marker )
+}	// formatSampleLine
+
+// The daily CSV files, one open for appending, and the audit log file
+type csvStore struct {
+	mu				sync.Mutex
+	f				*os.File
+	name			string
+}
+
+// open starts the day's file with a header line, in a new month folder on the 1st, call with c.mu held.
+func ( c *csvStore ) open( day time.Time ) error {
+	if c.f != nil {
+		if err := c.close(); err != nil {
+			recorderLog.Error( "csvStore - closing daily: " + c.name + " ", err )
+		}
+	}
+	ensureMonthDir( day )
+	c.f, c.name = openDailyFile( day, os.O_APPEND|os.O_CREATE|os.O_WRONLY, true )
+	if c.f == nil {
+		return errors.New( "daily file not open: " + c.name )
+	}
+	return os.Chmod( c.name, 0664 )							// beware file permissions! Or you get 0644.
+}	// open
+
+func ( c *csvStore ) close() error {
+	err := c.f.Sync()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	c.f = nil
+	return err
+}	// close
+
+func ( c *csvStore ) AppendStart( t time.Time ) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open( t )
+}	// AppendStart
+
+// AppendSample writes to the sample's day file, the first sample of a new day starts its file.
+func ( c *csvStore ) AppendSample( s hvacSample ) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil || c.name != dailyFileFor( s.When ) {
+		if err := c.open( s.When ); err != nil {
+			return err
+		}
+	}
+	_, err := c.f.WriteString( formatSampleLine(s) )
+	return err
+}	// AppendSample
+
+func ( c *csvStore ) AppendEvent( e auditEntry ) error {
+	line, err := json.Marshal( e )
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile( filePath + auditFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644 )
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write( append(line, '\n') )
+	return err
+}	// AppendEvent
+
+// Samples reads the daily files of the range, a missing day is no samples.
+func ( c *csvStore ) Samples( from, to time.Time ) ( []hvacSample, error ) {
+	var samples []hvacSample
+
+	for day := startOfDay( from ); day.Before( to ); day = day.AddDate(0, 0, 1) {
+		list, _, err := readDailySamples( dailyFileFor(day) )
+		if errors.Is( err, os.ErrNotExist ) {
+			continue
+		}
+		if err != nil {
+			return samples, err
+		}
+		for _, s := range list {
+			if !s.When.Before( from ) && s.When.Before( to ) {
+				samples = append( samples, s )
+			}
+		}
+	}
+	return samples, nil
+}	// Samples
+
+func ( c *csvStore ) Events( from, to time.Time ) ( []auditEntry, error ) {
+	var entries []auditEntry
+
+	f, err := os.Open( filePath + auditFileName )
+	if errors.Is( err, os.ErrNotExist ) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner( f )
+	for scanner.Scan() {
+		var e auditEntry
+		if json.Unmarshal( scanner.Bytes(), &e ) != nil || e.Time.Before( from ) || !e.Time.Before( to ) {
+			continue
+		}
+		entries = append( entries, e )
+	}
+	return entries, scanner.Err()
+}	// Events
+
+func ( c *csvStore ) DailySummary( day time.Time ) ( daySummary, bool ) {
+	return summarizeDay( startOfDay(day) )
+}	// DailySummary
+
+// The rollups of one month, in its folder
+type rollupsFile struct {
+	Hour			[]rollup		`json:"hour"`
+	Day				[]rollup		`json:"day"`
+}
+
+func rollupsFileFor( month time.Time ) string {
+	return filePath + month.Format("2006-01") + "/" + rollupsFileName
+}	// rollupsFileFor
+
+func readRollupsFile( month time.Time ) ( rollupsFile, error ) {
+	var rf rollupsFile
+
+	f, err := openDataFile( rollupsFileFor(month) )			// Or from an archive made before rollups were kept out
+	if errors.Is( err, os.ErrNotExist ) {
+		return rf, nil
+	}
+	if err != nil {
+		return rf, err
+	}
+	defer f.Close()
+	err = json.NewDecoder( f ).Decode( &rf )
+	return rf, err
+}	// readRollupsFile
+
+// list is the resolution's rollups of the file.
+func ( rf *rollupsFile ) list( res rollupRes ) *[]rollup {
+	if res == rollupHour {
+		return &rf.Hour
+	}
+	return &rf.Day
+}	// list
+
+func ( c *csvStore ) Rollups( res rollupRes, from, to time.Time ) ( []rollup, error ) {
+	var list []rollup
+
+	for month := time.Date( from.Year(), from.Month(), 1, 0, 0, 0, 0, time.Local ); month.Before( to ); month = month.AddDate(0, 1, 0) {
+		rf, err := readRollupsFile( month )
+		if err != nil {
+			return list, fmt.Errorf( "%s: %w", rollupsFileFor(month), err )
+		}
+		for _, r := range *rf.list( res ) {
+			if !r.Start.Before( from ) && r.Start.Before( to ) {
+				list = append( list, r )
+			}
+		}
+	}
+	return list, nil
+}	// Rollups
+
+// PutRollups rewrites the month files from..to touches, through a temp file.
+func ( c *csvStore ) PutRollups( res rollupRes, from, to time.Time, list []rollup ) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for month := time.Date( from.Year(), from.Month(), 1, 0, 0, 0, 0, time.Local ); month.Before( to ); month = month.AddDate(0, 1, 0) {
+		rf, err := readRollupsFile( month )
+		if err != nil {
+			return fmt.Errorf( "%s: %w", rollupsFileFor(month), err )
+		}
+		next, kept := month.AddDate( 0, 1, 0 ), (*rf.list( res ))[:0]
+		for _, r := range *rf.list( res ) {
+			if r.Start.Before( from ) || !r.Start.Before( to ) {
+				kept = append( kept, r )
+			}
+		}
+		for _, r := range list {
+			if !r.Start.Before( month ) && r.Start.Before( next ) {
+				kept = append( kept, r )
+			}
+		}
+		sort.Slice( kept, func(i, j int) bool { return kept[i].Start.Before(kept[j].Start) } )
+		*rf.list( res ) = kept
+		data, err := json.Marshal( rf )
+		if err != nil {
+			return err
+		}
+		file := rollupsFileFor( month )
+		tmp  := file + ".tmp"
+		if err = os.MkdirAll( filepath.Dir(file), 0755 ); err == nil {
+			err = os.WriteFile( tmp, append(data, '\n'), 0644 )
+		}
+		if err == nil {
+			err = os.Rename( tmp, file )
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}	// PutRollups
+
+func ( c *csvStore ) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	name := c.name
+	err  := c.close()
+	os.Chmod( name, 0664 )
+	return err
+}	// Close
+
+// runMigrateCommand loads the CSV files and the audit log into the database, args follow "migrate".
+func runMigrateCommand( c config, args []string ) error {
+	file := c.Store.File
+	if file == "" {
+		file = filePath + dbFileName
+	}
+	fs := flag.NewFlagSet( "migrate", flag.ContinueOnError )
+	fs.StringVar( &file, "db", file, "database file" )
+	fs.Usage = func() { fmt.Fprintln( os.Stderr, migrateUsage ); fs.PrintDefaults() }
+	if err := fs.Parse( args ); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New( migrateUsage )
+	}
+	db, err := openBoltStore( file )
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	total := 0
+	for _, month := range archiveMonths() {
+		days, samples := 0, 0
+		for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+			list, restarts, err := readDailySamples( dailyFileFor(day) )		// Archived days too
+			if err != nil && !errors.Is( err, os.ErrNotExist ) {
+				return fmt.Errorf( "%s: %w", day.Format("2006-01-02"), err )
+			}
+			sum, ok := summarizeDay( day )									// Pruned days have only this
+			if err = db.load( day, list, restarts, sum, ok ); err != nil {
+				return fmt.Errorf( "%s: %w", day.Format("2006-01-02"), err )
+			}
+			if ok || len(list) > 0 {
+				days++
+			}
+			samples += len( list )
+		}
+		for _, res := range []rollupRes{ rollupHour, rollupDay } {			// Rollups the csv store kept, rebuilt later if none
+			list, err := (&csvStore{}).Rollups( res, month, month.AddDate(0, 1, 0) )
+			if err == nil && len(list) > 0 {
+				err = db.PutRollups( res, month, month.AddDate(0, 1, 0), list )
+			}
+			if err != nil {
+				return fmt.Errorf( "%s: %w", month.Format("2006-01"), err )
+			}
+		}
+		if days > 0 {
+			fmt.Printf( "%s: %d days, %d samples\n", month.Format("2006-01"), days, samples )
+		}
+		total += samples
+	}
+	events, err := (&csvStore{}).Events( time.Time{}, time.Now().AddDate(1, 0, 0) )
+	if err == nil {
+		err = db.loadEvents( events )
+	}
+	if err != nil {
+		return fmt.Errorf( "%s: %w", auditFileName, err )
+	}
+	fmt.Printf( "%d samples and %d events in %s. Set store: { backend: bolt } in %s and start the service.\n",
+		total, len(events), file, configFileName )
+	return nil
+}	// runMigrateCommand
@@ -0,0 +1,284 @@
+package main
+	// The embedded database store, one bbolt file, no server and no cgo so it builds for the Pi as before.
+	// Buckets, keys sort by time so a range is one cursor walk:
+	//		samples		UnixNano, 8 bytes big endian				a hvacSample as JSON
+	//		starts		UnixNano									Infinitive started, or a new day began, like a CSV header line
+	//		events		UnixNano then a sequence, 16 bytes			an auditEntry as JSON
+	//		summaries	YYYY-MM-DD									a daySummary as JSON, past days only
+	//		hourly		UnixNano of the hour						a rollup as JSON, see rollup.go
+	//		daily		UnixNano of the day							a rollup as JSON
+	// A past day's summary is worked out once and kept, migrate writes them too, pruned days included.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	samplesBucket	= []byte( "samples" )
+	startsBucket	= []byte( "starts" )
+	eventsBucket	= []byte( "events" )
+	summariesBucket	= []byte( "summaries" )
+	hourlyBucket	= []byte( "hourly" )
+	dailyBucket		= []byte( "daily" )
+)
+
+type boltStore struct {
+	db				*bolt.DB
+	mu				sync.Mutex
+	lastDay			time.Time					// Day of the last start or sample, a new day counts as a start
+}
+
+// openBoltStore opens or creates the database, an error rather than a wait when another process has it open.
+func openBoltStore( file string ) ( *boltStore, error ) {
+	db, err := bolt.Open( file, 0644, &bolt.Options{ Timeout: time.Second } )
+	if err != nil {
+		return nil, fmt.Errorf( "%s: %w", file, err )
+	}
+	err = db.Update( func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{ samplesBucket, startsBucket, eventsBucket, summariesBucket, hourlyBucket, dailyBucket } {
+			if _, err := tx.CreateBucketIfNotExists( name ); err != nil {
+				return err
+			}
+		}
+		return nil
+	} )
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf( "%s: %w", file, err )
+	}
+	return &boltStore{ db: db }, nil
+}	// openBoltStore
+
+// timeKey sorts by time, anything before 1970 like a zero time is the first key.
+func timeKey( t time.Time ) []byte {
+	key := make( []byte, 8 )
+	if t.Unix() >= 0 {
+		binary.BigEndian.PutUint64( key, uint64(t.UnixNano()) )
+	}
+	return key
+}	// timeKey
+
+func eventKey( t time.Time, seq uint64 ) []byte {
+	return binary.BigEndian.AppendUint64( timeKey(t), seq )
+}	// eventKey
+
+// boltPut stores v as JSON under key in the bucket.
+func boltPut( tx *bolt.Tx, bucket []byte, key []byte, v any ) error {
+	data, err := json.Marshal( v )
+	if err != nil {
+		return err
+	}
+	return tx.Bucket( bucket ).Put( key, data )
+}	// boltPut
+
+func ( b *boltStore ) AppendStart( t time.Time ) error {
+	b.mu.Lock()
+	b.lastDay = startOfDay( t )
+	b.mu.Unlock()
+	return b.db.Update( func(tx *bolt.Tx) error {
+		return tx.Bucket( startsBucket ).Put( timeKey(t), nil )
+	} )
+}	// AppendStart
+
+func ( b *boltStore ) AppendSample( s hvacSample ) error {
+	b.mu.Lock()
+	newDay := !b.lastDay.Equal( startOfDay(s.When) )
+	b.lastDay = startOfDay( s.When )
+	b.mu.Unlock()
+	return b.db.Update( func(tx *bolt.Tx) error {
+		if newDay {
+			if err := tx.Bucket( startsBucket ).Put( timeKey(startOfDay(s.When)), nil ); err != nil {
+				return err
+			}
+		}
+		return boltPut( tx, samplesBucket, timeKey(s.When), s )
+	} )
+}	// AppendSample
+
+func ( b *boltStore ) AppendEvent( e auditEntry ) error {
+	return b.db.Update( func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket( eventsBucket ).NextSequence()
+		if err != nil {
+			return err
+		}
+		return boltPut( tx, eventsBucket, eventKey(e.Time, seq), e )
+	} )
+}	// AppendEvent
+
+// boltScan decodes each value with a key from..to into one new item.
+func boltScan[T any]( b *boltStore, bucket []byte, from, to time.Time ) ( []T, error ) {
+	var list []T
+
+	end := timeKey( to )
+	err := b.db.View( func(tx *bolt.Tx) error {
+		c := tx.Bucket( bucket ).Cursor()
+		for k, v := c.Seek( timeKey(from) ); k != nil && string(k[:8]) < string(end); k, v = c.Next() {
+			var item T
+			if err := json.Unmarshal( v, &item ); err != nil {
+				return fmt.Errorf( "%s %x: %w", bucket, k, err )
+			}
+			list = append( list, item )
+		}
+		return nil
+	} )
+	return list, err
+}	// boltScan
+
+func ( b *boltStore ) Samples( from, to time.Time ) ( []hvacSample, error ) {
+	return boltScan[hvacSample]( b, samplesBucket, from, to )
+}	// Samples
+
+func ( b *boltStore ) Events( from, to time.Time ) ( []auditEntry, error ) {
+	return boltScan[auditEntry]( b, eventsBucket, from, to )
+}	// Events
+
+// starts counts the starts from..to.
+func ( b *boltStore ) starts( from, to time.Time ) int {
+	n := 0
+	b.db.View( func(tx *bolt.Tx) error {
+		c := tx.Bucket( startsBucket ).Cursor()
+		for k, _ := c.Seek( timeKey(from) ); k != nil && string(k) < string(timeKey(to)); k, _ = c.Next() {
+			n++
+		}
+		return nil
+	} )
+	return n
+}	// starts
+
+// DailySummary is the kept summary of a past day, or worked out from the day's samples.
+func ( b *boltStore ) DailySummary( day time.Time ) ( daySummary, bool ) {
+	var sum daySummary
+
+	day   = startOfDay( day )
+	key  := []byte( day.Format("2006-01-02") )
+	kept := false
+	b.db.View( func(tx *bolt.Tx) error {
+		if data := tx.Bucket( summariesBucket ).Get( key ); data != nil {
+			kept = json.Unmarshal( data, &sum ) == nil
+		}
+		return nil
+	} )
+	if kept {
+		return sum, sum.Samples > 0
+	}
+	samples, err := b.Samples( day, day.AddDate(0, 0, 1) )
+	if err != nil {
+		chartsLog.Error( "boltStore - summary: ", err )
+		return daySummary{}, false
+	}
+	sum = summarizeSamples( day, samples )
+	sum.Restarts = b.starts( day, day.AddDate(0, 0, 1) )
+	if sum.Samples > 0 && day.Before( startOfDay(time.Now()) ) {
+		err = b.db.Update( func(tx *bolt.Tx) error {
+			return boltPut( tx, summariesBucket, key, sum )
+		} )
+		if err != nil {
+			chartsLog.Error( "boltStore - summary save: ", err )
+		}
+	}
+	return sum, sum.Samples > 0
+}	// DailySummary
+
+func rollupBucket( res rollupRes ) []byte {
+	if res == rollupHour {
+		return hourlyBucket
+	}
+	return dailyBucket
+}	// rollupBucket
+
+func ( b *boltStore ) Rollups( res rollupRes, from, to time.Time ) ( []rollup, error ) {
+	return boltScan[rollup]( b, rollupBucket(res), from, to )
+}	// Rollups
+
+func ( b *boltStore ) PutRollups( res rollupRes, from, to time.Time, list []rollup ) error {
+	return b.db.Update( func(tx *bolt.Tx) error {
+		c := tx.Bucket( rollupBucket(res) ).Cursor()
+		for k, _ := c.Seek( timeKey(from) ); k != nil && string(k) < string(timeKey(to)); k, _ = c.Seek( timeKey(from) ) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		for _, r := range list {
+			if err := boltPut( tx, rollupBucket(res), timeKey(r.Start), r ); err != nil {
+				return err
+			}
+		}
+		return nil
+	} )
+}	// PutRollups
+
+func ( b *boltStore ) Close() error {
+	return b.db.Close()
+}	// Close
+
+// load replaces a day with the samples, starts and summary read from its CSV file, for migrate.
+func ( b *boltStore ) load( day time.Time, samples []hvacSample, restarts int, sum daySummary, summarized bool ) error {
+	from, to := timeKey( day ), timeKey( day.AddDate(0, 0, 1) )
+	return b.db.Update( func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{ samplesBucket, startsBucket } {
+			c := tx.Bucket( bucket ).Cursor()
+			for k, _ := c.Seek( from ); k != nil && string(k) < string(to); k, _ = c.Seek( from ) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		for _, s := range samples {
+			if err := boltPut( tx, samplesBucket, timeKey(s.When), s ); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < restarts; i++ {
+			if err := tx.Bucket( startsBucket ).Put( timeKey(day.Add(time.Duration(i))), nil ); err != nil {
+				return err
+			}
+		}
+		if !summarized {
+			return nil
+		}
+		return boltPut( tx, summariesBucket, []byte(day.Format("2006-01-02")), sum )
+	} )
+}	// load
+
+// loadEvents stores the audit log entries not stored yet, the same entry at the same time is there already,
+// from an earlier migrate or written live, so a second migrate adds only what is new.
+func ( b *boltStore ) loadEvents( events []auditEntry ) error {
+	return b.db.Update( func(tx *bolt.Tx) error {
+		bucket := tx.Bucket( eventsBucket )
+		for _, e := range events {
+			data, err := json.Marshal( e )
+			if err != nil {
+				return err
+			}
+			if boltHasEvent( bucket, timeKey(e.Time), data ) {
+				continue
+			}
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put( eventKey(e.Time, seq), data ); err != nil {
+				return err
+			}
+		}
+		return nil
+	} )
+}	// loadEvents
+
+// boltHasEvent is true when an event at the time, the key prefix, is stored as data.
+func boltHasEvent( bucket *bolt.Bucket, prefix, data []byte ) bool {
+	c := bucket.Cursor()
+	for k, v := c.Seek( prefix ); k != nil && bytes.HasPrefix( k, prefix ); k, v = c.Next() {
+		if bytes.Equal( v, data ) {
+			return true
+		}
+	}
+	return false
+}	// boltHasEvent
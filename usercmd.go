@@ -0,0 +1,174 @@
+package main
+	// The user subcommand, manages the accounts in filePath+usersFileName. A running server picks up changes by itself.
+	//		infinitive user list
+	//		infinitive user add NAME viewer|presence|control		asks for the password, or reads it from stdin
+	//		infinitive user passwd NAME
+	//		infinitive user role NAME viewer|presence|control
+	//		infinitive user del NAME
+	//		infinitive user token NAME LABEL				prints a new API token, it is not shown again
+	//		infinitive user revoke NAME LABEL
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+var userUsage = `usage: infinitive user list
+       infinitive user add NAME viewer|presence|control
+       infinitive user passwd NAME
+       infinitive user role NAME viewer|presence|control
+       infinitive user del NAME
+       infinitive user token NAME LABEL
+       infinitive user revoke NAME LABEL
+-config FILE reads the data folder from another config file`
+
+// runUserCommand does one user subcommand, args follow "user".
+func runUserCommand( args []string ) error {
+	if len(args) == 0 {
+		return errors.New( userUsage )
+	}
+	fileName := filePath + usersFileName
+	users, err := readUsers( fileName )
+	if err != nil {
+		return err
+	}
+	need := map[string]int{ "list": 1, "add": 3, "passwd": 2, "role": 3, "del": 2, "token": 3, "revoke": 3 }
+	if n, ok := need[args[0]]; !ok || len(args) != n {
+		return errors.New( userUsage )
+	}
+	if args[0] == "list" {
+		names := make( []string, 0, len(users) )
+		for name := range users {
+			names = append( names, name )
+		}
+		sort.Strings( names )
+		for _, name := range names {
+			u := users[name]
+			fmt.Printf( "%-16s %-8s", u.Name, u.Role )
+			for _, t := range u.Tokens {
+				fmt.Printf( " token:%s(%s)", t.Label, t.Created.Format("2006-01-02") )
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+
+	var newToken string
+
+	name := args[1]
+	u, found := users[name]
+	switch args[0] {
+	case "add":
+		if found {
+			return fmt.Errorf( "user %s exists", name )
+		}
+		if _, ok := roleNames[args[2]]; !ok {
+			return fmt.Errorf( "unknown role %q, use viewer, presence or control", args[2] )
+		}
+		u = userAccount{ Name: name, Role: args[2] }
+		if u.Password, err = askPassword(); err != nil {
+			return err
+		}
+	case "passwd":
+		if !found {
+			return fmt.Errorf( "no user %s", name )
+		}
+		if u.Password, err = askPassword(); err != nil {
+			return err
+		}
+	case "role":
+		if !found {
+			return fmt.Errorf( "no user %s", name )
+		}
+		if _, ok := roleNames[args[2]]; !ok {
+			return fmt.Errorf( "unknown role %q, use viewer, presence or control", args[2] )
+		}
+		u.Role = args[2]
+	case "del":
+		if !found {
+			return fmt.Errorf( "no user %s", name )
+		}
+		delete( users, name )
+		return writeUsers( fileName, users )
+	case "token":
+		if !found {
+			return fmt.Errorf( "no user %s", name )
+		}
+		for _, t := range u.Tokens {
+			if t.Label == args[2] {
+				return fmt.Errorf( "user %s already has token %s", name, args[2] )
+			}
+		}
+		newToken = tokenPrefix + randomHex( 32 )
+		sum     := sha256.Sum256( []byte(newToken) )
+		u.Tokens = append( u.Tokens, apiToken{ Label: args[2], Hash: hex.EncodeToString(sum[:]), Created: time.Now() } )
+	case "revoke":
+		if !found {
+			return fmt.Errorf( "no user %s", name )
+		}
+		kept := u.Tokens[:0]
+		for _, t := range u.Tokens {
+			if t.Label != args[2] {
+				kept = append( kept, t )
+			}
+		}
+		if len(kept) == len(u.Tokens) {
+			return fmt.Errorf( "user %s has no token %s", name, args[2] )
+		}
+		u.Tokens = kept
+	}
+	users[name] = u
+	if err = writeUsers( fileName, users ); err != nil {
+		return err
+	}
+	if newToken != "" {
+		fmt.Println( newToken )
+	}
+	return nil
+}	// runUserCommand
+
+// askPassword reads the password twice from a terminal, or once from piped stdin, and returns its bcrypt hash.
+func askPassword() ( string, error ) {
+	var password string
+
+	fd := int( os.Stdin.Fd() )
+	if term.IsTerminal( fd ) {
+		fmt.Print( "Password: " )
+		first, err := term.ReadPassword( fd )
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		fmt.Print( "Again: " )
+		second, err := term.ReadPassword( fd )
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		if string(first) != string(second) {
+			return "", errors.New( "passwords differ" )
+		}
+		password = string( first )
+	} else {
+		line, err := bufio.NewReader( os.Stdin ).ReadString( '\n' )
+		if err != nil && line == "" {
+			return "", err
+		}
+		password = strings.TrimRight( line, "\r\n" )
+	}
+	if len(password) < 8 {
+		return "", errors.New( "password needs at least 8 characters" )
+	}
+	hash, err := bcrypt.GenerateFromPassword( []byte(password), bcrypt.DefaultCost )
+	return string( hash ), err
+}	// askPassword